@@ -2,10 +2,17 @@ package options
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/skeeey/aggregator-proxy-server/pkg/api"
 	"github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/openapi"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
+	"github.com/skeeey/aggregator-proxy-server/pkg/controller"
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"github.com/skeeey/aggregator-proxy-server/pkg/proxy"
+	"github.com/skeeey/aggregator-proxy-server/pkg/retry"
 	"github.com/spf13/pflag"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	openapinamer "k8s.io/apiserver/pkg/endpoints/openapi"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	genericapiserveroptions "k8s.io/apiserver/pkg/server/options"
@@ -14,29 +21,119 @@ import (
 type Options struct {
 	KubeConfigFile string
 
+	// EnableAggregatorServices enables registering aggregator services with the AggregatorService resources
+	EnableAggregatorServices bool
+	// EnableAggregatorConfigMaps enables registering aggregator services with the labelled ConfigMaps,
+	// it is kept for migrating to the AggregatorService resources
+	EnableAggregatorConfigMaps bool
+	// AggregatorConfigMapNamespaces are the namespaces of the aggregator ConfigMaps, all namespaces if it is empty
+	AggregatorConfigMapNamespaces []string
+	// AggregatorConfigMapLabelSelector selects the aggregator ConfigMaps, only the selected ConfigMaps are cached
+	AggregatorConfigMapLabelSelector string
+	// StaticServicesFile is the yaml or json file of the static aggregator services, e.g. for the development
+	StaticServicesFile string
+	// StaticServicesSyncPeriod is how often the static services file is resynced, its changes are also watched
+	StaticServicesSyncPeriod time.Duration
+
+	// ClusterSource is the kind of the objects that the clusters are registered with, namespace or configmap
+	ClusterSource string
+	// ClusterLabelSelector selects the objects that the clusters are registered with
+	ClusterLabelSelector string
+	// ClusterNamespace is the namespace of the configmaps that the clusters are registered with
+	ClusterNamespace string
+
+	// FanOutConcurrency is the number of clusters that a fan-out request is sent to concurrently
+	FanOutConcurrency int
+	// FanOutMaxResponseBytes is the size limit of the response of a cluster to a fan-out request
+	FanOutMaxResponseBytes int64
+
+	// RouteToEndpoints sends the requests to the ready endpoints of the backend services directly
+	RouteToEndpoints bool
+	// LoadBalancingPolicy is the policy to pick an endpoint for a request when RouteToEndpoints is true
+	LoadBalancingPolicy string
+
+	// RetryBudgetRatio is the ratio of the retries to the proxied requests that all aggregator services can retry
+	RetryBudgetRatio float64
+	// RetryBudgetBurst is the number of the retries that can be sent before the budget is earned by the requests
+	RetryBudgetBurst int
+
+	// HealthProbeConcurrency is the number of the aggregator services that are probed concurrently
+	HealthProbeConcurrency int
+
 	ServerRun      *genericapiserveroptions.ServerRunOptions
 	SecureServing  *genericapiserveroptions.SecureServingOptionsWithLoopback
 	Authentication *genericapiserveroptions.DelegatingAuthenticationOptions
 	Authorization  *genericapiserveroptions.DelegatingAuthorizationOptions
+	Audit          *genericapiserveroptions.AuditOptions
 }
 
 // NewOptions constructs a new set of default options for aggregator-proxy-server.
 func NewOptions() *Options {
 	return &Options{
-		ServerRun:      genericapiserveroptions.NewServerRunOptions(),
-		SecureServing:  genericapiserveroptions.NewSecureServingOptions().WithLoopback(),
-		Authentication: genericapiserveroptions.NewDelegatingAuthenticationOptions(),
-		Authorization:  genericapiserveroptions.NewDelegatingAuthorizationOptions(),
+		EnableAggregatorServices:         true,
+		EnableAggregatorConfigMaps:       true,
+		AggregatorConfigMapLabelSelector: controller.DefaultAggregatorConfigMapLabelSelector,
+		StaticServicesSyncPeriod:         controller.DefaultFileSourceSyncPeriod,
+		ClusterSource:                    cluster.SourceNamespace,
+		ClusterLabelSelector:             "aggregation.open-cluster-management.io/cluster",
+		FanOutConcurrency:                proxy.DefaultFanOutConcurrency,
+		FanOutMaxResponseBytes:           proxy.DefaultFanOutMaxResponseBytes,
+		LoadBalancingPolicy:              proxy.PolicyRoundRobin,
+		RetryBudgetRatio:                 retry.DefaultBudgetRatio,
+		RetryBudgetBurst:                 retry.DefaultBudgetBurst,
+		HealthProbeConcurrency:           health.DefaultConcurrency,
+		ServerRun:                        genericapiserveroptions.NewServerRunOptions(),
+		SecureServing:                    genericapiserveroptions.NewSecureServingOptions().WithLoopback(),
+		Authentication:                   genericapiserveroptions.NewDelegatingAuthenticationOptions(),
+		Authorization:                    genericapiserveroptions.NewDelegatingAuthorizationOptions(),
+		Audit:                            genericapiserveroptions.NewAuditOptions(),
 	}
 }
 
 func (o *Options) AddFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&o.KubeConfigFile, "kube-config-file", "", "Kubernetes configuration file to connect to kube-apiserver")
+	fs.BoolVar(&o.EnableAggregatorServices, "enable-aggregator-services", o.EnableAggregatorServices,
+		"Register aggregator services with the AggregatorService resources")
+	fs.BoolVar(&o.EnableAggregatorConfigMaps, "enable-aggregator-configmaps", o.EnableAggregatorConfigMaps,
+		"Register aggregator services with the ConfigMaps selected by --aggregator-configmap-label-selector, "+
+			"deprecated in favor of the AggregatorService resources")
+	fs.StringSliceVar(&o.AggregatorConfigMapNamespaces, "aggregator-configmap-namespaces", o.AggregatorConfigMapNamespaces,
+		"The namespaces of the aggregator ConfigMaps, the ConfigMaps of all namespaces are watched if it is not set")
+	fs.StringVar(&o.AggregatorConfigMapLabelSelector, "aggregator-configmap-label-selector", o.AggregatorConfigMapLabelSelector,
+		"The label selector of the aggregator ConfigMaps, only the selected ConfigMaps are cached")
+	fs.StringVar(&o.StaticServicesFile, "static-services-file", o.StaticServicesFile,
+		"The yaml or json file of the static aggregator services, the file is reloaded when it is changed")
+	fs.DurationVar(&o.StaticServicesSyncPeriod, "static-services-sync-period", o.StaticServicesSyncPeriod,
+		"How often the static services file and its TLS files are resynced, the changes of the file are also watched")
+	fs.StringVar(&o.ClusterSource, "cluster-source", o.ClusterSource,
+		"The kind of the objects that the clusters are registered with, one of namespace and configmap, "+
+			"the cluster name is the name of the object")
+	fs.StringVar(&o.ClusterLabelSelector, "cluster-label-selector", o.ClusterLabelSelector,
+		"The label selector of the objects that the clusters are registered with")
+	fs.StringVar(&o.ClusterNamespace, "cluster-namespace", o.ClusterNamespace,
+		"The namespace of the configmaps that the clusters are registered with, required by the configmap cluster source")
+	fs.IntVar(&o.FanOutConcurrency, "fan-out-concurrency", o.FanOutConcurrency,
+		"The number of clusters that a fan-out request is sent to concurrently")
+	fs.Int64Var(&o.FanOutMaxResponseBytes, "fan-out-max-response-bytes", o.FanOutMaxResponseBytes,
+		"The size limit of the response of a cluster to a fan-out request, a cluster that responds with a larger "+
+			"response is reported as a failure")
+	fs.BoolVar(&o.RouteToEndpoints, "route-to-endpoints", o.RouteToEndpoints,
+		"Send the requests to the ready endpoints of the backend services directly instead of the service DNS names")
+	fs.StringVar(&o.LoadBalancingPolicy, "load-balancing-policy", o.LoadBalancingPolicy,
+		"The policy to pick an endpoint for a request when --route-to-endpoints is set, "+
+			"one of round-robin, least-outstanding and cluster-hash")
+	fs.Float64Var(&o.RetryBudgetRatio, "retry-budget-ratio", o.RetryBudgetRatio,
+		"The max ratio of the retries to the proxied requests, shared by all aggregator services with a retry policy")
+	fs.IntVar(&o.RetryBudgetBurst, "retry-budget-burst", o.RetryBudgetBurst,
+		"The number of the retries that can be sent before the retry budget is earned by the proxied requests")
+	fs.IntVar(&o.HealthProbeConcurrency, "health-probe-concurrency", o.HealthProbeConcurrency,
+		"The number of the aggregator services with a health check that are probed concurrently")
 
 	o.ServerRun.AddUniversalFlags(fs)
 	o.SecureServing.AddFlags(fs)
 	o.Authentication.AddFlags(fs)
 	o.Authorization.AddFlags(fs)
+	o.Audit.AddFlags(fs)
 }
 
 func (o Options) APIServerConfig() (*genericapiserver.Config, error) {
@@ -59,10 +156,23 @@ func (o Options) APIServerConfig() (*genericapiserver.Config, error) {
 		return nil, err
 	}
 
-	//TODO: add custormer authorization here
 	if err := o.Authorization.ApplyTo(&serverConfig.Authorization); err != nil {
 		return nil, err
 	}
+	// the audit events of the proxied requests are annotated with the clusters and the backends, the dynamic audit
+	// backends are not supported
+	if errs := o.Audit.Validate(); len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	if o.Audit.DynamicOptions.Enabled {
+		return nil, fmt.Errorf("the dynamic audit backends are not supported")
+	}
+	if err := o.Audit.ApplyTo(serverConfig, nil, nil, nil, nil); err != nil {
+		return nil, err
+	}
+
+	// the upgraded connections and the streaming requests through the aggregator are not limited by the request timeout
+	serverConfig.LongRunningFunc = proxy.LongRunningRequestCheck(serverConfig.LongRunningFunc)
 
 	// enable OpenAPI schemas
 	serverConfig.OpenAPIConfig = genericapiserver.DefaultOpenAPIConfig(
@@ -0,0 +1,344 @@
+package options
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/client/aggregator"
+	"github.com/skeeey/aggregator-proxy-server/pkg/client/clientset/versioned"
+	aggregationinformers "github.com/skeeey/aggregator-proxy-server/pkg/client/informers/externalversions"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/proxy"
+	"github.com/skeeey/aggregator-proxy-server/pkg/server"
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+)
+
+const auditPolicy = `
+apiVersion: audit.k8s.io/v1
+kind: Policy
+omitStages:
+- RequestReceived
+rules:
+- level: Metadata
+`
+
+const auditWebhookConfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: sink
+  cluster:
+    server: %s
+contexts:
+- name: sink
+  context:
+    cluster: sink
+    user: sink
+current-context: sink
+users:
+- name: sink
+`
+
+// newAuditWebhookSink returns a webhook backend that sends the received audit events to the channel
+func newAuditWebhookSink(events chan<- auditv1.Event) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		eventList := &auditv1.EventList{}
+		if err := json.NewDecoder(req.Body).Decode(eventList); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, event := range eventList.Items {
+			events <- event
+		}
+	}))
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path
+}
+
+// newTestProxyServer returns a proxy server that the anonymous users can access, the requests to the sub resource sub
+// are proxied to the backend
+func newTestProxyServer(
+	t *testing.T, opts *Options, backend *httptest.Server, sources ...getter.ServiceInfoSource) *server.ProxyServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts.SecureServing.Listener = listener
+	opts.Authentication.RemoteKubeConfigFileOptional = true
+	opts.Authorization.RemoteKubeConfigFileOptional = true
+	opts.Authorization.AlwaysAllowGroups = []string{"system:unauthenticated"}
+	apiServerConfig, err := opts.APIServerConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	informerFactory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+	_ = namespaceInformer.Informer().GetStore().Add(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster1", Labels: map[string]string{"cluster": ""}},
+	})
+	selector, _ := labels.Parse("cluster")
+
+	backendAddr := backend.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(backendAddr)
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(&getter.AggregatorServiceInfo{
+		Name:             "default/sub",
+		SubResource:      "sub",
+		ServiceName:      "backend",
+		ServiceNamespace: "default",
+		ServicePort:      port,
+		RootPath:         "api",
+		RestConfig: &restclient.Config{
+			TLSClientConfig: restclient.TLSClientConfig{Insecure: true},
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, backendAddr)
+			},
+		},
+	})
+
+	proxyServer, err := server.NewProxyServer(informerFactory, apiServerConfig, serviceInfoGetter, sources,
+		cluster.NewNamespaceSource(namespaceInformer, selector), proxy.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return proxyServer
+}
+
+func TestAudit(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer backend.Close()
+
+	events := make(chan auditv1.Event, 10)
+	sink := newAuditWebhookSink(events)
+	defer sink.Close()
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.SecureServing.ServerCert.CertDirectory = dir
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	opts.AddFlags(fs)
+	logPath := filepath.Join(dir, "audit.log")
+	if err := fs.Parse([]string{
+		"--audit-policy-file=" + writeFile(t, dir, "policy.yaml", auditPolicy),
+		"--audit-log-path=" + logPath,
+		"--audit-webhook-config-file=" + writeFile(t, dir, "webhook.yaml", fmt.Sprintf(auditWebhookConfig, sink.URL)),
+		"--audit-webhook-mode=blocking",
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	proxyServer := newTestProxyServer(t, opts, backend)
+	apiServer := httptest.NewServer(proxyServer.Handler)
+	defer apiServer.Close()
+
+	resp, err := http.Get(apiServer.URL +
+		"/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/cluster1/aggregator/sub/pods")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status 202, but %d", resp.StatusCode)
+	}
+
+	var event auditv1.Event
+	select {
+	case event = <-events:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected the audit event is sent to the webhook")
+	}
+	expected := map[string]string{
+		proxy.AuditAnnotationCluster:      "cluster1",
+		proxy.AuditAnnotationSubResource:  "sub",
+		proxy.AuditAnnotationBackend:      "backend.default.svc:" + backend.URL[strings.LastIndex(backend.URL, ":")+1:],
+		proxy.AuditAnnotationUpstreamPath: "/api/sub/pods",
+		proxy.AuditAnnotationUpstreamCode: "202",
+	}
+	for key, value := range expected {
+		if event.Annotations[key] != value {
+			t.Errorf("expected annotation %s=%s, but %q", key, value, event.Annotations[key])
+		}
+	}
+	if _, err := time.ParseDuration(event.Annotations[proxy.AuditAnnotationUpstreamLatency]); err != nil {
+		t.Errorf("expected the upstream latency, but %v", err)
+	}
+
+	// the log backend records the same event
+	log, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(log), `"`+proxy.AuditAnnotationBackend+`"`) {
+		t.Errorf("expected the audit log has the backend annotation, but %s", string(log))
+	}
+}
+
+// fakeSource is a service info source that is synced when the test says so
+type fakeSource struct {
+	synced int32
+}
+
+func (s *fakeSource) Name() string {
+	return "fake-services"
+}
+
+func (s *fakeSource) Run() {}
+
+func (s *fakeSource) HasSynced() bool {
+	return atomic.LoadInt32(&s.synced) == 1
+}
+
+func TestReadyz(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "readyz")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.SecureServing.ServerCert.CertDirectory = dir
+	source := &fakeSource{}
+	proxyServer := newTestProxyServer(t, opts, backend, source)
+	proxyServer.PrepareRun()
+	apiServer := httptest.NewServer(proxyServer.Handler)
+	defer apiServer.Close()
+
+	getStatus := func(path string) (int, string) {
+		resp, err := http.Get(apiServer.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := getStatus("/readyz?verbose"); code != http.StatusInternalServerError || !strings.Contains(body, "[-]fake-services failed") {
+		t.Errorf("expected not ready before the source has synced, but %d: %s", code, body)
+	}
+	atomic.StoreInt32(&source.synced, 1)
+	if code, body := getStatus("/readyz/fake-services"); code != http.StatusOK {
+		t.Errorf("expected ready after the source has synced, but %d: %s", code, body)
+	}
+
+	code, body := getStatus(server.ServicesPath)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200, but %d: %s", code, body)
+	}
+	statuses := []getter.ServiceInfoStatus{}
+	if err := json.Unmarshal([]byte(body), &statuses); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(statuses) != 1 || statuses[0].Name != "default/sub" || !statuses[0].Usable {
+		t.Errorf("expected default/sub is usable, but %#v", statuses)
+	}
+}
+
+func TestClients(t *testing.T) {
+	var backendPath string
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		backendPath = req.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind":"PodList","apiVersion":"v1","items":[{"metadata":{"name":"pod1"}}]}`))
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "clients")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.SecureServing.ServerCert.CertDirectory = dir
+	proxyServer := newTestProxyServer(t, opts, backend)
+	apiServer := httptest.NewServer(proxyServer.Handler)
+	defer apiServer.Close()
+	config := &restclient.Config{Host: apiServer.URL}
+
+	// the generated clientset watches the clusters and the informers sync them
+	clientset, err := versioned.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	watcher, err := clientset.AggregationV1().ClusterStatuses().Watch(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer watcher.Stop()
+	select {
+	case event := <-watcher.ResultChan():
+		if event.Type != watch.Added {
+			t.Errorf("expected ADDED event, but %s %#v", event.Type, event.Object)
+		}
+	case <-time.After(wait.ForeverTestTimeout):
+		t.Fatalf("expected ADDED event, but timed out")
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory := aggregationinformers.NewSharedInformerFactory(clientset, 0)
+	lister := informerFactory.Aggregation().V1().ClusterStatuses().Lister()
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+	if _, err := lister.Get("cluster1"); err != nil {
+		t.Errorf("expected cluster1 is synced, but %v", err)
+	}
+
+	// the kubernetes client calls the backend through the aggregator sub-resource
+	kubeClient, err := aggregator.KubernetesClientFor(config, "cluster1", "sub")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pods, err := kubeClient.CoreV1().Pods("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pods.Items) != 1 || pods.Items[0].Name != "pod1" {
+		t.Errorf("expected pod1, but %#v", pods.Items)
+	}
+	if backendPath != "/api/sub/api/v1/namespaces/default/pods" {
+		t.Errorf("expected the pods are listed on the backend, but %s", backendPath)
+	}
+}
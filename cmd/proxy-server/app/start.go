@@ -1,15 +1,24 @@
 package app
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/skeeey/aggregator-proxy-server/cmd/proxy-server/app/options"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
 	"github.com/skeeey/aggregator-proxy-server/pkg/controller"
 	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"github.com/skeeey/aggregator-proxy-server/pkg/proxy"
+	"github.com/skeeey/aggregator-proxy-server/pkg/retry"
 	"github.com/skeeey/aggregator-proxy-server/pkg/server"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
 )
 
 func Run(opts *options.Options, stopCh <-chan struct{}) error {
@@ -22,18 +31,79 @@ func Run(opts *options.Options, stopCh <-chan struct{}) error {
 		return err
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(clusterCfg)
+	if err != nil {
+		return err
+	}
+
 	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
 
 	informerFactory := informers.NewSharedInformerFactory(kubeClient, 10*time.Minute)
-	ctrl := controller.NewAggregatorServiceInfoController(kubeClient, informerFactory, serviceInfoGetter, stopCh)
-	go ctrl.Run()
+	secretInformers := controller.NewSecretInformers(kubeClient, 10*time.Minute, stopCh)
+	sources := []getter.ServiceInfoSource{}
+	if opts.EnableAggregatorConfigMaps {
+		selector, err := labels.Parse(opts.AggregatorConfigMapLabelSelector)
+		if err != nil {
+			return fmt.Errorf("invalid aggregator configmap label selector %q: %v", opts.AggregatorConfigMapLabelSelector, err)
+		}
+		configMapInformerFactories := controller.NewConfigMapInformerFactories(
+			kubeClient, 10*time.Minute, opts.AggregatorConfigMapNamespaces, selector)
+		sources = append(sources, controller.NewAggregatorServiceInfoController(
+			kubeClient, secretInformers, configMapInformerFactories, selector, serviceInfoGetter, stopCh))
+		for _, configMapInformerFactory := range configMapInformerFactories {
+			configMapInformerFactory.Start(stopCh)
+		}
+	}
+	if opts.EnableAggregatorServices {
+		installed, err := controller.AggregatorServicesInstalled(kubeClient.Discovery())
+		if err != nil {
+			return err
+		}
+		if installed {
+			dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 10*time.Minute)
+			sources = append(sources, controller.NewAggregatorServiceController(
+				kubeClient, dynamicClient, secretInformers, dynamicInformerFactory, serviceInfoGetter, stopCh))
+			dynamicInformerFactory.Start(stopCh)
+		} else {
+			klog.Warningf("The AggregatorService resource is not installed, the aggregator services cannot be " +
+				"registered with the AggregatorService resources")
+		}
+	}
+	if opts.StaticServicesFile != "" {
+		sources = append(sources, controller.NewFileSource(
+			opts.StaticServicesFile, opts.StaticServicesSyncPeriod, serviceInfoGetter, stopCh))
+	}
+	for _, source := range sources {
+		go source.Run()
+	}
+	go secretInformers.Run()
+	go health.NewProber(serviceInfoGetter.ProbeTargets, opts.HealthProbeConcurrency).Run(stopCh)
+	clusterSource, clusterInformerFactory, err := cluster.NewSource(
+		opts.ClusterSource, opts.ClusterNamespace, opts.ClusterLabelSelector, kubeClient, 10*time.Minute)
+	if err != nil {
+		return err
+	}
+	proxyConfig := proxy.Config{
+		FanOutConcurrency:      opts.FanOutConcurrency,
+		FanOutMaxResponseBytes: opts.FanOutMaxResponseBytes,
+		RetryBudget:            retry.NewBudget(opts.RetryBudgetRatio, opts.RetryBudgetBurst),
+	}
+	if opts.RouteToEndpoints {
+		proxyConfig.EndpointResolver, err = proxy.NewEndpointResolver(informerFactory.Core().V1().Services(),
+			informerFactory.Core().V1().Endpoints(), opts.LoadBalancingPolicy)
+		if err != nil {
+			return err
+		}
+	}
 	informerFactory.Start(stopCh)
+	clusterInformerFactory.Start(stopCh)
 
 	apiServerConfig, err := opts.APIServerConfig()
 	if err != nil {
 		return err
 	}
-	proxyServer, err := server.NewProxyServer(informerFactory, apiServerConfig, serviceInfoGetter)
+	proxyServer, err := server.NewProxyServer(
+		informerFactory, apiServerConfig, serviceInfoGetter, sources, clusterSource, proxyConfig)
 	if err != nil {
 		return err
 	}
@@ -3,9 +3,11 @@ module github.com/skeeey/aggregator-proxy-server
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/go-openapi/spec v0.19.3
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
 	google.golang.org/appengine v1.6.5 // indirect
 	k8s.io/api v0.17.4
 	k8s.io/apimachinery v0.17.4
@@ -15,4 +17,5 @@ require (
 	k8s.io/klog v1.0.0
 	k8s.io/kube-openapi v0.0.0-20191107075043-30be4d16710a
 	k8s.io/metrics v0.17.4
+	sigs.k8s.io/yaml v1.1.0
 )
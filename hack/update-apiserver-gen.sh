@@ -17,13 +17,36 @@ SC_PKG='github.com/skeeey/aggregator-proxy-server'
 "${BINDIR}"/deepcopy-gen "$@" \
 	--v 1 --logtostderr\
 	--go-header-file "${REPO_ROOT}"/hack/custom-boilerplate.go.txt \
-	--input-dirs "${SC_PKG}/pkg/apis/aggregation/v1" \
+	--input-dirs "${SC_PKG}/pkg/apis/aggregation/v1,${SC_PKG}/pkg/apis/proxy/v1alpha1" \
 	--output-file-base zz_generated.deepcopy
 
 # Generate openapi
 "${BINDIR}"/openapi-gen "$@" \
 	--v 1 --logtostderr \
 	--go-header-file "${REPO_ROOT}"/hack/custom-boilerplate.go.txt \
-	--input-dirs "${SC_PKG}/pkg/apis/aggregation/v1,k8s.io/apimachinery/pkg/apis/meta/v1" \
+	--input-dirs "${SC_PKG}/pkg/apis/aggregation/v1,k8s.io/apimachinery/pkg/apis/meta/v1,k8s.io/apimachinery/pkg/runtime,k8s.io/apimachinery/pkg/version" \
 	--output-package "${SC_PKG}/pkg/apis/aggregation/openapi" \
 	--report-filename ".api_violation.report"
+
+# Generate the clientset, listers and informers of the aggregation API group
+"${BINDIR}"/client-gen "$@" \
+	--v 1 --logtostderr \
+	--go-header-file "${REPO_ROOT}"/hack/custom-boilerplate.go.txt \
+	--clientset-name versioned \
+	--input-base "" \
+	--input "${SC_PKG}/pkg/apis/aggregation/v1" \
+	--output-package "${SC_PKG}/pkg/client/clientset"
+
+"${BINDIR}"/lister-gen "$@" \
+	--v 1 --logtostderr \
+	--go-header-file "${REPO_ROOT}"/hack/custom-boilerplate.go.txt \
+	--input-dirs "${SC_PKG}/pkg/apis/aggregation/v1" \
+	--output-package "${SC_PKG}/pkg/client/listers"
+
+"${BINDIR}"/informer-gen "$@" \
+	--v 1 --logtostderr \
+	--go-header-file "${REPO_ROOT}"/hack/custom-boilerplate.go.txt \
+	--input-dirs "${SC_PKG}/pkg/apis/aggregation/v1" \
+	--versioned-clientset-package "${SC_PKG}/pkg/client/clientset/versioned" \
+	--listers-package "${SC_PKG}/pkg/client/listers" \
+	--output-package "${SC_PKG}/pkg/client/informers"
@@ -2,16 +2,23 @@ package api
 
 import (
 	"context"
+	"fmt"
+	"strings"
 
 	"github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation"
 	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
 	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
 	"github.com/skeeey/aggregator-proxy-server/pkg/proxy"
+	corev1 "k8s.io/api/core/v1"
 	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/apiserver/pkg/registry/rest"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 )
@@ -31,17 +38,25 @@ func init() {
 	metav1.AddToGroupVersion(Scheme, schema.GroupVersion{Version: "v1"})
 }
 
-func Install(serviceInfoGetter *getter.AggregatorServiceInfoGetter, server *genericapiserver.GenericAPIServer) error {
+func Install(
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter,
+	clusterSource cluster.Source,
+	proxyConfig proxy.Config,
+	server *genericapiserver.GenericAPIServer) error {
+	proxyRest := proxy.NewAggregatorProxyRest(serviceInfoGetter, clusterSource, proxyConfig)
 	apiGroupInfo := genericapiserver.NewDefaultAPIGroupInfo(aggregationv1.GroupName, Scheme, ParameterCodec, Codecs)
 	apiGroupInfo.VersionedResourcesStorageMap[aggregationv1.SchemeGroupVersion.Version] = map[string]rest.Storage{
-		"clusterstatuses":            &clusterStatusStorage{},
-		"clusterstatuses/aggregator": proxy.NewAggregatorProxyRest(serviceInfoGetter),
+		"clusterstatuses":            &clusterStatusStorage{clusterSource: clusterSource, serviceInfoGetter: serviceInfoGetter},
+		"clusterstatuses/aggregator": proxyRest,
 	}
 
 	return server.InstallAPIGroup(&apiGroupInfo)
 }
 
-type clusterStatusStorage struct{}
+type clusterStatusStorage struct {
+	clusterSource     cluster.Source
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter
+}
 
 var (
 	_ = rest.Storage(&clusterStatusStorage{})
@@ -49,6 +64,7 @@ var (
 	_ = rest.Lister(&clusterStatusStorage{})
 	_ = rest.Getter(&clusterStatusStorage{})
 	_ = rest.Scoper(&clusterStatusStorage{})
+	_ = rest.Watcher(&clusterStatusStorage{})
 )
 
 // Storage interface
@@ -68,12 +84,111 @@ func (s *clusterStatusStorage) NewList() runtime.Object {
 
 // Lister interface
 func (s *clusterStatusStorage) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
-	return &aggregationv1.ClusterStatusList{}, nil
+	labelSelector, fieldSelector := selectorsFor(options)
+	clusters, err := s.clusterSource.List(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterList := &aggregationv1.ClusterStatusList{Items: []aggregationv1.ClusterStatus{}}
+	for _, cluster := range clusters {
+		if !fieldSelector.Matches(clusterFields(cluster)) {
+			continue
+		}
+		clusterList.Items = append(clusterList.Items, *s.withHealthCondition(cluster))
+	}
+	return clusterList, nil
 }
 
 // Getter interface
 func (s *clusterStatusStorage) Get(ctx context.Context, name string, opts *metav1.GetOptions) (runtime.Object, error) {
-	return &aggregationv1.ClusterStatus{}, nil
+	cluster, err := s.clusterSource.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return s.withHealthCondition(cluster), nil
+}
+
+// Watcher interface, the watch starts with the ADDED events of the current clusters regardless of the resource
+// version, a cluster that stops or starts matching the selectors is deleted or added
+func (s *clusterStatusStorage) Watch(ctx context.Context, options *metainternalversion.ListOptions) (watch.Interface, error) {
+	labelSelector, fieldSelector := selectorsFor(options)
+	changes, err := s.clusterSource.Watch()
+	if err != nil {
+		return nil, err
+	}
+
+	// the filter is called by one goroutine, so the matched clusters are not locked
+	matched := map[string]bool{}
+	return watch.Filter(changes, func(event watch.Event) (watch.Event, bool) {
+		cluster, ok := event.Object.(*aggregationv1.ClusterStatus)
+		if !ok {
+			return event, true
+		}
+		matches := labelSelector.Matches(labels.Set(cluster.Labels)) && fieldSelector.Matches(clusterFields(cluster))
+		switch {
+		case event.Type == watch.Deleted:
+			if !matched[cluster.Name] {
+				return event, false
+			}
+			delete(matched, cluster.Name)
+		case matches && !matched[cluster.Name]:
+			event.Type = watch.Added
+			matched[cluster.Name] = true
+		case !matches && matched[cluster.Name]:
+			event.Type = watch.Deleted
+			delete(matched, cluster.Name)
+		case !matches:
+			return event, false
+		}
+		event.Object = s.withHealthCondition(cluster.DeepCopy())
+		return event, true
+	}), nil
+}
+
+func selectorsFor(options *metainternalversion.ListOptions) (labels.Selector, fields.Selector) {
+	labelSelector := labels.Everything()
+	fieldSelector := fields.Everything()
+	if options != nil {
+		if options.LabelSelector != nil {
+			labelSelector = options.LabelSelector
+		}
+		if options.FieldSelector != nil {
+			fieldSelector = options.FieldSelector
+		}
+	}
+	return labelSelector, fieldSelector
+}
+
+func clusterFields(cluster *aggregationv1.ClusterStatus) fields.Set {
+	return fields.Set{"metadata.name": cluster.Name}
+}
+
+// withHealthCondition adds the health of the probed aggregator services to a cluster, the backends are shared by
+// all clusters, so every cluster has the same condition
+func (s *clusterStatusStorage) withHealthCondition(cluster *aggregationv1.ClusterStatus) *aggregationv1.ClusterStatus {
+	if s.serviceInfoGetter == nil {
+		return cluster
+	}
+	summary := s.serviceInfoGetter.HealthSummary()
+	if summary.Probed == 0 {
+		return cluster
+	}
+
+	condition := aggregationv1.ClusterStatusCondition{
+		Type:               aggregationv1.ClusterAggregatorServicesHealthy,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.NewTime(summary.LastTransitionTime),
+		Reason:             "AggregatorServicesHealthy",
+	}
+	if len(summary.Unhealthy) > 0 {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "AggregatorServicesUnhealthy"
+		condition.Message = fmt.Sprintf("the backends of the aggregator services (%s) are unhealthy",
+			strings.Join(summary.Unhealthy, ", "))
+	}
+	cluster.Status.Conditions = append(cluster.Status.Conditions, condition)
+	return cluster
 }
 
 // Scoper interface
@@ -1,6 +1,7 @@
 package v1
 
 import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
@@ -9,6 +10,11 @@ const GroupName = "aggregation.open-cluster-management.io"
 
 var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1"}
 
+// Resource takes an unqualified resource and returns a Group qualified GroupResource
+func Resource(resource string) schema.GroupResource {
+	return SchemeGroupVersion.WithResource(resource).GroupResource()
+}
+
 var (
 	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
 	AddToScheme   = SchemeBuilder.AddToScheme
@@ -20,5 +26,7 @@ func addKnownTypes(scheme *runtime.Scheme) error {
 		&ClusterStatusList{},
 		&ClusterStatusProxyOptions{},
 	)
+	// the watch events and the list options of the group version, so the clusters can be watched
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
 	return nil
 }
@@ -1,9 +1,13 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// +genclient
+// +genclient:nonNamespaced
+// +genclient:onlyVerbs=get,list,watch
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 // ClusterStatus about a registered cluster in a federated kubernetes setup.
@@ -13,6 +17,45 @@ type ClusterStatus struct {
 	// More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#metadata
 	// +optional
 	metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+
+	// Status is the most recently observed status of the cluster
+	// +optional
+	Status ClusterStatusStatus `json:"status,omitempty" protobuf:"bytes,2,opt,name=status"`
+}
+
+// ClusterStatusStatus is the status of a registered cluster
+type ClusterStatusStatus struct {
+	// Conditions is the current observed conditions of the cluster
+	// +optional
+	Conditions []ClusterStatusCondition `json:"conditions,omitempty" protobuf:"bytes,1,rep,name=conditions"`
+}
+
+// ClusterStatusConditionType is a valid value for ClusterStatusCondition.Type
+type ClusterStatusConditionType string
+
+const (
+	// ClusterAvailable means the cluster is registered and can be accessed through the aggregator
+	ClusterAvailable ClusterStatusConditionType = "Available"
+	// ClusterAggregatorServicesHealthy means the backends of the probed aggregator services are healthy, it is only
+	// reported if an aggregator service has a health check
+	ClusterAggregatorServicesHealthy ClusterStatusConditionType = "AggregatorServicesHealthy"
+)
+
+// ClusterStatusCondition describes the state of a cluster at a certain point
+type ClusterStatusCondition struct {
+	// Type of the condition
+	Type ClusterStatusConditionType `json:"type" protobuf:"bytes,1,opt,name=type,casttype=ClusterStatusConditionType"`
+	// Status of the condition, one of True, False, Unknown
+	Status corev1.ConditionStatus `json:"status" protobuf:"bytes,2,opt,name=status,casttype=k8s.io/api/core/v1.ConditionStatus"`
+	// Last time the condition transitioned from one status to another
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty" protobuf:"bytes,3,opt,name=lastTransitionTime"`
+	// Unique, one-word, CamelCase reason for the condition's last transition
+	// +optional
+	Reason string `json:"reason,omitempty" protobuf:"bytes,4,opt,name=reason"`
+	// Human-readable message indicating details about last transition
+	// +optional
+	Message string `json:"message,omitempty" protobuf:"bytes,5,opt,name=message"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
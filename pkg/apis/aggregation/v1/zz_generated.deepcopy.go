@@ -13,6 +13,7 @@ func (in *ClusterStatus) DeepCopyInto(out *ClusterStatus) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -34,6 +35,23 @@ func (in *ClusterStatus) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterStatusCondition) DeepCopyInto(out *ClusterStatusCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterStatusCondition.
+func (in *ClusterStatusCondition) DeepCopy() *ClusterStatusCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterStatusCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ClusterStatusList) DeepCopyInto(out *ClusterStatusList) {
 	*out = *in
@@ -91,3 +109,26 @@ func (in *ClusterStatusProxyOptions) DeepCopyObject() runtime.Object {
 	}
 	return nil
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterStatusStatus) DeepCopyInto(out *ClusterStatusStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]ClusterStatusCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterStatusStatus.
+func (in *ClusterStatusStatus) DeepCopy() *ClusterStatusStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterStatusStatus)
+	in.DeepCopyInto(out)
+	return out
+}
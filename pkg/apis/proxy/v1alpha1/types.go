@@ -0,0 +1,231 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// AggregatorService registers a backend service behind the aggregator sub-resource of clusterstatuses
+type AggregatorService struct {
+	metav1.TypeMeta `json:",inline"`
+	// Standard object's metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#metadata
+	// +optional
+	metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+
+	// Spec defines how requests are routed to the backend service
+	Spec AggregatorServiceSpec `json:"spec" protobuf:"bytes,2,opt,name=spec"`
+
+	// Status is the most recently observed status of the aggregator service
+	// +optional
+	Status AggregatorServiceStatus `json:"status,omitempty" protobuf:"bytes,3,opt,name=status"`
+}
+
+// AggregatorServiceSpec is the specification of an AggregatorService
+type AggregatorServiceSpec struct {
+	// SubResource is the path after clusterstatuses/{name}/aggregator that is routed to the service, it may have
+	// multiple segments, e.g. metrics/v1, and a request is routed to the service of its longest sub-resource prefix
+	SubResource string `json:"subResource" protobuf:"bytes,1,opt,name=subResource"`
+
+	// Service references the backend service, the service is always accessed with https
+	Service ServiceReference `json:"service" protobuf:"bytes,2,opt,name=service"`
+
+	// RootPath is the path on the backend service that the requests are proxied under
+	// +optional
+	RootPath string `json:"rootPath,omitempty" protobuf:"bytes,3,opt,name=rootPath"`
+
+	// UseID indicates whether the cluster name is passed to the backend service
+	// +optional
+	UseID bool `json:"useID,omitempty" protobuf:"varint,4,opt,name=useID"`
+
+	// IDPlacement is where the cluster name is put in the upstream request when UseID is true,
+	// one of path, query and header, defaults to path
+	// +optional
+	IDPlacement string `json:"idPlacement,omitempty" protobuf:"bytes,5,opt,name=idPlacement"`
+
+	// Secret references a kubernetes.io/tls secret that contains the client certificate (tls.crt, tls.key)
+	// and the CA bundle (ca.crt) to access the backend service
+	Secret SecretReference `json:"secret" protobuf:"bytes,6,opt,name=secret"`
+
+	// AllowedMethods is the HTTP methods that the service allows, e.g. GET and HEAD for a read-only service,
+	// the other methods are rejected with 405, all methods are allowed if it is empty
+	// +optional
+	AllowedMethods []string `json:"allowedMethods,omitempty" protobuf:"bytes,7,rep,name=allowedMethods"`
+
+	// CircuitBreaker rejects the requests to the service for a while when the service keeps failing,
+	// the requests are always proxied if it is not set
+	// +optional
+	CircuitBreaker *CircuitBreakerSpec `json:"circuitBreaker,omitempty" protobuf:"bytes,8,opt,name=circuitBreaker"`
+
+	// RetryPolicy retries the idempotent requests that failed transiently, the requests are not retried if it is not set
+	// +optional
+	RetryPolicy *RetryPolicySpec `json:"retryPolicy,omitempty" protobuf:"bytes,9,opt,name=retryPolicy"`
+
+	// IdentityForwarding is how the authenticated user is forwarded to the backend service, one of none,
+	// impersonation (Impersonate-* headers) and front-proxy (X-Remote-* headers), defaults to none. The identity
+	// headers sent by the clients are always removed
+	// +optional
+	IdentityForwarding string `json:"identityForwarding,omitempty" protobuf:"bytes,10,opt,name=identityForwarding"`
+
+	// AllowedPaths are the path prefixes or the glob patterns, e.g. /api/v1/namespaces/*/pods, of the paths on the
+	// backend service that the requests can be proxied to, all paths under the rootPath are allowed if it is empty
+	// +optional
+	AllowedPaths []string `json:"allowedPaths,omitempty" protobuf:"bytes,11,rep,name=allowedPaths"`
+
+	// DeniedPaths are the path prefixes or the glob patterns of the paths on the backend service that the requests
+	// cannot be proxied to, they take precedence over the allowed paths
+	// +optional
+	DeniedPaths []string `json:"deniedPaths,omitempty" protobuf:"bytes,12,rep,name=deniedPaths"`
+
+	// HealthCheck probes the backend service periodically and stops proxying to it while it is unhealthy, the
+	// service is not probed if it is not set
+	// +optional
+	HealthCheck *HealthCheckSpec `json:"healthCheck,omitempty" protobuf:"bytes,13,opt,name=healthCheck"`
+}
+
+// HealthCheckSpec is the active health check of an aggregator service
+type HealthCheckSpec struct {
+	// Path is the path on the backend service that is probed with GET, a 2xx or 3xx response is a success
+	Path string `json:"path" protobuf:"bytes,1,opt,name=path"`
+
+	// Period is how often the service is probed, defaults to 10s
+	// +optional
+	Period *metav1.Duration `json:"period,omitempty" protobuf:"bytes,2,opt,name=period"`
+
+	// Timeout is how long a probe waits for the response, defaults to 3s
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty" protobuf:"bytes,3,opt,name=timeout"`
+
+	// SuccessThreshold is the number of the consecutive successes that mark an unhealthy service healthy,
+	// defaults to 1
+	// +optional
+	SuccessThreshold int32 `json:"successThreshold,omitempty" protobuf:"varint,4,opt,name=successThreshold"`
+
+	// FailureThreshold is the number of the consecutive failures that mark a healthy service unhealthy,
+	// defaults to 3
+	// +optional
+	FailureThreshold int32 `json:"failureThreshold,omitempty" protobuf:"varint,5,opt,name=failureThreshold"`
+}
+
+// RetryPolicySpec is the retry policy of an aggregator service, only the requests with the idempotent methods
+// and the replayable bodies are retried
+type RetryPolicySpec struct {
+	// MaxAttempts is the max number of the attempts of a request, including the first one, defaults to 3
+	// +optional
+	MaxAttempts int32 `json:"maxAttempts,omitempty" protobuf:"varint,1,opt,name=maxAttempts"`
+
+	// RetryOnConnectionErrors retries the requests that cannot get a response, e.g. the connection is reset
+	// +optional
+	RetryOnConnectionErrors bool `json:"retryOnConnectionErrors,omitempty" protobuf:"varint,2,opt,name=retryOnConnectionErrors"`
+
+	// RetryOnStatusCodes retries the requests that are responded with these codes, e.g. 502 and 503
+	// +optional
+	RetryOnStatusCodes []int32 `json:"retryOnStatusCodes,omitempty" protobuf:"varint,3,rep,name=retryOnStatusCodes"`
+
+	// Backoff is the wait before the first retry, it is doubled for each retry and jittered, defaults to 100ms
+	// +optional
+	Backoff *metav1.Duration `json:"backoff,omitempty" protobuf:"bytes,4,opt,name=backoff"`
+
+	// MaxBackoff is the max wait between the retries, defaults to 2s
+	// +optional
+	MaxBackoff *metav1.Duration `json:"maxBackoff,omitempty" protobuf:"bytes,5,opt,name=maxBackoff"`
+}
+
+// CircuitBreakerSpec is the thresholds of the circuit breaker of an aggregator service
+type CircuitBreakerSpec struct {
+	// ErrorRateThreshold is the percentage of the failed requests in the latest requests that opens the breaker,
+	// a request is failed if the service cannot be connected or responds with a 5xx code
+	ErrorRateThreshold int32 `json:"errorRateThreshold" protobuf:"varint,1,opt,name=errorRateThreshold"`
+
+	// LatencyThreshold is the latency that a slower request is counted as failed, the watch and upgrade
+	// requests are not counted by their latency
+	// +optional
+	LatencyThreshold *metav1.Duration `json:"latencyThreshold,omitempty" protobuf:"bytes,2,opt,name=latencyThreshold"`
+
+	// MinimumRequests is the number of the latest requests that the error rate is calculated from, defaults to 20
+	// +optional
+	MinimumRequests int32 `json:"minimumRequests,omitempty" protobuf:"varint,3,opt,name=minimumRequests"`
+
+	// OpenDuration is how long the requests are rejected before a probe request is let through, defaults to 30s
+	// +optional
+	OpenDuration *metav1.Duration `json:"openDuration,omitempty" protobuf:"bytes,4,opt,name=openDuration"`
+}
+
+// ServiceReference references a service
+type ServiceReference struct {
+	// Namespace of the service, defaults to the namespace of the AggregatorService
+	// +optional
+	Namespace string `json:"namespace,omitempty" protobuf:"bytes,1,opt,name=namespace"`
+
+	// Name of the service
+	Name string `json:"name" protobuf:"bytes,2,opt,name=name"`
+
+	// Port of the service
+	Port int32 `json:"port" protobuf:"varint,3,opt,name=port"`
+}
+
+// SecretReference references a secret
+type SecretReference struct {
+	// Namespace of the secret, defaults to the namespace of the service
+	// +optional
+	Namespace string `json:"namespace,omitempty" protobuf:"bytes,1,opt,name=namespace"`
+
+	// Name of the secret
+	Name string `json:"name" protobuf:"bytes,2,opt,name=name"`
+}
+
+// AggregatorServiceConditionType is a valid value for AggregatorServiceCondition.Type
+type AggregatorServiceConditionType string
+
+const (
+	// AggregatorServiceValid means the spec of the aggregator service is valid
+	AggregatorServiceValid AggregatorServiceConditionType = "Valid"
+	// AggregatorServiceSecretResolved means the referenced secret is found and contains the client certificate
+	AggregatorServiceSecretResolved AggregatorServiceConditionType = "SecretResolved"
+	// AggregatorServiceBackendReachable means the backend service has ready endpoints
+	AggregatorServiceBackendReachable AggregatorServiceConditionType = "BackendReachable"
+)
+
+// AggregatorServiceCondition describes the state of an aggregator service at a certain point
+type AggregatorServiceCondition struct {
+	// Type of the condition
+	Type AggregatorServiceConditionType `json:"type" protobuf:"bytes,1,opt,name=type,casttype=AggregatorServiceConditionType"`
+	// Status of the condition, one of True, False, Unknown
+	Status corev1.ConditionStatus `json:"status" protobuf:"bytes,2,opt,name=status,casttype=k8s.io/api/core/v1.ConditionStatus"`
+	// Last time the condition transitioned from one status to another
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty" protobuf:"bytes,3,opt,name=lastTransitionTime"`
+	// Unique, one-word, CamelCase reason for the condition's last transition
+	// +optional
+	Reason string `json:"reason,omitempty" protobuf:"bytes,4,opt,name=reason"`
+	// Human-readable message indicating details about last transition
+	// +optional
+	Message string `json:"message,omitempty" protobuf:"bytes,5,opt,name=message"`
+}
+
+// AggregatorServiceStatus is the status of an AggregatorService
+type AggregatorServiceStatus struct {
+	// ObservedGeneration is the generation of the spec that the status is observed from
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty" protobuf:"varint,1,opt,name=observedGeneration"`
+
+	// Conditions is the current observed conditions of the aggregator service
+	// +optional
+	Conditions []AggregatorServiceCondition `json:"conditions,omitempty" protobuf:"bytes,2,rep,name=conditions"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// AggregatorServiceList is a list of AggregatorServices
+type AggregatorServiceList struct {
+	metav1.TypeMeta `json:",inline"`
+	// Standard list metadata.
+	// More info: https://git.k8s.io/community/contributors/devel/api-conventions.md#types-kinds
+	// +optional
+	metav1.ListMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
+
+	// List of AggregatorServices
+	Items []AggregatorService `json:"items" protobuf:"bytes,2,rep,name=items"`
+}
@@ -0,0 +1,106 @@
+package authorization
+
+import (
+	"context"
+	"fmt"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/utils"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const (
+	clusterStatusesResource = "clusterstatuses"
+	aggregatorSubresource   = "aggregator"
+)
+
+// aggregatorAuthorizer authorizes the requests to the aggregator sub-resource of clusterstatuses per cluster and per
+// aggregator sub-resource. A user is allowed to access an aggregator sub-resource of a cluster if the user is allowed
+// to act on clusterstatuses/aggregator, or on clusterstatuses/aggregator/<sub-resource>, with the cluster name as the
+// resource name, e.g. the following rule only allows to get the v1 aggregator sub-resource of cluster1
+//
+//   - apiGroups: ["aggregation.open-cluster-management.io"]
+//     resources: ["clusterstatuses/aggregator/v1"]
+//     resourceNames: ["cluster1"]
+//     verbs: ["get"]
+//
+// The sub-resource is the registered sub-resource that the request is routed to, e.g. metrics/v1 for the request to
+// aggregator/metrics/v1/pods, so a multi-segment sub-resource is granted on its own.
+type aggregatorAuthorizer struct {
+	delegate          authorizer.Authorizer
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter
+}
+
+// NewAggregatorAuthorizer returns an authorizer that authorizes the aggregator requests per aggregator sub-resource,
+// the other requests are authorized by the delegate authorizer
+func NewAggregatorAuthorizer(
+	delegate authorizer.Authorizer, serviceInfoGetter *getter.AggregatorServiceInfoGetter) authorizer.Authorizer {
+	return &aggregatorAuthorizer{delegate: delegate, serviceInfoGetter: serviceInfoGetter}
+}
+
+func (a *aggregatorAuthorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	decision, reason, err := a.delegate.Authorize(ctx, attrs)
+	if decision == authorizer.DecisionAllow || !isAggregatorRequest(attrs) {
+		return decision, reason, err
+	}
+
+	// a fan-out request is authorized per cluster when it is sent to the selected clusters, the clusters that the
+	// user is not allowed to access are reported as failures in its response
+	if attrs.GetName() == utils.AllClusters && attrs.GetVerb() == "get" {
+		return authorizer.DecisionAllow, "", nil
+	}
+
+	// a request that is not routed to an aggregator service is only allowed by the delegate
+	subResourcePath, subResourceErr := utils.GetSubResourcePath(attrs.GetPath())
+	if subResourceErr != nil {
+		return decision, reason, err
+	}
+	serviceInfo := a.serviceInfoGetter.GetAggregatorServiceInfo(subResourcePath)
+	if serviceInfo == nil {
+		return decision, reason, err
+	}
+	return a.authorizeSubResource(ctx, attrs, serviceInfo.SubResource)
+}
+
+// AuthorizeSubResource authorizes an aggregator request on the sub-resource that it is routed to. The route may be
+// changed after the request is authorized, e.g. a longer sub-resource is registered, so the proxy checks the request
+// again with the sub-resource of the aggregator service that serves it.
+func (a *aggregatorAuthorizer) AuthorizeSubResource(
+	ctx context.Context, attrs authorizer.Attributes, subResource string) (authorizer.Decision, string, error) {
+	decision, reason, err := a.delegate.Authorize(ctx, attrs)
+	if decision == authorizer.DecisionAllow {
+		return decision, reason, err
+	}
+	return a.authorizeSubResource(ctx, attrs, subResource)
+}
+
+// authorizeSubResource authorizes the attributes of an aggregator request on an aggregator sub-resource
+func (a *aggregatorAuthorizer) authorizeSubResource(
+	ctx context.Context, attrs authorizer.Attributes, subResource string) (authorizer.Decision, string, error) {
+	subResourceAttrs := authorizer.AttributesRecord{
+		User:            attrs.GetUser(),
+		Verb:            attrs.GetVerb(),
+		APIGroup:        attrs.GetAPIGroup(),
+		APIVersion:      attrs.GetAPIVersion(),
+		Resource:        clusterStatusesResource,
+		Subresource:     aggregatorSubresource + "/" + subResource,
+		Name:            attrs.GetName(),
+		ResourceRequest: true,
+		Path:            attrs.GetPath(),
+	}
+	decision, _, err := a.delegate.Authorize(ctx, subResourceAttrs)
+	if decision == authorizer.DecisionAllow {
+		return decision, "", nil
+	}
+
+	return decision, fmt.Sprintf("cannot %s the aggregator sub-resource %q of cluster %q",
+		attrs.GetVerb(), subResource, attrs.GetName()), err
+}
+
+func isAggregatorRequest(attrs authorizer.Attributes) bool {
+	return attrs.IsResourceRequest() &&
+		attrs.GetAPIGroup() == aggregationv1.GroupName &&
+		attrs.GetResource() == clusterStatusesResource &&
+		attrs.GetSubresource() == aggregatorSubresource
+}
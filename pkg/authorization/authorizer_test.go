@@ -0,0 +1,170 @@
+package authorization
+
+import (
+	"context"
+	"testing"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+)
+
+const testPathPrefix = "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/"
+
+// rule allows a user to act on a resource with a resource name
+type rule struct {
+	user        string
+	subresource string
+	name        string
+}
+
+func newFakeAuthorizer(rules ...rule) authorizer.Authorizer {
+	return authorizer.AuthorizerFunc(func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+		for _, r := range rules {
+			if r.user == attrs.GetUser().GetName() && r.subresource == attrs.GetSubresource() &&
+				(r.name == "" || r.name == attrs.GetName()) {
+				return authorizer.DecisionAllow, "", nil
+			}
+		}
+		return authorizer.DecisionNoOpinion, "no rule", nil
+	})
+}
+
+func newAggregatorAttributes(userName, cluster, subResource string) authorizer.AttributesRecord {
+	return authorizer.AttributesRecord{
+		User:            &user.DefaultInfo{Name: userName},
+		Verb:            "get",
+		APIGroup:        "aggregation.open-cluster-management.io",
+		APIVersion:      "v1",
+		Resource:        "clusterstatuses",
+		Subresource:     "aggregator",
+		Name:            cluster,
+		ResourceRequest: true,
+		Path:            testPathPrefix + cluster + "/aggregator/" + subResource + "/namespaces",
+	}
+}
+
+// newTestServiceInfoGetter returns a getter that routes the sub-resources to the aggregator services
+func newTestServiceInfoGetter(t *testing.T, subResources ...string) *getter.AggregatorServiceInfoGetter {
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	for _, subResource := range subResources {
+		if err := serviceInfoGetter.AddAggregatorServiceInfo(&getter.AggregatorServiceInfo{
+			Name:        "default/" + subResource,
+			SubResource: subResource,
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return serviceInfoGetter
+}
+
+func TestAggregatorAuthorizer(t *testing.T) {
+	a := NewAggregatorAuthorizer(newFakeAuthorizer(
+		rule{user: "admin", subresource: "aggregator"},
+		rule{user: "team-a", subresource: "aggregator", name: "cluster-a"},
+		rule{user: "team-b", subresource: "aggregator/v1", name: "cluster-b"},
+		rule{user: "team-c", subresource: "aggregator/metrics/v1", name: "cluster-c"},
+		rule{user: "team-d", subresource: "aggregator/metrics", name: "cluster-d"},
+		rule{user: "team-e", subresource: "aggregator/unknown", name: "cluster-e"},
+	), newTestServiceInfoGetter(t, "v1", "metrics", "metrics/v1", "metrics/v2"))
+
+	cases := []struct {
+		name     string
+		attrs    authorizer.Attributes
+		expected authorizer.Decision
+	}{
+		{
+			name:     "all clusters",
+			attrs:    newAggregatorAttributes("admin", "cluster-b", "metrics"),
+			expected: authorizer.DecisionAllow,
+		},
+		{
+			name:     "all sub-resources of own cluster",
+			attrs:    newAggregatorAttributes("team-a", "cluster-a", "metrics"),
+			expected: authorizer.DecisionAllow,
+		},
+		{
+			name:     "other cluster",
+			attrs:    newAggregatorAttributes("team-a", "cluster-b", "v1"),
+			expected: authorizer.DecisionNoOpinion,
+		},
+		{
+			name:     "allowed sub-resource of own cluster",
+			attrs:    newAggregatorAttributes("team-b", "cluster-b", "v1"),
+			expected: authorizer.DecisionAllow,
+		},
+		{
+			name:     "other sub-resource of own cluster",
+			attrs:    newAggregatorAttributes("team-b", "cluster-b", "metrics"),
+			expected: authorizer.DecisionNoOpinion,
+		},
+		{
+			name:     "allowed sub-resource of other cluster",
+			attrs:    newAggregatorAttributes("team-b", "cluster-a", "v1"),
+			expected: authorizer.DecisionNoOpinion,
+		},
+		{
+			name:     "allowed multi-segment sub-resource",
+			attrs:    newAggregatorAttributes("team-c", "cluster-c", "metrics/v1"),
+			expected: authorizer.DecisionAllow,
+		},
+		{
+			name:     "sibling of allowed multi-segment sub-resource",
+			attrs:    newAggregatorAttributes("team-c", "cluster-c", "metrics/v2"),
+			expected: authorizer.DecisionNoOpinion,
+		},
+		{
+			name:     "parent of allowed multi-segment sub-resource",
+			attrs:    newAggregatorAttributes("team-c", "cluster-c", "metrics"),
+			expected: authorizer.DecisionNoOpinion,
+		},
+		{
+			name:     "allowed first segment does not allow multi-segment sub-resource",
+			attrs:    newAggregatorAttributes("team-d", "cluster-d", "metrics/v2"),
+			expected: authorizer.DecisionNoOpinion,
+		},
+		{
+			name:     "allowed first segment routed to the first segment",
+			attrs:    newAggregatorAttributes("team-d", "cluster-d", "metrics/v3"),
+			expected: authorizer.DecisionAllow,
+		},
+		{
+			name:     "unregistered sub-resource",
+			attrs:    newAggregatorAttributes("team-e", "cluster-e", "unknown"),
+			expected: authorizer.DecisionNoOpinion,
+		},
+		{
+			name:     "fan-out request, authorized per cluster by the handler",
+			attrs:    newAggregatorAttributes("team-a", "-", "v1"),
+			expected: authorizer.DecisionAllow,
+		},
+		{
+			name: "non aggregator request",
+			attrs: authorizer.AttributesRecord{
+				User:            &user.DefaultInfo{Name: "team-b"},
+				Verb:            "get",
+				APIGroup:        "aggregation.open-cluster-management.io",
+				Resource:        "clusterstatuses",
+				Name:            "cluster-b",
+				ResourceRequest: true,
+				Path:            testPathPrefix + "cluster-b",
+			},
+			expected: authorizer.DecisionNoOpinion,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			decision, reason, err := a.Authorize(context.TODO(), c.attrs)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if decision != c.expected {
+				t.Errorf("expected decision %v, but %v", c.expected, decision)
+			}
+			if decision != authorizer.DecisionAllow && reason == "" {
+				t.Errorf("expected a reason for the denied request")
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package circuitbreaker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+)
+
+// State is the state of a circuit breaker
+type State string
+
+const (
+	// StateClosed lets all requests through, the breaker is opened if the error rate reaches the threshold
+	StateClosed State = "Closed"
+	// StateOpen rejects all requests until the open duration elapses
+	StateOpen State = "Open"
+	// StateHalfOpen lets one probe request through, the breaker is closed if the probe succeeds, otherwise opened again
+	StateHalfOpen State = "HalfOpen"
+)
+
+// stateValues are the values of the states in the state metric
+var stateValues = map[State]int{StateClosed: 0, StateHalfOpen: 1, StateOpen: 2}
+
+const (
+	DefaultMinimumRequests = 20
+	DefaultOpenDuration    = 30 * time.Second
+)
+
+// Config is the thresholds of a circuit breaker
+type Config struct {
+	// ErrorRateThreshold is the percentage of the failed requests that opens the breaker
+	ErrorRateThreshold int
+	// LatencyThreshold is the duration that a request slower than it is counted as failed, it is disabled if it is 0
+	LatencyThreshold time.Duration
+	// MinimumRequests is the number of the latest requests that the error rate is calculated from, the breaker is not
+	// opened until there are so many requests
+	MinimumRequests int
+	// OpenDuration is how long the breaker rejects the requests before it lets a probe request through
+	OpenDuration time.Duration
+}
+
+// Snapshot is the observed state of a circuit breaker
+type Snapshot struct {
+	Name     string     `json:"name"`
+	State    State      `json:"state"`
+	Requests int        `json:"requests"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+}
+
+// Breaker is a circuit breaker of an aggregator service
+type Breaker struct {
+	name   string
+	config Config
+	now    func() time.Time
+
+	mutex    sync.Mutex
+	state    State
+	results  []bool
+	next     int
+	count    int
+	openedAt time.Time
+	probing  bool
+}
+
+// Complete returns the config with the defaults of the unset thresholds
+func (c Config) Complete() Config {
+	if c.MinimumRequests <= 0 {
+		c.MinimumRequests = DefaultMinimumRequests
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = DefaultOpenDuration
+	}
+	return c
+}
+
+// New returns a closed circuit breaker, the defaults are used for the unset thresholds
+func New(name string, config Config) *Breaker {
+	config = config.Complete()
+	b := &Breaker{
+		name:    name,
+		config:  config,
+		now:     time.Now,
+		state:   StateClosed,
+		results: make([]bool, config.MinimumRequests),
+	}
+	metrics.SetCircuitBreakerState(name, stateValues[StateClosed])
+	return b
+}
+
+// Config returns the thresholds of the breaker
+func (b *Breaker) Config() Config {
+	return b.config
+}
+
+// Allow returns true if a request can be sent to the backend, otherwise it returns how long the caller should wait
+// before retrying
+func (b *Breaker) Allow() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case StateOpen:
+		if elapsed := b.now().Sub(b.openedAt); elapsed < b.config.OpenDuration {
+			metrics.RecordCircuitBreakerRejection(b.name)
+			return false, b.config.OpenDuration - elapsed
+		}
+		b.setState(StateHalfOpen)
+		b.probing = true
+		return true, 0
+	case StateHalfOpen:
+		if b.probing {
+			// wait for the result of the probe request
+			metrics.RecordCircuitBreakerRejection(b.name)
+			return false, time.Second
+		}
+		b.probing = true
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+// Record records the result of a request that was allowed, a request slower than the latency threshold is counted
+// as failed
+func (b *Breaker) Record(failed bool, elapsed time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.config.LatencyThreshold > 0 && elapsed > b.config.LatencyThreshold {
+		failed = true
+	}
+
+	switch b.state {
+	case StateHalfOpen:
+		b.probing = false
+		if failed {
+			b.open()
+			return
+		}
+		b.reset()
+		b.setState(StateClosed)
+	case StateClosed:
+		b.results[b.next] = failed
+		b.next = (b.next + 1) % len(b.results)
+		if b.count < len(b.results) {
+			b.count++
+		}
+		if b.count < len(b.results) {
+			return
+		}
+		if b.failures()*100 >= b.config.ErrorRateThreshold*b.count {
+			b.open()
+		}
+	}
+}
+
+// Snapshot returns the observed state of the breaker
+func (b *Breaker) Snapshot() Snapshot {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	snapshot := Snapshot{
+		Name:     b.name,
+		State:    b.state,
+		Requests: b.count,
+		Failures: b.failures(),
+	}
+	if b.state != StateClosed {
+		openedAt := b.openedAt
+		snapshot.OpenedAt = &openedAt
+	}
+	return snapshot
+}
+
+// Close removes the metrics of the breaker when its aggregator service is removed
+func (b *Breaker) Close() {
+	metrics.DeleteCircuitBreaker(b.name)
+}
+
+func (b *Breaker) open() {
+	b.reset()
+	b.openedAt = b.now()
+	b.setState(StateOpen)
+}
+
+func (b *Breaker) reset() {
+	for i := range b.results {
+		b.results[i] = false
+	}
+	b.next = 0
+	b.count = 0
+}
+
+func (b *Breaker) failures() int {
+	failures := 0
+	for i := 0; i < b.count; i++ {
+		if b.results[i] {
+			failures++
+		}
+	}
+	return failures
+}
+
+func (b *Breaker) setState(state State) {
+	b.state = state
+	metrics.SetCircuitBreakerState(b.name, stateValues[state])
+}
@@ -0,0 +1,104 @@
+package circuitbreaker
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker(config Config) (*Breaker, *time.Time) {
+	now := time.Now()
+	b := New("default/sub", config)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+func expectState(t *testing.T, b *Breaker, expected State) {
+	t.Helper()
+	if state := b.Snapshot().State; state != expected {
+		t.Errorf("expected state %s, but %s", expected, state)
+	}
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	b, now := newTestBreaker(Config{ErrorRateThreshold: 50, MinimumRequests: 4, OpenDuration: 10 * time.Second})
+
+	// the breaker is not opened until there are enough requests
+	for i := 0; i < 3; i++ {
+		b.Record(true, 0)
+	}
+	expectState(t, b, StateClosed)
+
+	b.Record(false, 0)
+	expectState(t, b, StateOpen)
+
+	*now = now.Add(4 * time.Second)
+	allowed, retryAfter := b.Allow()
+	if allowed {
+		t.Errorf("expected the request is rejected by the open breaker")
+	}
+	if retryAfter != 6*time.Second {
+		t.Errorf("expected retry after 6s, but %s", retryAfter)
+	}
+}
+
+func TestBreakerErrorRateBelowThreshold(t *testing.T) {
+	b, _ := newTestBreaker(Config{ErrorRateThreshold: 50, MinimumRequests: 4})
+
+	for i := 0; i < 10; i++ {
+		b.Record(i%4 == 0, 0)
+	}
+	expectState(t, b, StateClosed)
+	if allowed, _ := b.Allow(); !allowed {
+		t.Errorf("expected the request is allowed by the closed breaker")
+	}
+}
+
+func TestBreakerLatencyThreshold(t *testing.T) {
+	b, _ := newTestBreaker(Config{ErrorRateThreshold: 100, LatencyThreshold: time.Second, MinimumRequests: 2})
+
+	b.Record(false, 2*time.Second)
+	b.Record(false, 3*time.Second)
+	expectState(t, b, StateOpen)
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	b, now := newTestBreaker(Config{ErrorRateThreshold: 100, MinimumRequests: 1, OpenDuration: 10 * time.Second})
+
+	b.Record(true, 0)
+	expectState(t, b, StateOpen)
+
+	// only one probe request is let through after the open duration
+	*now = now.Add(10 * time.Second)
+	if allowed, _ := b.Allow(); !allowed {
+		t.Errorf("expected the probe request is allowed")
+	}
+	expectState(t, b, StateHalfOpen)
+	if allowed, _ := b.Allow(); allowed {
+		t.Errorf("expected the request is rejected while the probe is in flight")
+	}
+
+	// the failed probe opens the breaker again
+	b.Record(true, 0)
+	expectState(t, b, StateOpen)
+	if allowed, _ := b.Allow(); allowed {
+		t.Errorf("expected the request is rejected by the reopened breaker")
+	}
+
+	// the succeeded probe closes the breaker
+	*now = now.Add(10 * time.Second)
+	if allowed, _ := b.Allow(); !allowed {
+		t.Errorf("expected the probe request is allowed")
+	}
+	b.Record(false, 0)
+	expectState(t, b, StateClosed)
+	if snapshot := b.Snapshot(); snapshot.Requests != 0 || snapshot.OpenedAt != nil {
+		t.Errorf("expected the closed breaker is reset, but %#v", snapshot)
+	}
+}
+
+func TestConfigComplete(t *testing.T) {
+	config := Config{ErrorRateThreshold: 50}.Complete()
+	if config.MinimumRequests != DefaultMinimumRequests || config.OpenDuration != DefaultOpenDuration {
+		t.Errorf("expected the default thresholds, but %#v", config)
+	}
+}
@@ -0,0 +1,66 @@
+// Package aggregator provides the clients of the APIs that are proxied by the aggregator sub-resources of the
+// clusters, e.g. the kube-apiserver of a managed cluster is called with a kubernetes.Interface through the proxy.
+package aggregator
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+// ConfigFor returns a copy of the config of the proxy server that is scoped to the aggregator sub-resource of a
+// cluster, the paths of the requests are the paths on the backend of the aggregator service.
+func ConfigFor(config *rest.Config, clusterName, subResource string) (*rest.Config, error) {
+	subResource = strings.Trim(subResource, "/")
+	if clusterName == "" || strings.Contains(clusterName, "/") {
+		return nil, fmt.Errorf("the cluster name %q is invalid", clusterName)
+	}
+	if subResource == "" {
+		return nil, fmt.Errorf("the aggregator sub-resource is required")
+	}
+
+	hostURL, err := url.Parse(config.Host)
+	if err != nil || hostURL.Scheme == "" || hostURL.Host == "" {
+		// the host may have no scheme, it is a https host as the rest client does
+		hostURL, err = url.Parse("https://" + config.Host)
+		if err != nil {
+			return nil, fmt.Errorf("the host %q is invalid: %v", config.Host, err)
+		}
+	}
+	// the rest client keeps the path of the host as the prefix of the request paths
+	hostURL.Path = path.Join("/", hostURL.Path, "apis", aggregationv1.GroupName,
+		aggregationv1.SchemeGroupVersion.Version, "clusterstatuses", clusterName, "aggregator", subResource)
+
+	scopedConfig := rest.CopyConfig(config)
+	scopedConfig.Host = hostURL.String()
+	return scopedConfig, nil
+}
+
+// RESTClientFor returns a rest client of the aggregator sub-resource of a cluster, the kubernetes scheme is used if
+// the config has no serializer.
+func RESTClientFor(config *rest.Config, clusterName, subResource string) (rest.Interface, error) {
+	scopedConfig, err := ConfigFor(config, clusterName, subResource)
+	if err != nil {
+		return nil, err
+	}
+	if scopedConfig.NegotiatedSerializer == nil {
+		scopedConfig.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+	}
+	return rest.UnversionedRESTClientFor(scopedConfig)
+}
+
+// KubernetesClientFor returns a kubernetes client of the aggregator sub-resource of a cluster, the backend of the
+// aggregator service is expected to serve the kubernetes APIs, e.g. it is the kube-apiserver of the cluster.
+func KubernetesClientFor(config *rest.Config, clusterName, subResource string) (kubernetes.Interface, error) {
+	scopedConfig, err := ConfigFor(config, clusterName, subResource)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(scopedConfig)
+}
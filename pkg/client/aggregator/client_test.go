@@ -0,0 +1,136 @@
+package aggregator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+)
+
+const testPrefix = "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/cluster1/aggregator/sub"
+
+func TestConfigFor(t *testing.T) {
+	cases := []struct {
+		name        string
+		host        string
+		clusterName string
+		subResource string
+		expected    string
+		expectedErr bool
+	}{
+		{
+			name:        "url",
+			host:        "https://proxy.example.com:6443",
+			clusterName: "cluster1",
+			subResource: "/sub/",
+			expected:    "https://proxy.example.com:6443" + testPrefix,
+		},
+		{
+			name:        "host with path",
+			host:        "https://proxy.example.com/prefix/",
+			clusterName: "cluster1",
+			subResource: "sub",
+			expected:    "https://proxy.example.com/prefix" + testPrefix,
+		},
+		{
+			name:        "host without scheme",
+			host:        "proxy.example.com",
+			clusterName: "cluster1",
+			subResource: "sub",
+			expected:    "https://proxy.example.com" + testPrefix,
+		},
+		{
+			name:        "no cluster",
+			host:        "https://proxy.example.com",
+			subResource: "sub",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid cluster",
+			host:        "https://proxy.example.com",
+			clusterName: "cluster1/aggregator",
+			subResource: "sub",
+			expectedErr: true,
+		},
+		{
+			name:        "no sub-resource",
+			host:        "https://proxy.example.com",
+			clusterName: "cluster1",
+			subResource: "/",
+			expectedErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config := &rest.Config{Host: c.host, BearerToken: "token"}
+			scopedConfig, err := ConfigFor(config, c.clusterName, c.subResource)
+			if c.expectedErr {
+				if err == nil {
+					t.Errorf("expected an error, but %s", scopedConfig.Host)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if scopedConfig.Host != c.expected {
+				t.Errorf("expected host %s, but %s", c.expected, scopedConfig.Host)
+			}
+			if scopedConfig.BearerToken != "token" {
+				t.Errorf("expected the credentials are copied, but %q", scopedConfig.BearerToken)
+			}
+			if config.Host != c.host {
+				t.Errorf("expected the config is not changed, but %s", config.Host)
+			}
+		})
+	}
+}
+
+func TestClientsFor(t *testing.T) {
+	var requestPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestPath = req.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		pods := &corev1.PodList{
+			TypeMeta: metav1.TypeMeta{Kind: "PodList", APIVersion: "v1"},
+			Items:    []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod1"}}},
+		}
+		_, _ = w.Write([]byte(runtime.EncodeOrDie(scheme.Codecs.LegacyCodec(corev1.SchemeGroupVersion), pods)))
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL}
+	expectedPath := testPrefix + "/api/v1/namespaces/default/pods"
+
+	kubeClient, err := KubernetesClientFor(config, "cluster1", "sub")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pods, err := kubeClient.CoreV1().Pods("default").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requestPath != expectedPath {
+		t.Errorf("expected path %s, but %s", expectedPath, requestPath)
+	}
+	if len(pods.Items) != 1 || pods.Items[0].Name != "pod1" {
+		t.Errorf("expected pod1, but %v", pods.Items)
+	}
+
+	restClient, err := RESTClientFor(config, "cluster1", "sub")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := restClient.Get().AbsPath("/api/v1/namespaces/default/pods").Do().Error(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requestPath != expectedPath {
+		t.Errorf("expected path %s, but %s", expectedPath, requestPath)
+	}
+}
@@ -0,0 +1,73 @@
+// Code generated by client-gen. DO NOT EDIT.
+
+package v1
+
+import (
+	v1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/client/clientset/versioned/scheme"
+	rest "k8s.io/client-go/rest"
+)
+
+type AggregationV1Interface interface {
+	RESTClient() rest.Interface
+	ClusterStatusesGetter
+}
+
+// AggregationV1Client is used to interact with features provided by the aggregation.open-cluster-management.io group.
+type AggregationV1Client struct {
+	restClient rest.Interface
+}
+
+func (c *AggregationV1Client) ClusterStatuses() ClusterStatusInterface {
+	return newClusterStatuses(c)
+}
+
+// NewForConfig creates a new AggregationV1Client for the given config.
+func NewForConfig(c *rest.Config) (*AggregationV1Client, error) {
+	config := *c
+	if err := setConfigDefaults(&config); err != nil {
+		return nil, err
+	}
+	client, err := rest.RESTClientFor(&config)
+	if err != nil {
+		return nil, err
+	}
+	return &AggregationV1Client{client}, nil
+}
+
+// NewForConfigOrDie creates a new AggregationV1Client for the given config and
+// panics if there is an error in the config.
+func NewForConfigOrDie(c *rest.Config) *AggregationV1Client {
+	client, err := NewForConfig(c)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// New creates a new AggregationV1Client for the given RESTClient.
+func New(c rest.Interface) *AggregationV1Client {
+	return &AggregationV1Client{c}
+}
+
+func setConfigDefaults(config *rest.Config) error {
+	gv := v1.SchemeGroupVersion
+	config.GroupVersion = &gv
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+
+	return nil
+}
+
+// RESTClient returns a RESTClient that is used to communicate
+// with API server by this client implementation.
+func (c *AggregationV1Client) RESTClient() rest.Interface {
+	if c == nil {
+		return nil
+	}
+	return c.restClient
+}
@@ -0,0 +1,81 @@
+// Code generated by client-gen. DO NOT EDIT.
+
+package v1
+
+import (
+	"time"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	scheme "github.com/skeeey/aggregator-proxy-server/pkg/client/clientset/versioned/scheme"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	watch "k8s.io/apimachinery/pkg/watch"
+	rest "k8s.io/client-go/rest"
+)
+
+// ClusterStatusesGetter has a method to return a ClusterStatusInterface.
+// A group's client should implement this interface.
+type ClusterStatusesGetter interface {
+	ClusterStatuses() ClusterStatusInterface
+}
+
+// ClusterStatusInterface has methods to work with ClusterStatus resources.
+type ClusterStatusInterface interface {
+	Get(name string, options v1.GetOptions) (*aggregationv1.ClusterStatus, error)
+	List(opts v1.ListOptions) (*aggregationv1.ClusterStatusList, error)
+	Watch(opts v1.ListOptions) (watch.Interface, error)
+	ClusterStatusExpansion
+}
+
+// clusterStatuses implements ClusterStatusInterface
+type clusterStatuses struct {
+	client rest.Interface
+}
+
+// newClusterStatuses returns a ClusterStatuses
+func newClusterStatuses(c *AggregationV1Client) *clusterStatuses {
+	return &clusterStatuses{
+		client: c.RESTClient(),
+	}
+}
+
+// Get takes name of the clusterStatus, and returns the corresponding clusterStatus object, and an error if there is any.
+func (c *clusterStatuses) Get(name string, options v1.GetOptions) (result *aggregationv1.ClusterStatus, err error) {
+	result = &aggregationv1.ClusterStatus{}
+	err = c.client.Get().
+		Resource("clusterstatuses").
+		Name(name).
+		VersionedParams(&options, scheme.ParameterCodec).
+		Do().
+		Into(result)
+	return
+}
+
+// List takes label and field selectors, and returns the list of ClusterStatuses that match those selectors.
+func (c *clusterStatuses) List(opts v1.ListOptions) (result *aggregationv1.ClusterStatusList, err error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	result = &aggregationv1.ClusterStatusList{}
+	err = c.client.Get().
+		Resource("clusterstatuses").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Timeout(timeout).
+		Do().
+		Into(result)
+	return
+}
+
+// Watch returns a watch.Interface that watches the requested clusterStatuses.
+func (c *clusterStatuses) Watch(opts v1.ListOptions) (watch.Interface, error) {
+	var timeout time.Duration
+	if opts.TimeoutSeconds != nil {
+		timeout = time.Duration(*opts.TimeoutSeconds) * time.Second
+	}
+	opts.Watch = true
+	return c.client.Get().
+		Resource("clusterstatuses").
+		VersionedParams(&opts, scheme.ParameterCodec).
+		Timeout(timeout).
+		Watch()
+}
@@ -0,0 +1,24 @@
+// Code generated by client-gen. DO NOT EDIT.
+
+package fake
+
+import (
+	v1 "github.com/skeeey/aggregator-proxy-server/pkg/client/clientset/versioned/typed/aggregation/v1"
+	rest "k8s.io/client-go/rest"
+	testing "k8s.io/client-go/testing"
+)
+
+type FakeAggregationV1 struct {
+	*testing.Fake
+}
+
+func (c *FakeAggregationV1) ClusterStatuses() v1.ClusterStatusInterface {
+	return &FakeClusterStatuses{c}
+}
+
+// RESTClient returns a RESTClient that is used to communicate
+// with API server by this client implementation.
+func (c *FakeAggregationV1) RESTClient() rest.Interface {
+	var ret *rest.RESTClient
+	return ret
+}
@@ -0,0 +1,58 @@
+// Code generated by client-gen. DO NOT EDIT.
+
+package fake
+
+import (
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	labels "k8s.io/apimachinery/pkg/labels"
+	schema "k8s.io/apimachinery/pkg/runtime/schema"
+	watch "k8s.io/apimachinery/pkg/watch"
+	testing "k8s.io/client-go/testing"
+)
+
+// FakeClusterStatuses implements ClusterStatusInterface
+type FakeClusterStatuses struct {
+	Fake *FakeAggregationV1
+}
+
+var clusterstatusesResource = schema.GroupVersionResource{Group: "aggregation.open-cluster-management.io", Version: "v1", Resource: "clusterstatuses"}
+
+var clusterstatusesKind = schema.GroupVersionKind{Group: "aggregation.open-cluster-management.io", Version: "v1", Kind: "ClusterStatus"}
+
+// Get takes name of the clusterStatus, and returns the corresponding clusterStatus object, and an error if there is any.
+func (c *FakeClusterStatuses) Get(name string, options v1.GetOptions) (result *aggregationv1.ClusterStatus, err error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewRootGetAction(clusterstatusesResource, name), &aggregationv1.ClusterStatus{})
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*aggregationv1.ClusterStatus), err
+}
+
+// List takes label and field selectors, and returns the list of ClusterStatuses that match those selectors.
+func (c *FakeClusterStatuses) List(opts v1.ListOptions) (result *aggregationv1.ClusterStatusList, err error) {
+	obj, err := c.Fake.
+		Invokes(testing.NewRootListAction(clusterstatusesResource, clusterstatusesKind, opts), &aggregationv1.ClusterStatusList{})
+	if obj == nil {
+		return nil, err
+	}
+
+	label, _, _ := testing.ExtractFromListOptions(opts)
+	if label == nil {
+		label = labels.Everything()
+	}
+	list := &aggregationv1.ClusterStatusList{ListMeta: obj.(*aggregationv1.ClusterStatusList).ListMeta}
+	for _, item := range obj.(*aggregationv1.ClusterStatusList).Items {
+		if label.Matches(labels.Set(item.Labels)) {
+			list.Items = append(list.Items, item)
+		}
+	}
+	return list, err
+}
+
+// Watch returns a watch.Interface that watches the requested clusterStatuses.
+func (c *FakeClusterStatuses) Watch(opts v1.ListOptions) (watch.Interface, error) {
+	return c.Fake.
+		InvokesWatch(testing.NewRootWatchAction(clusterstatusesResource, opts))
+}
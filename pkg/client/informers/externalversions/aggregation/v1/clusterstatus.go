@@ -0,0 +1,72 @@
+// Code generated by informer-gen. DO NOT EDIT.
+
+package v1
+
+import (
+	time "time"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	versioned "github.com/skeeey/aggregator-proxy-server/pkg/client/clientset/versioned"
+	internalinterfaces "github.com/skeeey/aggregator-proxy-server/pkg/client/informers/externalversions/internalinterfaces"
+	v1 "github.com/skeeey/aggregator-proxy-server/pkg/client/listers/aggregation/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	watch "k8s.io/apimachinery/pkg/watch"
+	cache "k8s.io/client-go/tools/cache"
+)
+
+// ClusterStatusInformer provides access to a shared informer and lister for
+// ClusterStatuses.
+type ClusterStatusInformer interface {
+	Informer() cache.SharedIndexInformer
+	Lister() v1.ClusterStatusLister
+}
+
+type clusterStatusInformer struct {
+	factory          internalinterfaces.SharedInformerFactory
+	tweakListOptions internalinterfaces.TweakListOptionsFunc
+}
+
+// NewClusterStatusInformer constructs a new informer for ClusterStatus type.
+// Always prefer using an informer factory to get a shared informer instead of getting an independent
+// one. This reduces memory footprint and number of connections to the server.
+func NewClusterStatusInformer(client versioned.Interface, resyncPeriod time.Duration, indexers cache.Indexers) cache.SharedIndexInformer {
+	return NewFilteredClusterStatusInformer(client, resyncPeriod, indexers, nil)
+}
+
+// NewFilteredClusterStatusInformer constructs a new informer for ClusterStatus type.
+// Always prefer using an informer factory to get a shared informer instead of getting an independent
+// one. This reduces memory footprint and number of connections to the server.
+func NewFilteredClusterStatusInformer(client versioned.Interface, resyncPeriod time.Duration, indexers cache.Indexers, tweakListOptions internalinterfaces.TweakListOptionsFunc) cache.SharedIndexInformer {
+	return cache.NewSharedIndexInformer(
+		&cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				if tweakListOptions != nil {
+					tweakListOptions(&options)
+				}
+				return client.AggregationV1().ClusterStatuses().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				if tweakListOptions != nil {
+					tweakListOptions(&options)
+				}
+				return client.AggregationV1().ClusterStatuses().Watch(options)
+			},
+		},
+		&aggregationv1.ClusterStatus{},
+		resyncPeriod,
+		indexers,
+	)
+}
+
+func (f *clusterStatusInformer) defaultInformer(client versioned.Interface, resyncPeriod time.Duration) cache.SharedIndexInformer {
+	return NewFilteredClusterStatusInformer(client, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}, f.tweakListOptions)
+}
+
+func (f *clusterStatusInformer) Informer() cache.SharedIndexInformer {
+	return f.factory.InformerFor(&aggregationv1.ClusterStatus{}, f.defaultInformer)
+}
+
+func (f *clusterStatusInformer) Lister() v1.ClusterStatusLister {
+	return v1.NewClusterStatusLister(f.Informer().GetIndexer())
+}
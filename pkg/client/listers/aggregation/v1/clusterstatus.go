@@ -0,0 +1,49 @@
+// Code generated by lister-gen. DO NOT EDIT.
+
+package v1
+
+import (
+	v1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ClusterStatusLister helps list ClusterStatuses.
+type ClusterStatusLister interface {
+	// List lists all ClusterStatuses in the indexer.
+	List(selector labels.Selector) (ret []*v1.ClusterStatus, err error)
+	// Get retrieves the ClusterStatus from the index for a given name.
+	Get(name string) (*v1.ClusterStatus, error)
+	ClusterStatusListerExpansion
+}
+
+// clusterStatusLister implements the ClusterStatusLister interface.
+type clusterStatusLister struct {
+	indexer cache.Indexer
+}
+
+// NewClusterStatusLister returns a new ClusterStatusLister.
+func NewClusterStatusLister(indexer cache.Indexer) ClusterStatusLister {
+	return &clusterStatusLister{indexer: indexer}
+}
+
+// List lists all ClusterStatuses in the indexer.
+func (s *clusterStatusLister) List(selector labels.Selector) (ret []*v1.ClusterStatus, err error) {
+	err = cache.ListAll(s.indexer, selector, func(m interface{}) {
+		ret = append(ret, m.(*v1.ClusterStatus))
+	})
+	return ret, err
+}
+
+// Get retrieves the ClusterStatus from the index for a given name.
+func (s *clusterStatusLister) Get(name string) (*v1.ClusterStatus, error) {
+	obj, exists, err := s.indexer.GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(v1.Resource("clusterstatus"), name)
+	}
+	return obj.(*v1.ClusterStatus), nil
+}
@@ -0,0 +1,249 @@
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	v1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The kinds of the objects that the clusters are registered with
+const (
+	SourceNamespace = "namespace"
+	SourceConfigMap = "configmap"
+)
+
+// Source provides the registered clusters that can be accessed through the aggregator
+type Source interface {
+	// List returns the registered clusters that match the label selector, ordered by name
+	List(selector labels.Selector) ([]*aggregationv1.ClusterStatus, error)
+	// Get returns a registered cluster, a NotFound error is returned if the cluster is not registered
+	Get(name string) (*aggregationv1.ClusterStatus, error)
+	// HasSynced returns true if the registered clusters have been synced
+	HasSynced() bool
+	// Watch returns the changes of the registered clusters, starting with the ADDED events of the current clusters
+	Watch() (watch.Interface, error)
+}
+
+// namespaceSource registers a cluster with a labelled namespace, the cluster name is the namespace name
+type namespaceSource struct {
+	lister      v1.NamespaceLister
+	selector    labels.Selector
+	synced      cache.InformerSynced
+	broadcaster *clusterBroadcaster
+}
+
+func NewNamespaceSource(informer coreinformers.NamespaceInformer, selector labels.Selector) Source {
+	s := &namespaceSource{
+		lister:      informer.Lister(),
+		selector:    selector,
+		synced:      informer.Informer().HasSynced,
+		broadcaster: newClusterBroadcaster(),
+	}
+	informer.Informer().AddEventHandler(s.broadcaster.eventHandler(s.clusterFor))
+	return s
+}
+
+func (s *namespaceSource) List(selector labels.Selector) ([]*aggregationv1.ClusterStatus, error) {
+	namespaces, err := s.lister.List(s.selector)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := []*aggregationv1.ClusterStatus{}
+	for _, namespace := range namespaces {
+		if selector.Matches(labels.Set(namespace.Labels)) {
+			clusters = append(clusters, clusterForNamespace(namespace))
+		}
+	}
+	sortClusters(clusters)
+	return clusters, nil
+}
+
+func (s *namespaceSource) Get(name string) (*aggregationv1.ClusterStatus, error) {
+	namespace, err := s.lister.Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if err != nil || !s.selector.Matches(labels.Set(namespace.Labels)) {
+		return nil, errors.NewNotFound(aggregationv1.Resource("clusterstatuses"), name)
+	}
+	return clusterForNamespace(namespace), nil
+}
+
+func (s *namespaceSource) HasSynced() bool {
+	return s.synced()
+}
+
+func (s *namespaceSource) Watch() (watch.Interface, error) {
+	return s.broadcaster.watch(func() ([]*aggregationv1.ClusterStatus, error) {
+		return s.List(labels.Everything())
+	})
+}
+
+// clusterFor returns the cluster of a namespace event, it is false if the namespace does not register a cluster
+func (s *namespaceSource) clusterFor(obj interface{}) (*aggregationv1.ClusterStatus, bool) {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok || !s.selector.Matches(labels.Set(namespace.Labels)) {
+		return nil, false
+	}
+	return clusterForNamespace(namespace), true
+}
+
+func clusterForNamespace(namespace *corev1.Namespace) *aggregationv1.ClusterStatus {
+	condition := newAvailableCondition(namespace.CreationTimestamp, corev1.ConditionTrue, "NamespaceActive")
+	if namespace.DeletionTimestamp != nil {
+		condition = newAvailableCondition(*namespace.DeletionTimestamp, corev1.ConditionFalse, "NamespaceTerminating")
+	}
+	return newCluster(namespace.ObjectMeta, condition)
+}
+
+// configMapSource registers a cluster with a labelled configmap in a namespace, the cluster name is the configmap name
+type configMapSource struct {
+	lister      v1.ConfigMapNamespaceLister
+	namespace   string
+	selector    labels.Selector
+	synced      cache.InformerSynced
+	broadcaster *clusterBroadcaster
+}
+
+func NewConfigMapSource(informer coreinformers.ConfigMapInformer, namespace string, selector labels.Selector) Source {
+	s := &configMapSource{
+		lister:      informer.Lister().ConfigMaps(namespace),
+		namespace:   namespace,
+		selector:    selector,
+		synced:      informer.Informer().HasSynced,
+		broadcaster: newClusterBroadcaster(),
+	}
+	informer.Informer().AddEventHandler(s.broadcaster.eventHandler(s.clusterFor))
+	return s
+}
+
+func (s *configMapSource) List(selector labels.Selector) ([]*aggregationv1.ClusterStatus, error) {
+	configMaps, err := s.lister.List(s.selector)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := []*aggregationv1.ClusterStatus{}
+	for _, configMap := range configMaps {
+		if selector.Matches(labels.Set(configMap.Labels)) {
+			clusters = append(clusters, clusterForConfigMap(configMap))
+		}
+	}
+	sortClusters(clusters)
+	return clusters, nil
+}
+
+func (s *configMapSource) Get(name string) (*aggregationv1.ClusterStatus, error) {
+	configMap, err := s.lister.Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if err != nil || !s.selector.Matches(labels.Set(configMap.Labels)) {
+		return nil, errors.NewNotFound(aggregationv1.Resource("clusterstatuses"), name)
+	}
+	return clusterForConfigMap(configMap), nil
+}
+
+func (s *configMapSource) HasSynced() bool {
+	return s.synced()
+}
+
+func (s *configMapSource) Watch() (watch.Interface, error) {
+	return s.broadcaster.watch(func() ([]*aggregationv1.ClusterStatus, error) {
+		return s.List(labels.Everything())
+	})
+}
+
+// clusterFor returns the cluster of a configmap event, it is false if the configmap does not register a cluster
+func (s *configMapSource) clusterFor(obj interface{}) (*aggregationv1.ClusterStatus, bool) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok || configMap.Namespace != s.namespace || !s.selector.Matches(labels.Set(configMap.Labels)) {
+		return nil, false
+	}
+	return clusterForConfigMap(configMap), true
+}
+
+func clusterForConfigMap(configMap *corev1.ConfigMap) *aggregationv1.ClusterStatus {
+	condition := newAvailableCondition(configMap.CreationTimestamp, corev1.ConditionTrue, "ClusterRegistered")
+	if configMap.DeletionTimestamp != nil {
+		condition = newAvailableCondition(*configMap.DeletionTimestamp, corev1.ConditionFalse, "ClusterDeregistering")
+	}
+	return newCluster(configMap.ObjectMeta, condition)
+}
+
+func newCluster(meta metav1.ObjectMeta, conditions ...aggregationv1.ClusterStatusCondition) *aggregationv1.ClusterStatus {
+	clusterLabels := map[string]string{}
+	for key, value := range meta.Labels {
+		clusterLabels[key] = value
+	}
+
+	return &aggregationv1.ClusterStatus{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              meta.Name,
+			Labels:            clusterLabels,
+			CreationTimestamp: meta.CreationTimestamp,
+			ResourceVersion:   meta.ResourceVersion,
+		},
+		Status: aggregationv1.ClusterStatusStatus{
+			Conditions: conditions,
+		},
+	}
+}
+
+func newAvailableCondition(
+	transitionTime metav1.Time, status corev1.ConditionStatus, reason string) aggregationv1.ClusterStatusCondition {
+	return aggregationv1.ClusterStatusCondition{
+		Type:               aggregationv1.ClusterAvailable,
+		Status:             status,
+		LastTransitionTime: transitionTime,
+		Reason:             reason,
+	}
+}
+
+func sortClusters(clusters []*aggregationv1.ClusterStatus) {
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+}
+
+// NewSource returns a cluster source for the kind of objects that the clusters are registered with, and the informer
+// factory of the objects that is started by the caller. The selector is pushed into the list options, and the
+// configmaps are only listed in the cluster namespace, so only the objects that register the clusters are cached.
+func NewSource(kind, namespace, labelSelector string,
+	client kubernetes.Interface, resyncPeriod time.Duration) (Source, informers.SharedInformerFactory, error) {
+	selector, err := labels.Parse(labelSelector)
+	if err != nil {
+		return nil, nil, fmt.Errorf("the cluster label selector %q is invalid, %v", labelSelector, err)
+	}
+	tweakListOptions := informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = selector.String()
+	})
+
+	switch kind {
+	case SourceNamespace:
+		informerFactory := informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod, tweakListOptions)
+		return NewNamespaceSource(informerFactory.Core().V1().Namespaces(), selector), informerFactory, nil
+	case SourceConfigMap:
+		if namespace == "" {
+			return nil, nil, fmt.Errorf("the cluster namespace is required for the %s cluster source", kind)
+		}
+		informerFactory := informers.NewSharedInformerFactoryWithOptions(
+			client, resyncPeriod, informers.WithNamespace(namespace), tweakListOptions)
+		return NewConfigMapSource(informerFactory.Core().V1().ConfigMaps(), namespace, selector), informerFactory, nil
+	default:
+		return nil, nil, fmt.Errorf("the cluster source %q is not supported", kind)
+	}
+}
@@ -0,0 +1,237 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+const testClusterLabel = "aggregation.open-cluster-management.io/cluster"
+
+func newTestSource(t *testing.T, kind string, objs ...metav1.Object) Source {
+	source, informerFactory, err := NewSource(kind, "clusters", testClusterLabel, kubefake.NewSimpleClientset(), 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, obj := range objs {
+		var err error
+		switch kind {
+		case SourceNamespace:
+			err = informerFactory.Core().V1().Namespaces().Informer().GetStore().Add(obj)
+		case SourceConfigMap:
+			err = informerFactory.Core().V1().ConfigMaps().Informer().GetStore().Add(obj)
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return source
+}
+
+func newTestMeta(namespace, name string, clusterLabels map[string]string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace:         namespace,
+		Name:              name,
+		Labels:            clusterLabels,
+		CreationTimestamp: metav1.Now(),
+	}
+}
+
+func TestSource(t *testing.T) {
+	registered := map[string]string{testClusterLabel: "", "env": "prod"}
+	terminating := metav1.Now()
+
+	cases := []struct {
+		name   string
+		source func(t *testing.T) Source
+	}{
+		{
+			name: "namespace",
+			source: func(t *testing.T) Source {
+				return newTestSource(t, SourceNamespace,
+					&corev1.Namespace{ObjectMeta: newTestMeta("", "cluster2", map[string]string{testClusterLabel: ""})},
+					&corev1.Namespace{ObjectMeta: newTestMeta("", "cluster1", registered)},
+					&corev1.Namespace{ObjectMeta: newTestMeta("", "unregistered", nil)},
+				)
+			},
+		},
+		{
+			name: "configmap",
+			source: func(t *testing.T) Source {
+				return newTestSource(t, SourceConfigMap,
+					&corev1.ConfigMap{ObjectMeta: newTestMeta("clusters", "cluster2", map[string]string{testClusterLabel: ""})},
+					&corev1.ConfigMap{ObjectMeta: newTestMeta("clusters", "cluster1", registered)},
+					&corev1.ConfigMap{ObjectMeta: newTestMeta("clusters", "unregistered", nil)},
+					&corev1.ConfigMap{ObjectMeta: newTestMeta("others", "cluster3", registered)},
+				)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			source := c.source(t)
+
+			clusters, err := source.List(labels.Everything())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(clusters) != 2 || clusters[0].Name != "cluster1" || clusters[1].Name != "cluster2" {
+				t.Errorf("expected cluster1 and cluster2, but %#v", clusters)
+			}
+
+			clusters, err = source.List(labels.SelectorFromSet(labels.Set{"env": "prod"}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(clusters) != 1 || clusters[0].Name != "cluster1" {
+				t.Errorf("expected cluster1, but %#v", clusters)
+			}
+
+			cluster, err := source.Get("cluster1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cluster.Labels["env"] != "prod" || cluster.CreationTimestamp.IsZero() {
+				t.Errorf("unexpected cluster: %#v", cluster)
+			}
+			if len(cluster.Status.Conditions) != 1 ||
+				cluster.Status.Conditions[0].Type != aggregationv1.ClusterAvailable ||
+				cluster.Status.Conditions[0].Status != corev1.ConditionTrue {
+				t.Errorf("expected available cluster, but %#v", cluster.Status)
+			}
+
+			for _, name := range []string{"unregistered", "unknown", "cluster3"} {
+				if _, err := source.Get(name); !errors.IsNotFound(err) {
+					t.Errorf("expected not found error for %s, but %v", name, err)
+				}
+			}
+		})
+	}
+
+	source := newTestSource(t, SourceNamespace, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:              "cluster1",
+		Labels:            registered,
+		DeletionTimestamp: &terminating,
+	}})
+	cluster, err := source.Get("cluster1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cluster.Status.Conditions[0].Status != corev1.ConditionFalse {
+		t.Errorf("expected unavailable terminating cluster, but %#v", cluster.Status)
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset()
+	if _, _, err := NewSource("unknown", "", testClusterLabel, kubeClient, 0); err == nil {
+		t.Errorf("expected unsupported source error, but failed")
+	}
+	if _, _, err := NewSource(SourceConfigMap, "", testClusterLabel, kubeClient, 0); err == nil {
+		t.Errorf("expected namespace required error, but failed")
+	}
+	if _, _, err := NewSource(SourceNamespace, "", "a in (", kubeClient, 0); err == nil {
+		t.Errorf("expected invalid selector error, but failed")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(
+		&corev1.ConfigMap{ObjectMeta: newTestMeta("clusters", "cluster1", map[string]string{testClusterLabel: ""})})
+	source, informerFactory, err := NewSource(SourceConfigMap, "clusters", testClusterLabel, kubeClient, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	informerFactory.Start(stopCh)
+	informerFactory.WaitForCacheSync(stopCh)
+
+	// only the labelled configmaps in the cluster namespace are listed and watched
+	for _, action := range kubeClient.Actions() {
+		var selector labels.Selector
+		switch action := action.(type) {
+		case clienttesting.ListAction:
+			selector = action.GetListRestrictions().Labels
+		case clienttesting.WatchAction:
+			selector = action.GetWatchRestrictions().Labels
+		}
+		if action.GetNamespace() != "clusters" || selector == nil || selector.String() != testClusterLabel {
+			t.Errorf("expected the configmaps are %s with the selector %s in namespace clusters, but %v in %q",
+				action.GetVerb(), testClusterLabel, selector, action.GetNamespace())
+		}
+	}
+
+	watcher, err := source.Watch()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer watcher.Stop()
+
+	expectEvent := func(eventType watch.EventType, name string) {
+		select {
+		case event := <-watcher.ResultChan():
+			cluster, ok := event.Object.(*aggregationv1.ClusterStatus)
+			if !ok || event.Type != eventType || cluster.Name != name {
+				t.Fatalf("expected %s %s, but %s %#v", eventType, name, event.Type, event.Object)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("expected %s %s, but timed out", eventType, name)
+		}
+	}
+	configMaps := kubeClient.CoreV1().ConfigMaps("clusters")
+
+	expectEvent(watch.Added, "cluster1")
+
+	// the unlabelled and the other namespace configmaps are not clusters
+	cluster2 := &corev1.ConfigMap{ObjectMeta: newTestMeta("clusters", "cluster2", nil)}
+	if _, err := configMaps.Create(cluster2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	others := &corev1.ConfigMap{ObjectMeta: newTestMeta("others", "cluster3", map[string]string{testClusterLabel: ""})}
+	if _, err := kubeClient.CoreV1().ConfigMaps("others").Create(others); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cluster2.Labels = map[string]string{testClusterLabel: ""}
+	if _, err := configMaps.Update(cluster2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectEvent(watch.Added, "cluster2")
+
+	cluster1 := &corev1.ConfigMap{
+		ObjectMeta: newTestMeta("clusters", "cluster1", map[string]string{testClusterLabel: "", "env": "prod"}),
+	}
+	if _, err := configMaps.Update(cluster1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectEvent(watch.Modified, "cluster1")
+
+	cluster1.Labels = nil
+	if _, err := configMaps.Update(cluster1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectEvent(watch.Deleted, "cluster1")
+
+	if err := configMaps.Delete("cluster2", &metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectEvent(watch.Deleted, "cluster2")
+
+	select {
+	case event := <-watcher.ResultChan():
+		t.Errorf("expected no more events, but %s %#v", event.Type, event.Object)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
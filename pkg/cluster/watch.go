@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"sync"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// watchQueueLength is the number of the changes that are queued for a watcher
+const watchQueueLength = 100
+
+// clusterBroadcaster broadcasts the changes of the registered clusters of a source to its watchers. Each watcher has
+// its own queue, a watcher that does not keep up is ended with an expired error rather than blocking the others and
+// the informer, so its client lists the clusters again.
+type clusterBroadcaster struct {
+	mutex    sync.Mutex
+	watchers map[*clusterWatcher]struct{}
+}
+
+// clusterWatcher is a watcher of the clusters, changes is closed when the watcher falls behind
+type clusterWatcher struct {
+	changes chan watch.Event
+}
+
+func newClusterBroadcaster() *clusterBroadcaster {
+	return &clusterBroadcaster{
+		watchers: map[*clusterWatcher]struct{}{},
+	}
+}
+
+// action queues a change to all watchers without blocking
+func (b *clusterBroadcaster) action(eventType watch.EventType, cluster *aggregationv1.ClusterStatus) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	event := watch.Event{Type: eventType, Object: cluster}
+	for watcher := range b.watchers {
+		select {
+		case watcher.changes <- event:
+		default:
+			klog.Warningf("Closing a cluster watcher that has %d pending changes", watchQueueLength)
+			delete(b.watchers, watcher)
+			close(watcher.changes)
+		}
+	}
+}
+
+func (b *clusterBroadcaster) remove(watcher *clusterWatcher) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.watchers, watcher)
+}
+
+// eventHandler returns the handler of the informer of a source, clusterFor returns the cluster of an object and
+// whether the object registers the cluster. An object that stops or starts matching the selector of the source
+// deletes or adds its cluster.
+func (b *clusterBroadcaster) eventHandler(
+	clusterFor func(obj interface{}) (*aggregationv1.ClusterStatus, bool)) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if cluster, ok := clusterFor(obj); ok {
+				b.action(watch.Added, cluster)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldCluster, oldRegistered := clusterFor(oldObj)
+			newCluster, newRegistered := clusterFor(newObj)
+			switch {
+			case oldRegistered && newRegistered:
+				b.action(watch.Modified, newCluster)
+			case newRegistered:
+				b.action(watch.Added, newCluster)
+			case oldRegistered:
+				b.action(watch.Deleted, oldCluster)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if cluster, ok := clusterFor(obj); ok {
+				b.action(watch.Deleted, cluster)
+			}
+		},
+	}
+}
+
+// watch returns the changes of the clusters, starting with the ADDED events of the current clusters. The watcher is
+// registered before the clusters are listed, so no change is missed between them, a change may be sent again after
+// its ADDED event.
+func (b *clusterBroadcaster) watch(list func() ([]*aggregationv1.ClusterStatus, error)) (watch.Interface, error) {
+	watcher := &clusterWatcher{changes: make(chan watch.Event, watchQueueLength)}
+	b.mutex.Lock()
+	b.watchers[watcher] = struct{}{}
+	b.mutex.Unlock()
+
+	clusters, err := list()
+	if err != nil {
+		b.remove(watcher)
+		return nil, err
+	}
+
+	result := make(chan watch.Event)
+	proxyWatcher := watch.NewProxyWatcher(result)
+	go func() {
+		defer close(result)
+		defer b.remove(watcher)
+
+		for _, cluster := range clusters {
+			select {
+			case result <- watch.Event{Type: watch.Added, Object: cluster}:
+			case <-proxyWatcher.StopChan():
+				return
+			}
+		}
+		for {
+			select {
+			case event, ok := <-watcher.changes:
+				if !ok {
+					// the watcher fell behind, the expired error makes the informers list the clusters again
+					expired := errors.NewResourceExpired("the watch of the clusters fell behind the changes").ErrStatus
+					event = watch.Event{Type: watch.Error, Object: &expired}
+				}
+				select {
+				case result <- event:
+				case <-proxyWatcher.StopChan():
+					return
+				}
+				if !ok {
+					return
+				}
+			case <-proxyWatcher.StopChan():
+				return
+			}
+		}
+	}()
+	return proxyWatcher, nil
+}
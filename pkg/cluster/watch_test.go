@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+func TestSlowWatcher(t *testing.T) {
+	broadcaster := newClusterBroadcaster()
+	list := func() ([]*aggregationv1.ClusterStatus, error) {
+		return []*aggregationv1.ClusterStatus{}, nil
+	}
+	slow, err := broadcaster.watch(list)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer slow.Stop()
+	fast, err := broadcaster.watch(list)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer fast.Stop()
+
+	// the slow watcher does not block the changes of the fast watcher
+	changes := watchQueueLength * 2
+	for i := 0; i < changes; i++ {
+		name := fmt.Sprintf("cluster%d", i)
+		broadcaster.action(watch.Added, &aggregationv1.ClusterStatus{ObjectMeta: metav1.ObjectMeta{Name: name}})
+		select {
+		case event := <-fast.ResultChan():
+			if cluster, ok := event.Object.(*aggregationv1.ClusterStatus); !ok || cluster.Name != name {
+				t.Fatalf("expected %s, but %#v", name, event.Object)
+			}
+		case <-time.After(wait.ForeverTestTimeout):
+			t.Fatalf("expected %s, but timed out", name)
+		}
+	}
+
+	// the slow watcher ends with an expired error after its queued changes
+	received := 0
+	for event := range slow.ResultChan() {
+		if event.Type != watch.Error {
+			received++
+			continue
+		}
+		status, ok := event.Object.(*metav1.Status)
+		if !ok || status.Reason != metav1.StatusReasonExpired {
+			t.Errorf("expected expired error, but %#v", event.Object)
+		}
+		if received >= changes {
+			t.Errorf("expected the slow watcher misses changes, but %d", received)
+		}
+		return
+	}
+	t.Errorf("expected expired error, but the watcher is closed")
+}
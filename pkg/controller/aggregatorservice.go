@@ -0,0 +1,617 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	proxyv1alpha1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/proxy/v1alpha1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/circuitbreaker"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+	"github.com/skeeey/aggregator-proxy-server/pkg/retry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// aggregatorServiceControllerName is the name of the workqueue and the metrics of the AggregatorServiceController
+const aggregatorServiceControllerName = "aggregatorServiceController"
+
+// AggregatorServiceController reconciles the AggregatorService resources into the aggregator service infos
+type AggregatorServiceController struct {
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter
+	client            kubernetes.Interface
+	dynamicClient     dynamic.Interface
+	lister            cache.GenericLister
+	secrets           secretGetter
+	synced            cache.InformerSynced
+	warmUp            warmUp
+	workqueue         workqueue.RateLimitingInterface
+	broadcaster       record.EventBroadcaster
+	recorder          record.EventRecorder
+	stopCh            <-chan struct{}
+}
+
+func NewAggregatorServiceController(
+	client kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	secretInformers *SecretInformers,
+	dynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory,
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter,
+	stopCh <-chan struct{}) *AggregatorServiceController {
+	aggregatorServiceInformer := dynamicInformerFactory.ForResource(proxyv1alpha1.AggregatorServiceResource)
+	broadcaster, recorder := newEventRecorder()
+
+	controller := &AggregatorServiceController{
+		serviceInfoGetter: serviceInfoGetter,
+		client:            client,
+		dynamicClient:     dynamicClient,
+		lister:            aggregatorServiceInformer.Lister(),
+		secrets:           secretInformers,
+		synced:            aggregatorServiceInformer.Informer().HasSynced,
+		workqueue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), aggregatorServiceControllerName),
+		broadcaster:       broadcaster,
+		recorder:          recorder,
+		stopCh:            stopCh,
+	}
+
+	aggregatorServiceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			controller.enqueue(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			controller.enqueue(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			controller.enqueue(obj)
+		},
+	})
+	utilruntime.Must(aggregatorServiceInformer.Informer().AddIndexers(cache.Indexers{
+		secretReferenceIndex: indexAggregatorServiceBySecret,
+	}))
+
+	secretInformers.AddReferences(aggregatorServiceInformer.Informer().GetIndexer(), controller.workqueue)
+
+	// the conflicting aggregator services are reported again when they are promoted or demoted
+	serviceInfoGetter.AddRegistrationHandler(controller.enqueueServiceInfo)
+
+	return controller
+}
+
+// indexAggregatorServiceBySecret indexes the aggregator services by the secrets that they reference
+func indexAggregatorServiceBySecret(obj interface{}) ([]string, error) {
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return []string{}, nil
+	}
+	aggregatorService := &proxyv1alpha1.AggregatorService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(
+		unstructuredObj.UnstructuredContent(), aggregatorService); err != nil {
+		return []string{}, nil
+	}
+
+	_, secretNamespace := namespacesOfAggregatorService(aggregatorService)
+	return []string{secretNamespace + "/" + aggregatorService.Spec.Secret.Name}, nil
+}
+
+// namespacesOfAggregatorService returns the namespaces of the service and the secret of an aggregator service,
+// the service is in the namespace of the aggregator service and the secret is in the namespace of the service by default
+func namespacesOfAggregatorService(aggregatorService *proxyv1alpha1.AggregatorService) (string, string) {
+	serviceNamespace := aggregatorService.Spec.Service.Namespace
+	if serviceNamespace == "" {
+		serviceNamespace = aggregatorService.Namespace
+	}
+	secretNamespace := aggregatorService.Spec.Secret.Namespace
+	if secretNamespace == "" {
+		secretNamespace = serviceNamespace
+	}
+	return serviceNamespace, secretNamespace
+}
+
+func (c *AggregatorServiceController) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.workqueue.Add(key)
+}
+
+// enqueueServiceInfo requeues the aggregator service of a service info, the service infos of the other sources
+// are ignored
+func (c *AggregatorServiceController) enqueueServiceInfo(serviceInfoName string) {
+	prefix := proxyv1alpha1.AggregatorServiceResource.Resource + "/"
+	if strings.HasPrefix(serviceInfoName, prefix) {
+		c.workqueue.Add(strings.TrimPrefix(serviceInfoName, prefix))
+	}
+}
+
+var _ = getter.ServiceInfoSource(&AggregatorServiceController{})
+
+// AggregatorServicesInstalled returns true if the AggregatorService resource is served, the informer of the resource
+// would never sync if its custom resource definition is not installed
+func AggregatorServicesInstalled(client discovery.DiscoveryInterface) (bool, error) {
+	resources, err := client.ServerResourcesForGroupVersion(proxyv1alpha1.SchemeGroupVersion.String())
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Name == proxyv1alpha1.AggregatorServiceResource.Resource {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// aggregatorServicesSourceName is the name of the readiness check of the AggregatorServiceController
+const aggregatorServicesSourceName = "aggregator-services"
+
+func (c *AggregatorServiceController) Name() string {
+	return aggregatorServicesSourceName
+}
+
+// HasSynced returns true if the informer caches have been synced and the cached aggregator services have been
+// synced once
+func (c *AggregatorServiceController) HasSynced() bool {
+	return c.warmUp.done()
+}
+
+// cachedKeys returns the keys of the cached aggregator services
+func (c *AggregatorServiceController) cachedKeys() []string {
+	keys := []string{}
+	objs, err := c.lister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return keys
+	}
+	for _, obj := range objs {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (c *AggregatorServiceController) Run() {
+	defer utilruntime.HandleCrash()
+	defer c.workqueue.ShutDown()
+
+	startRecording(c.broadcaster, c.client, c.stopCh)
+
+	klog.Info("Waiting for aggregator service informer caches to sync")
+	if !cache.WaitForCacheSync(c.stopCh, c.synced) {
+		klog.Errorf("failed to wait for aggregator service informer caches to sync")
+		return
+	}
+	c.warmUp.start(c.cachedKeys())
+
+	go wait.Until(c.runWorker, time.Second, c.stopCh)
+	<-c.stopCh
+	klog.Info("Shutting aggregator service controller")
+}
+
+func (c *AggregatorServiceController) runWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *AggregatorServiceController) processNextWorkItem() bool {
+	obj, shutdown := c.workqueue.Get()
+
+	if shutdown {
+		return false
+	}
+	// We wrap this block in a func so we can defer c.workqueue.Done.
+	err := func(obj interface{}) error {
+		defer c.workqueue.Done(obj)
+		var key string
+		var ok bool
+
+		if key, ok = obj.(string); !ok {
+			c.workqueue.Forget(obj)
+			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
+			return nil
+		}
+
+		startTime := time.Now()
+		err := c.syncHandler(key)
+		metrics.RecordControllerSync(aggregatorServiceControllerName, err, time.Since(startTime))
+		c.warmUp.synced(key)
+		if err != nil {
+			c.workqueue.AddRateLimited(key)
+			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
+		}
+
+		c.workqueue.Forget(obj)
+		klog.Infof("Successfully synced aggregator service '%s'", key)
+		return nil
+	}(obj)
+
+	if err != nil {
+		utilruntime.HandleError(err)
+		return true
+	}
+
+	return true
+}
+
+// aggregatorServiceInfoName returns the service info name of an aggregator service, it is prefixed with
+// the resource name to avoid conflicting with the service info from a configmap that has the same name
+func aggregatorServiceInfoName(namespace, name string) string {
+	return proxyv1alpha1.AggregatorServiceResource.Resource + "/" + namespace + "/" + name
+}
+
+func (c *AggregatorServiceController) syncHandler(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("invalid resource key: '%s'", key))
+		return nil
+	}
+
+	obj, err := c.lister.ByNamespace(namespace).Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			// aggregator service is deleted, delete aggregator config
+			c.serviceInfoGetter.RemoveAggregatorServiceInfo(aggregatorServiceInfoName(namespace, name))
+			return nil
+		}
+		return err
+	}
+
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected unstructured object but got %#v", obj))
+		return nil
+	}
+	aggregatorService := &proxyv1alpha1.AggregatorService{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(
+		unstructuredObj.UnstructuredContent(), aggregatorService); err != nil {
+		utilruntime.HandleError(fmt.Errorf("failed to convert aggregator service '%s': %v", key, err))
+		return nil
+	}
+
+	status := aggregatorService.Status.DeepCopy()
+	status.ObservedGeneration = aggregatorService.Generation
+	serviceInfo, syncErr := c.generateAggregatorServiceInfo(aggregatorService, status)
+	if serviceInfo != nil {
+		// the aggregator service is promoted when the older conflicting services are removed, so it is not resynced
+		err := c.serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+		c.reportConflict(aggregatorService, status, err)
+	} else {
+		c.serviceInfoGetter.RemoveAggregatorServiceInfo(aggregatorServiceInfoName(namespace, name))
+	}
+
+	if err := c.updateStatus(aggregatorService, status); err != nil {
+		return err
+	}
+	return syncErr
+}
+
+// reportConflict records the conflict of an aggregator service to the Valid condition of the status, and emits an
+// event when the conflict is changed
+func (c *AggregatorServiceController) reportConflict(aggregatorService *proxyv1alpha1.AggregatorService,
+	status *proxyv1alpha1.AggregatorServiceStatus, conflictErr error) {
+	var conflicting bool
+	var message string
+	if condition := findCondition(&aggregatorService.Status, proxyv1alpha1.AggregatorServiceValid); condition != nil {
+		conflicting = condition.Reason == SubResourceConflictReason
+		message = condition.Message
+	}
+
+	switch {
+	case conflictErr != nil:
+		setCondition(status, proxyv1alpha1.AggregatorServiceValid, corev1.ConditionFalse,
+			SubResourceConflictReason, conflictErr.Error())
+		if !conflicting || message != conflictErr.Error() {
+			c.recorder.Event(aggregatorService, corev1.EventTypeWarning, SubResourceConflictReason, conflictErr.Error())
+		}
+	case conflicting:
+		c.recorder.Eventf(aggregatorService, corev1.EventTypeNormal, SubResourceRegisteredReason,
+			"the subResource %s is registered", strings.Trim(aggregatorService.Spec.SubResource, "/"))
+	}
+}
+
+// generateAggregatorServiceInfo builds the service info of an aggregator service and records the result to
+// the conditions of the status, the returned error is not nil if the aggregator service should be resynced
+func (c *AggregatorServiceController) generateAggregatorServiceInfo(
+	aggregatorService *proxyv1alpha1.AggregatorService,
+	status *proxyv1alpha1.AggregatorServiceStatus) (*getter.AggregatorServiceInfo, error) {
+	spec := aggregatorService.Spec
+
+	idPlacement, err := validateAggregatorServiceSpec(&spec)
+	var identityForwarding string
+	if err == nil {
+		identityForwarding, err = validateIdentityForwarding(spec.IdentityForwarding)
+	}
+	var allowedMethods []string
+	if err == nil {
+		allowedMethods, err = validateAllowedMethods(spec.AllowedMethods)
+	}
+	var allowedPaths, deniedPaths []string
+	if err == nil {
+		allowedPaths, err = validatePathRules(spec.AllowedPaths)
+	}
+	if err == nil {
+		deniedPaths, err = validatePathRules(spec.DeniedPaths)
+	}
+	var circuitBreaker *circuitbreaker.Config
+	if err == nil {
+		circuitBreaker, err = validateCircuitBreaker(spec.CircuitBreaker)
+	}
+	var retryPolicy *retry.Policy
+	if err == nil {
+		retryPolicy, err = validateRetryPolicy(spec.RetryPolicy)
+	}
+	var healthCheck *health.Config
+	if err == nil {
+		healthCheck, err = validateHealthCheck(spec.HealthCheck)
+	}
+	if err != nil {
+		setCondition(status, proxyv1alpha1.AggregatorServiceValid, corev1.ConditionFalse, "InvalidSpec", err.Error())
+		setCondition(status, proxyv1alpha1.AggregatorServiceSecretResolved, corev1.ConditionUnknown, "InvalidSpec", "")
+		setCondition(status, proxyv1alpha1.AggregatorServiceBackendReachable, corev1.ConditionUnknown, "InvalidSpec", "")
+		// the spec has to be changed to fix it, so it is not resynced
+		return nil, nil
+	}
+	setCondition(status, proxyv1alpha1.AggregatorServiceValid, corev1.ConditionTrue, "Valid", "")
+
+	serviceNamespace, secretNamespace := namespacesOfAggregatorService(aggregatorService)
+
+	c.checkBackendReachable(serviceNamespace, spec.Service.Name, status)
+
+	secret, unavailableReason, err := getTLSSecret(c.secrets, secretNamespace, spec.Secret.Name)
+	if err != nil {
+		setCondition(status, proxyv1alpha1.AggregatorServiceSecretResolved, corev1.ConditionFalse, "SecretUnavailable",
+			fmt.Sprintf("failed to get secret %s/%s: %v", secretNamespace, spec.Secret.Name, err))
+		return nil, fmt.Errorf("failed to get secret in aggregator service %s/%s, %v",
+			aggregatorService.Namespace, aggregatorService.Name, err)
+	}
+	restConfig := &rest.Config{}
+	if secret != nil {
+		restConfig = restConfigForSecret(secret)
+		setCondition(status, proxyv1alpha1.AggregatorServiceSecretResolved, corev1.ConditionTrue, "SecretResolved", "")
+	} else {
+		// the service is kept as unavailable until the secret is fixed, the secret events requeue it
+		setCondition(status, proxyv1alpha1.AggregatorServiceSecretResolved, corev1.ConditionFalse, "InvalidSecret", unavailableReason)
+	}
+
+	return &getter.AggregatorServiceInfo{
+		Name:               aggregatorServiceInfoName(aggregatorService.Namespace, aggregatorService.Name),
+		SubResource:        strings.Trim(spec.SubResource, "/"),
+		CreationTimestamp:  aggregatorService.CreationTimestamp.Time,
+		ServiceName:        spec.Service.Name,
+		ServiceNamespace:   serviceNamespace,
+		ServicePort:        strconv.Itoa(int(spec.Service.Port)),
+		RootPath:           strings.Trim(spec.RootPath, "/"),
+		UseID:              spec.UseID,
+		IDPlacement:        idPlacement,
+		IdentityForwarding: identityForwarding,
+		AllowedMethods:     allowedMethods,
+		AllowedPaths:       allowedPaths,
+		DeniedPaths:        deniedPaths,
+		CircuitBreaker:     circuitBreaker,
+		RetryPolicy:        retryPolicy,
+		HealthCheck:        healthCheck,
+		RestConfig:         restConfig,
+		UnavailableReason:  unavailableReason,
+	}, nil
+}
+
+// validateAggregatorServiceSpec validates the fields that the schema of the custom resource definition cannot cover
+func validateAggregatorServiceSpec(spec *proxyv1alpha1.AggregatorServiceSpec) (string, error) {
+	if err := getter.ValidateSubResource(strings.Trim(spec.SubResource, "/")); err != nil {
+		return "", err
+	}
+	if spec.Service.Name == "" {
+		return "", fmt.Errorf("the service name is required")
+	}
+	if spec.Service.Port <= 0 || spec.Service.Port > 65535 {
+		return "", fmt.Errorf("the service port %d is invalid", spec.Service.Port)
+	}
+	if spec.Secret.Name == "" {
+		return "", fmt.Errorf("the secret name is required")
+	}
+	return validateIDPlacement(spec.IDPlacement)
+}
+
+// validateCircuitBreaker returns the circuit breaker config of an aggregator service, it is nil if the circuit
+// breaker is not set
+func validateCircuitBreaker(spec *proxyv1alpha1.CircuitBreakerSpec) (*circuitbreaker.Config, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	if spec.ErrorRateThreshold < 1 || spec.ErrorRateThreshold > 100 {
+		return nil, fmt.Errorf("the circuit breaker error rate threshold %d is not in [1, 100]", spec.ErrorRateThreshold)
+	}
+	if spec.MinimumRequests < 0 {
+		return nil, fmt.Errorf("the circuit breaker minimum requests %d is invalid", spec.MinimumRequests)
+	}
+
+	config := &circuitbreaker.Config{
+		ErrorRateThreshold: int(spec.ErrorRateThreshold),
+		MinimumRequests:    int(spec.MinimumRequests),
+	}
+	if spec.LatencyThreshold != nil {
+		if spec.LatencyThreshold.Duration < 0 {
+			return nil, fmt.Errorf("the circuit breaker latency threshold %s is invalid", spec.LatencyThreshold.Duration)
+		}
+		config.LatencyThreshold = spec.LatencyThreshold.Duration
+	}
+	if spec.OpenDuration != nil {
+		if spec.OpenDuration.Duration < 0 {
+			return nil, fmt.Errorf("the circuit breaker open duration %s is invalid", spec.OpenDuration.Duration)
+		}
+		config.OpenDuration = spec.OpenDuration.Duration
+	}
+	return config, nil
+}
+
+// validateRetryPolicy returns the retry policy of an aggregator service, it is nil if the retry policy is not set
+func validateRetryPolicy(spec *proxyv1alpha1.RetryPolicySpec) (*retry.Policy, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	if spec.MaxAttempts < 0 || spec.MaxAttempts > 10 {
+		return nil, fmt.Errorf("the retry max attempts %d is not in [0, 10], 0 means the default", spec.MaxAttempts)
+	}
+
+	policy := &retry.Policy{
+		MaxAttempts:             int(spec.MaxAttempts),
+		RetryOnConnectionErrors: spec.RetryOnConnectionErrors,
+	}
+	for _, code := range spec.RetryOnStatusCodes {
+		if code < 400 || code > 599 {
+			return nil, fmt.Errorf("the retry status code %d is not an error code", code)
+		}
+		policy.RetryOnStatusCodes = append(policy.RetryOnStatusCodes, int(code))
+	}
+	if spec.Backoff != nil {
+		if spec.Backoff.Duration < 0 {
+			return nil, fmt.Errorf("the retry backoff %s is invalid", spec.Backoff.Duration)
+		}
+		policy.Backoff = spec.Backoff.Duration
+	}
+	if spec.MaxBackoff != nil {
+		if spec.MaxBackoff.Duration < 0 {
+			return nil, fmt.Errorf("the retry max backoff %s is invalid", spec.MaxBackoff.Duration)
+		}
+		policy.MaxBackoff = spec.MaxBackoff.Duration
+	}
+	return policy, nil
+}
+
+// validateHealthCheck returns the health check config of an aggregator service, it is nil if the health check is
+// not set
+func validateHealthCheck(spec *proxyv1alpha1.HealthCheckSpec) (*health.Config, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(spec.Path, "/") {
+		return nil, fmt.Errorf("the health check path %q is not an absolute path", spec.Path)
+	}
+	if spec.SuccessThreshold < 0 {
+		return nil, fmt.Errorf("the health check success threshold %d is invalid", spec.SuccessThreshold)
+	}
+	if spec.FailureThreshold < 0 {
+		return nil, fmt.Errorf("the health check failure threshold %d is invalid", spec.FailureThreshold)
+	}
+
+	config := &health.Config{
+		Path:             spec.Path,
+		SuccessThreshold: int(spec.SuccessThreshold),
+		FailureThreshold: int(spec.FailureThreshold),
+	}
+	if spec.Period != nil {
+		if spec.Period.Duration < 0 {
+			return nil, fmt.Errorf("the health check period %s is invalid", spec.Period.Duration)
+		}
+		config.Period = spec.Period.Duration
+	}
+	if spec.Timeout != nil {
+		if spec.Timeout.Duration < 0 {
+			return nil, fmt.Errorf("the health check timeout %s is invalid", spec.Timeout.Duration)
+		}
+		config.Timeout = spec.Timeout.Duration
+	}
+	return config, nil
+}
+
+// checkBackendReachable records whether the backend service has ready endpoints
+func (c *AggregatorServiceController) checkBackendReachable(
+	namespace, name string, status *proxyv1alpha1.AggregatorServiceStatus) {
+	endpoints, err := c.client.CoreV1().Endpoints(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		setCondition(status, proxyv1alpha1.AggregatorServiceBackendReachable, corev1.ConditionFalse, "EndpointsNotFound",
+			fmt.Sprintf("failed to get endpoints of service %s/%s: %v", namespace, name, err))
+		return
+	}
+
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			setCondition(status, proxyv1alpha1.AggregatorServiceBackendReachable, corev1.ConditionTrue, "EndpointsReady", "")
+			return
+		}
+	}
+	setCondition(status, proxyv1alpha1.AggregatorServiceBackendReachable, corev1.ConditionFalse, "NoReadyEndpoints",
+		fmt.Sprintf("the service %s/%s has no ready endpoints", namespace, name))
+}
+
+// findCondition returns the condition of a type in the status, it is nil if the status has no such condition
+func findCondition(status *proxyv1alpha1.AggregatorServiceStatus,
+	conditionType proxyv1alpha1.AggregatorServiceConditionType) *proxyv1alpha1.AggregatorServiceCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition sets a condition in the status, the transition time is only changed when the status is changed
+func setCondition(status *proxyv1alpha1.AggregatorServiceStatus,
+	conditionType proxyv1alpha1.AggregatorServiceConditionType, conditionStatus corev1.ConditionStatus, reason, message string) {
+	newCondition := proxyv1alpha1.AggregatorServiceCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+
+	for i := range status.Conditions {
+		if status.Conditions[i].Type != conditionType {
+			continue
+		}
+		if status.Conditions[i].Status == conditionStatus {
+			newCondition.LastTransitionTime = status.Conditions[i].LastTransitionTime
+		}
+		status.Conditions[i] = newCondition
+		return
+	}
+	status.Conditions = append(status.Conditions, newCondition)
+}
+
+func (c *AggregatorServiceController) updateStatus(
+	aggregatorService *proxyv1alpha1.AggregatorService, status *proxyv1alpha1.AggregatorServiceStatus) error {
+	if equality.Semantic.DeepEqual(&aggregatorService.Status, status) {
+		return nil
+	}
+
+	updated := aggregatorService.DeepCopy()
+	updated.Status = *status
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(updated)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.dynamicClient.Resource(proxyv1alpha1.AggregatorServiceResource).Namespace(updated.Namespace).UpdateStatus(
+		&unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update status of aggregator service %s/%s, %v", updated.Namespace, updated.Name, err)
+	}
+	return nil
+}
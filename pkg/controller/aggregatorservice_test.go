@@ -0,0 +1,420 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	proxyv1alpha1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/proxy/v1alpha1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/circuitbreaker"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"github.com/skeeey/aggregator-proxy-server/pkg/retry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+func newAggregatorService(spec proxyv1alpha1.AggregatorServiceSpec) *unstructured.Unstructured {
+	aggregatorService := &proxyv1alpha1.AggregatorService{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: proxyv1alpha1.SchemeGroupVersion.String(),
+			Kind:       "AggregatorService",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "default",
+			Name:              "test",
+			Generation:        2,
+			CreationTimestamp: metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		},
+		Spec: spec,
+	}
+	content, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(aggregatorService)
+	return &unstructured.Unstructured{Object: content}
+}
+
+func newTLSSecret(namespace, name string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Data: map[string][]byte{
+			"tls.crt": []byte("cert"),
+			"tls.key": []byte("key"),
+			"ca.crt":  []byte("ca"),
+		},
+	}
+}
+
+func newReadyEndpoints(namespace, name string) *corev1.Endpoints {
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Subsets: []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}}},
+		},
+	}
+}
+
+func conditionStatus(status *proxyv1alpha1.AggregatorServiceStatus,
+	conditionType proxyv1alpha1.AggregatorServiceConditionType) corev1.ConditionStatus {
+	for _, condition := range status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status
+		}
+	}
+	return ""
+}
+
+func TestAggregatorServiceSync(t *testing.T) {
+	validSpec := proxyv1alpha1.AggregatorServiceSpec{
+		SubResource: "/sub/",
+		Service:     proxyv1alpha1.ServiceReference{Name: "backend", Port: 8443},
+		RootPath:    "/api",
+		Secret:      proxyv1alpha1.SecretReference{Name: "backend-tls"},
+	}
+	invalidSpec := validSpec
+	invalidSpec.IDPlacement = "body"
+
+	cases := []struct {
+		name              string
+		spec              proxyv1alpha1.AggregatorServiceSpec
+		kubeObjects       []runtime.Object
+		registered        *getter.AggregatorServiceInfo
+		expectedError     bool
+		expectedRegistry  bool
+		expectedAvailable bool
+		expectedValid     corev1.ConditionStatus
+		expectedSecret    corev1.ConditionStatus
+		expectedReachable corev1.ConditionStatus
+	}{
+		{
+			name:              "valid",
+			spec:              validSpec,
+			kubeObjects:       []runtime.Object{newTLSSecret("default", "backend-tls"), newReadyEndpoints("default", "backend")},
+			expectedRegistry:  true,
+			expectedAvailable: true,
+			expectedValid:     corev1.ConditionTrue,
+			expectedSecret:    corev1.ConditionTrue,
+			expectedReachable: corev1.ConditionTrue,
+		},
+		{
+			name:              "invalid spec",
+			spec:              invalidSpec,
+			kubeObjects:       []runtime.Object{newTLSSecret("default", "backend-tls")},
+			expectedValid:     corev1.ConditionFalse,
+			expectedSecret:    corev1.ConditionUnknown,
+			expectedReachable: corev1.ConditionUnknown,
+		},
+		{
+			name:              "secret not found",
+			spec:              validSpec,
+			kubeObjects:       []runtime.Object{newReadyEndpoints("default", "backend")},
+			expectedRegistry:  true,
+			expectedValid:     corev1.ConditionTrue,
+			expectedSecret:    corev1.ConditionFalse,
+			expectedReachable: corev1.ConditionTrue,
+		},
+		{
+			name:              "backend unreachable",
+			spec:              validSpec,
+			kubeObjects:       []runtime.Object{newTLSSecret("default", "backend-tls")},
+			expectedRegistry:  true,
+			expectedAvailable: true,
+			expectedValid:     corev1.ConditionTrue,
+			expectedSecret:    corev1.ConditionTrue,
+			expectedReachable: corev1.ConditionFalse,
+		},
+		{
+			name:              "sub-resource conflict",
+			spec:              validSpec,
+			kubeObjects:       []runtime.Object{newTLSSecret("default", "backend-tls"), newReadyEndpoints("default", "backend")},
+			registered:        &getter.AggregatorServiceInfo{Name: "default/other", SubResource: "sub"},
+			expectedValid:     corev1.ConditionFalse,
+			expectedSecret:    corev1.ConditionTrue,
+			expectedReachable: corev1.ConditionTrue,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			obj := newAggregatorService(c.spec)
+			kubeClient := kubefake.NewSimpleClientset(c.kubeObjects...)
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), obj)
+			informerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+			serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+			if c.registered != nil {
+				if err := serviceInfoGetter.AddAggregatorServiceInfo(c.registered); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			ctrl := NewAggregatorServiceController(
+				kubeClient, dynamicClient, newTestSecretInformers(kubeClient, "default"), informerFactory, serviceInfoGetter, nil)
+			ctrl.recorder = record.NewFakeRecorder(10)
+			if err := informerFactory.ForResource(proxyv1alpha1.AggregatorServiceResource).Informer().GetStore().Add(obj); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err := ctrl.syncHandler("default/test")
+			if c.expectedError && err == nil {
+				t.Errorf("expected error, but failed")
+			}
+			if !c.expectedError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+
+			serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("sub")
+			if serviceInfo == c.registered {
+				serviceInfo = nil
+			}
+			if c.expectedRegistry != (serviceInfo != nil) {
+				t.Errorf("expected registered %t, but %#v", c.expectedRegistry, serviceInfo)
+			}
+			if serviceInfo != nil {
+				if serviceInfo.ServicePort != "8443" || serviceInfo.RootPath != "api" ||
+					serviceInfo.IDPlacement != getter.IDPlacementPath {
+					t.Errorf("unexpected service info: %#v", serviceInfo)
+				}
+				if c.expectedAvailable != (serviceInfo.UnavailableReason == "") {
+					t.Errorf("expected available %t, but %q", c.expectedAvailable, serviceInfo.UnavailableReason)
+				}
+			}
+
+			updated, err := dynamicClient.Resource(proxyv1alpha1.AggregatorServiceResource).Namespace("default").Get("test", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			aggregatorService := &proxyv1alpha1.AggregatorService{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(updated.UnstructuredContent(), aggregatorService); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			status := &aggregatorService.Status
+			if status.ObservedGeneration != 2 {
+				t.Errorf("expected observed generation 2, but %d", status.ObservedGeneration)
+			}
+			if actual := conditionStatus(status, proxyv1alpha1.AggregatorServiceValid); actual != c.expectedValid {
+				t.Errorf("expected Valid %s, but %s", c.expectedValid, actual)
+			}
+			if actual := conditionStatus(status, proxyv1alpha1.AggregatorServiceSecretResolved); actual != c.expectedSecret {
+				t.Errorf("expected SecretResolved %s, but %s", c.expectedSecret, actual)
+			}
+			if actual := conditionStatus(status, proxyv1alpha1.AggregatorServiceBackendReachable); actual != c.expectedReachable {
+				t.Errorf("expected BackendReachable %s, but %s", c.expectedReachable, actual)
+			}
+		})
+	}
+}
+
+func TestValidateCircuitBreaker(t *testing.T) {
+	cases := []struct {
+		name          string
+		spec          *proxyv1alpha1.CircuitBreakerSpec
+		expected      *circuitbreaker.Config
+		expectedError bool
+	}{
+		{
+			name:     "no circuit breaker",
+			expected: nil,
+		},
+		{
+			name: "thresholds",
+			spec: &proxyv1alpha1.CircuitBreakerSpec{
+				ErrorRateThreshold: 50,
+				LatencyThreshold:   &metav1.Duration{Duration: 5 * time.Second},
+				MinimumRequests:    10,
+			},
+			expected: &circuitbreaker.Config{ErrorRateThreshold: 50, LatencyThreshold: 5 * time.Second, MinimumRequests: 10},
+		},
+		{
+			name:          "invalid error rate threshold",
+			spec:          &proxyv1alpha1.CircuitBreakerSpec{ErrorRateThreshold: 101},
+			expectedError: true,
+		},
+		{
+			name: "invalid open duration",
+			spec: &proxyv1alpha1.CircuitBreakerSpec{
+				ErrorRateThreshold: 50,
+				OpenDuration:       &metav1.Duration{Duration: -time.Second},
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := validateCircuitBreaker(c.spec)
+			if c.expectedError != (err != nil) {
+				t.Fatalf("expected error %v, but %v", c.expectedError, err)
+			}
+			if !reflect.DeepEqual(config, c.expected) {
+				t.Errorf("expected config %#v, but %#v", c.expected, config)
+			}
+		})
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	cases := []struct {
+		name          string
+		spec          *proxyv1alpha1.RetryPolicySpec
+		expected      *retry.Policy
+		expectedError bool
+	}{
+		{
+			name:     "no retry policy",
+			expected: nil,
+		},
+		{
+			name: "retry policy",
+			spec: &proxyv1alpha1.RetryPolicySpec{
+				MaxAttempts:             2,
+				RetryOnConnectionErrors: true,
+				RetryOnStatusCodes:      []int32{502, 503},
+				Backoff:                 &metav1.Duration{Duration: time.Second},
+			},
+			expected: &retry.Policy{
+				MaxAttempts:             2,
+				RetryOnConnectionErrors: true,
+				RetryOnStatusCodes:      []int{502, 503},
+				Backoff:                 time.Second,
+			},
+		},
+		{
+			name:     "default attempts",
+			spec:     &proxyv1alpha1.RetryPolicySpec{RetryOnConnectionErrors: true},
+			expected: &retry.Policy{RetryOnConnectionErrors: true},
+		},
+		{
+			name:          "negative attempts",
+			spec:          &proxyv1alpha1.RetryPolicySpec{MaxAttempts: -1},
+			expectedError: true,
+		},
+		{
+			name:          "too many attempts",
+			spec:          &proxyv1alpha1.RetryPolicySpec{MaxAttempts: 11},
+			expectedError: true,
+		},
+		{
+			name:          "invalid status code",
+			spec:          &proxyv1alpha1.RetryPolicySpec{RetryOnStatusCodes: []int32{200}},
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			policy, err := validateRetryPolicy(c.spec)
+			if c.expectedError != (err != nil) {
+				t.Fatalf("expected error %v, but %v", c.expectedError, err)
+			}
+			if !reflect.DeepEqual(policy, c.expected) {
+				t.Errorf("expected policy %#v, but %#v", c.expected, policy)
+			}
+		})
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	cases := []struct {
+		name          string
+		spec          *proxyv1alpha1.HealthCheckSpec
+		expected      *health.Config
+		expectedError bool
+	}{
+		{
+			name:     "no health check",
+			expected: nil,
+		},
+		{
+			name: "health check",
+			spec: &proxyv1alpha1.HealthCheckSpec{
+				Path:             "/healthz",
+				Period:           &metav1.Duration{Duration: 30 * time.Second},
+				FailureThreshold: 5,
+			},
+			expected: &health.Config{Path: "/healthz", Period: 30 * time.Second, FailureThreshold: 5},
+		},
+		{
+			name:          "relative path",
+			spec:          &proxyv1alpha1.HealthCheckSpec{Path: "healthz"},
+			expectedError: true,
+		},
+		{
+			name: "invalid timeout",
+			spec: &proxyv1alpha1.HealthCheckSpec{
+				Path:    "/healthz",
+				Timeout: &metav1.Duration{Duration: -time.Second},
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config, err := validateHealthCheck(c.spec)
+			if c.expectedError != (err != nil) {
+				t.Fatalf("expected error %v, but %v", c.expectedError, err)
+			}
+			if !reflect.DeepEqual(config, c.expected) {
+				t.Errorf("expected config %#v, but %#v", c.expected, config)
+			}
+		})
+	}
+}
+
+func TestAggregatorServicesInstalled(t *testing.T) {
+	cases := []struct {
+		name      string
+		resources []metav1.APIResource
+		expected  bool
+	}{
+		{
+			name:     "not installed",
+			expected: false,
+		},
+		{
+			name:      "installed",
+			resources: []metav1.APIResource{{Name: "aggregatorservices", Namespaced: true, Kind: "AggregatorService"}},
+			expected:  true,
+		},
+		{
+			name:      "other resources",
+			resources: []metav1.APIResource{{Name: "others", Namespaced: true, Kind: "Other"}},
+			expected:  false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if c.resources == nil || req.URL.Path != "/apis/"+proxyv1alpha1.SchemeGroupVersion.String() {
+					http.NotFound(w, req)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(&metav1.APIResourceList{
+					TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+					GroupVersion: proxyv1alpha1.SchemeGroupVersion.String(),
+					APIResources: c.resources,
+				})
+			}))
+			defer server.Close()
+
+			client := discovery.NewDiscoveryClientForConfigOrDie(&rest.Config{Host: server.URL})
+			installed, err := AggregatorServicesInstalled(client)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if installed != c.expected {
+				t.Errorf("expected installed %v, but %v", c.expected, installed)
+			}
+		})
+	}
+}
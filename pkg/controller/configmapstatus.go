@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConfigMapStatusAnnotation is set on an aggregator configmap with the json of its ConfigMapStatus
+const ConfigMapStatusAnnotation = "aggregation.open-cluster-management.io/status"
+
+// The results of syncing an aggregator configmap
+const (
+	// ConfigMapSynced means the configmap is served
+	ConfigMapSynced = "Synced"
+	// ConfigMapUnavailable means the configmap is registered, but the requests are rejected until its client
+	// certificate secret is fixed
+	ConfigMapUnavailable = "Unavailable"
+	// ConfigMapInvalid means the configmap is not served until it is fixed
+	ConfigMapInvalid = "Invalid"
+	// ConfigMapConflict means the configmap is not served because an older aggregator service claims its sub-resource
+	ConfigMapConflict = "Conflict"
+)
+
+// ConfigMapStatus is the last sync result of an aggregator configmap
+type ConfigMapStatus struct {
+	Result  string `json:"result"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Backend is the address of the service that the requests are proxied to, e.g. backend.default.svc:443
+	Backend string `json:"backend,omitempty"`
+	// ObservedDataHash is the hash of the data of the configmap that is synced, a configmap has no generation
+	ObservedDataHash   string      `json:"observedDataHash"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+}
+
+// newConfigMapStatus returns the status of an aggregator configmap that is synced to a service info, the service
+// info is nil if the configmap is invalid
+func newConfigMapStatus(cm *corev1.ConfigMap, serviceInfo *getter.AggregatorServiceInfo, syncErr error) *ConfigMapStatus {
+	status := &ConfigMapStatus{ObservedDataHash: configMapDataHash(cm)}
+	if serviceInfo != nil {
+		status.Backend = serviceInfo.Host()
+	}
+
+	switch {
+	case serviceInfo == nil:
+		status.Result, status.Reason = ConfigMapInvalid, InvalidConfigReason
+		status.Message = syncErr.Error()
+	case syncErr != nil:
+		status.Result, status.Reason = ConfigMapConflict, SubResourceConflictReason
+		status.Message = syncErr.Error()
+	case serviceInfo.UnavailableReason != "":
+		status.Result, status.Reason = ConfigMapUnavailable, SecretUnavailableReason
+		status.Message = serviceInfo.UnavailableReason
+	default:
+		status.Result, status.Reason = ConfigMapSynced, SyncedReason
+		status.Message = fmt.Sprintf("the subResource %s is registered", serviceInfo.SubResource)
+	}
+	return status
+}
+
+// configMapDataHash returns the hash of the data of a configmap, the keys are sorted when the data is marshalled
+func configMapDataHash(cm *corev1.ConfigMap) string {
+	data, _ := json.Marshal(cm.Data)
+	hash := fnv.New64a()
+	_, _ = hash.Write(data)
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+// configMapStatusOf returns the status of an aggregator configmap, it is nil if the configmap has no valid status
+func configMapStatusOf(cm *corev1.ConfigMap) *ConfigMapStatus {
+	data, ok := cm.Annotations[ConfigMapStatusAnnotation]
+	if !ok {
+		return nil
+	}
+	status := &ConfigMapStatus{}
+	if err := json.Unmarshal([]byte(data), status); err != nil {
+		return nil
+	}
+	return status
+}
+
+// updateConfigMapStatus writes the status annotation of an aggregator configmap, and emits an event when the result
+// is changed. The configmap is not updated if the status is not changed, so the update does not trigger another sync,
+// the update only changes the annotations, so the hash of the data is not changed by it.
+func (c *AggregatorServiceInfoController) updateConfigMapStatus(cm *corev1.ConfigMap, status *ConfigMapStatus) error {
+	old := configMapStatusOf(cm)
+	if old != nil && old.Result == status.Result && old.Reason == status.Reason && old.Message == status.Message {
+		if old.Backend == status.Backend && old.ObservedDataHash == status.ObservedDataHash {
+			return nil
+		}
+		status.LastTransitionTime = old.LastTransitionTime
+	} else {
+		status.LastTransitionTime = metav1.Now()
+		c.recordConfigMapEvent(cm, old, status)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	cm = cm.DeepCopy()
+	if cm.Annotations == nil {
+		cm.Annotations = map[string]string{}
+	}
+	cm.Annotations[ConfigMapStatusAnnotation] = string(data)
+	if status.Result == ConfigMapConflict {
+		cm.Annotations[SubResourceConflictAnnotation] = status.Message
+	} else {
+		delete(cm.Annotations, SubResourceConflictAnnotation)
+	}
+
+	_, err = c.client.CoreV1().ConfigMaps(cm.Namespace).Update(cm)
+	return err
+}
+
+// recordConfigMapEvent emits a Normal event when an aggregator configmap is served, otherwise a Warning event
+func (c *AggregatorServiceInfoController) recordConfigMapEvent(cm *corev1.ConfigMap, old, status *ConfigMapStatus) {
+	if status.Result != ConfigMapSynced {
+		c.recorder.Event(cm, corev1.EventTypeWarning, status.Reason, status.Message)
+		return
+	}
+
+	reason := status.Reason
+	if old != nil && old.Result == ConfigMapConflict {
+		reason = SubResourceRegisteredReason
+	}
+	c.recorder.Event(cm, corev1.EventTypeNormal, reason, status.Message)
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"fmt"
+	"path"
 	"strings"
 	"time"
 
@@ -9,105 +10,209 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 
+	proxyv1alpha1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/proxy/v1alpha1"
 	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
-	"github.com/skeeey/aggregator-proxy-server/pkg/utils"
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
+// aggregatorServiceInfoControllerName is the name of the workqueue and the metrics of the AggregatorServiceInfoController
+const aggregatorServiceInfoControllerName = "aggregatorServiceInfoController"
+
 type AggregatorServiceInfoController struct {
 	serviceInfoGetter *getter.AggregatorServiceInfoGetter
 	client            kubernetes.Interface
-	informerFactory   informers.SharedInformerFactory
-	lister            v1.ConfigMapLister
-	synced            cache.InformerSynced
+	listers           []v1.ConfigMapLister
+	selector          labels.Selector
+	secrets           secretGetter
+	synced            []cache.InformerSynced
+	warmUp            warmUp
 	workqueue         workqueue.RateLimitingInterface
+	broadcaster       record.EventBroadcaster
+	recorder          record.EventRecorder
 	stopCh            <-chan struct{}
 }
 
+// DefaultAggregatorConfigMapLabelSelector selects the aggregator configmaps by default
+const DefaultAggregatorConfigMapLabelSelector = "config=mcm-aggregator"
+
+// NewConfigMapInformerFactories returns the informer factories of the aggregator configmaps, one for each namespace
+// or one for all namespaces if no namespace is given. The selector is pushed into the list options, so only the
+// matching configmaps are cached.
+func NewConfigMapInformerFactories(
+	client kubernetes.Interface,
+	resyncPeriod time.Duration,
+	namespaces []string,
+	selector labels.Selector) []informers.SharedInformerFactory {
+	tweakListOptions := informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.LabelSelector = selector.String()
+	})
+	if len(namespaces) == 0 {
+		return []informers.SharedInformerFactory{
+			informers.NewSharedInformerFactoryWithOptions(client, resyncPeriod, tweakListOptions),
+		}
+	}
+
+	factories := []informers.SharedInformerFactory{}
+	for _, namespace := range sets.NewString(namespaces...).List() {
+		factories = append(factories, informers.NewSharedInformerFactoryWithOptions(
+			client, resyncPeriod, informers.WithNamespace(namespace), tweakListOptions))
+	}
+	return factories
+}
+
 func NewAggregatorServiceInfoController(
 	client kubernetes.Interface,
-	informerFactory informers.SharedInformerFactory,
+	secretInformers *SecretInformers,
+	configMapInformerFactories []informers.SharedInformerFactory,
+	selector labels.Selector,
 	serviceInfoGetter *getter.AggregatorServiceInfoGetter,
 	stopCh <-chan struct{}) *AggregatorServiceInfoController {
-	configMapInformer := informerFactory.Core().V1().ConfigMaps()
+	broadcaster, recorder := newEventRecorder()
 
 	controller := &AggregatorServiceInfoController{
 		serviceInfoGetter: serviceInfoGetter,
 		client:            client,
-		informerFactory:   informerFactory,
-		lister:            configMapInformer.Lister(),
-		synced:            configMapInformer.Informer().HasSynced,
-		workqueue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "aggregatorServiceInfoController"),
+		selector:          selector,
+		secrets:           secretInformers,
+		workqueue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), aggregatorServiceInfoControllerName),
+		broadcaster:       broadcaster,
+		recorder:          recorder,
 		stopCh:            stopCh,
 	}
 
-	configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc: func(obj interface{}) {
-			controller.enqueue(obj)
-		},
-		UpdateFunc: func(oldObj, newObj interface{}) {
-			controller.enqueue(newObj)
-		},
-		DeleteFunc: controller.deleteObj,
-	})
+	for _, configMapInformerFactory := range configMapInformerFactories {
+		configMapInformer := configMapInformerFactory.Core().V1().ConfigMaps()
+		controller.listers = append(controller.listers, configMapInformer.Lister())
+		controller.synced = append(controller.synced, configMapInformer.Informer().HasSynced)
+
+		configMapInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				controller.enqueue(obj)
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				controller.enqueue(newObj)
+			},
+			DeleteFunc: controller.deleteObj,
+		})
+		utilruntime.Must(configMapInformer.Informer().AddIndexers(cache.Indexers{
+			secretReferenceIndex: controller.indexConfigMapBySecret,
+		}))
+
+		secretInformers.AddReferences(configMapInformer.Informer().GetIndexer(), controller.workqueue)
+	}
+
+	// the conflicting configmaps are reported again when they are promoted or demoted
+	serviceInfoGetter.AddRegistrationHandler(controller.enqueueServiceInfo)
 
 	return controller
 }
 
-var aggregatorConfigMapLabels = map[string]string{
-	"config": "mcm-aggregator",
+// indexConfigMapBySecret indexes the aggregator configmaps by the secrets that they reference
+func (c *AggregatorServiceInfoController) indexConfigMapBySecret(obj interface{}) ([]string, error) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return []string{}, nil
+	}
+	if !c.selector.Matches(labels.Set(cm.GetLabels())) {
+		return []string{}, nil
+	}
+
+	secretNamespace, secretName, err := secretOfConfigMap(cm)
+	if err != nil {
+		// the configmap will be reported when it is synced
+		return []string{}, nil
+	}
+	return []string{secretNamespace + "/" + secretName}, nil
 }
 
+// enqueue adds the key of an aggregator configmap to the workqueue, the selector is checked again in case the
+// informer returns the objects that do not match the list options
 func (c *AggregatorServiceInfoController) enqueue(obj interface{}) {
-	var key string
-	var err error
-	labelSelector := &metav1.LabelSelector{
-		MatchLabels: aggregatorConfigMapLabels,
-	}
-	aggregatorConfigmap := obj.(*corev1.ConfigMap)
-	if utils.MatchLabelForLabelSelector(aggregatorConfigmap.GetLabels(), labelSelector) {
-		if key, err = cache.MetaNamespaceKeyFunc(obj); err != nil {
-			utilruntime.HandleError(err)
-			return
-		}
-		c.workqueue.Add(key)
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("expected configmap but got %#v", obj))
+		return
+	}
+	if !c.selector.Matches(labels.Set(cm.GetLabels())) {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(cm)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.workqueue.Add(key)
+}
+
+func (c *AggregatorServiceInfoController) enqueueServiceInfo(serviceInfoName string) {
+	if namespace, _, err := cache.SplitMetaNamespaceKey(serviceInfoName); err != nil || namespace == "" {
+		return
 	}
+	c.workqueue.Add(serviceInfoName)
 }
 
 func (c *AggregatorServiceInfoController) deleteObj(obj interface{}) {
-	var ok bool
-	if _, ok = obj.(metav1.Object); !ok {
-		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
-		if !ok {
-			utilruntime.HandleError(fmt.Errorf("error decoding object, invalid type"))
-			return
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	c.enqueue(obj)
+}
+
+var _ = getter.ServiceInfoSource(&AggregatorServiceInfoController{})
+
+// aggregatorConfigMapsSourceName is the name of the readiness check of the AggregatorServiceInfoController
+const aggregatorConfigMapsSourceName = "aggregator-configmaps"
+
+func (c *AggregatorServiceInfoController) Name() string {
+	return aggregatorConfigMapsSourceName
+}
+
+// HasSynced returns true if the informer caches have been synced and the cached configmaps have been synced once
+func (c *AggregatorServiceInfoController) HasSynced() bool {
+	return c.warmUp.done()
+}
+
+// cachedKeys returns the keys of the cached aggregator configmaps
+func (c *AggregatorServiceInfoController) cachedKeys() []string {
+	keys := []string{}
+	for _, lister := range c.listers {
+		cms, err := lister.List(c.selector)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
 		}
-		_, ok = tombstone.Obj.(metav1.Object)
-		if !ok {
-			utilruntime.HandleError(fmt.Errorf("error decoding object tombstone, invalid type"))
-			return
+		for _, cm := range cms {
+			keys = append(keys, cm.Namespace+"/"+cm.Name)
 		}
 	}
-	c.enqueue(obj)
+	return keys
 }
 
 func (c *AggregatorServiceInfoController) Run() {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
 
+	startRecording(c.broadcaster, c.client, c.stopCh)
+
 	klog.Info("Waiting for aggregator service configmap informer caches to sync")
-	if !cache.WaitForCacheSync(c.stopCh, c.synced) {
+	if !cache.WaitForCacheSync(c.stopCh, c.synced...) {
 		klog.Errorf("failed to wait for aggregator service configmap informer caches to sync")
 		return
 	}
+	c.warmUp.start(c.cachedKeys())
 
 	go wait.Until(c.runWorker, time.Second, c.stopCh)
 	<-c.stopCh
@@ -137,7 +242,11 @@ func (c *AggregatorServiceInfoController) processNextWorkItem() bool {
 			return nil
 		}
 
-		if err := c.syncHandler(key); err != nil {
+		startTime := time.Now()
+		err := c.syncHandler(key)
+		metrics.RecordControllerSync(aggregatorServiceInfoControllerName, err, time.Since(startTime))
+		c.warmUp.synced(key)
+		if err != nil {
 			c.workqueue.AddRateLimited(key)
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
 		}
@@ -162,7 +271,7 @@ func (c *AggregatorServiceInfoController) syncHandler(key string) error {
 		return nil
 	}
 
-	aggregatorConfigMap, err := c.lister.ConfigMaps(namespace).Get(name)
+	aggregatorConfigMap, err := c.getConfigMap(namespace, name)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			// configmap is deleted, delete aggregator config
@@ -174,11 +283,46 @@ func (c *AggregatorServiceInfoController) syncHandler(key string) error {
 
 	aggregatorServiceInfo, err := c.generateAggregatorServiceInfo(aggregatorConfigMap)
 	if err != nil {
+		if _, invalid := err.(*invalidConfigMapError); !invalid {
+			return err
+		}
+		// the invalid configmap is not served, and it is resynced after it is changed
+		c.serviceInfoGetter.RemoveAggregatorServiceInfo(namespace + "/" + name)
+		return c.updateConfigMapStatus(aggregatorConfigMap, newConfigMapStatus(aggregatorConfigMap, nil, err))
+	}
+
+	// the configmap is promoted when the older conflicting services are removed, so it is not resynced
+	err = c.serviceInfoGetter.AddAggregatorServiceInfo(aggregatorServiceInfo)
+	if err != nil && !getter.IsConflict(err) {
 		return err
 	}
+	return c.updateConfigMapStatus(aggregatorConfigMap, newConfigMapStatus(aggregatorConfigMap, aggregatorServiceInfo, err))
+}
 
-	c.serviceInfoGetter.AddAggregatorServiceInfo(aggregatorServiceInfo)
-	return nil
+// getConfigMap returns an aggregator configmap from the listers of the watched namespaces, it returns a not found
+// error if the configmap is not cached by any lister
+func (c *AggregatorServiceInfoController) getConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
+	for _, lister := range c.listers {
+		cm, err := lister.ConfigMaps(namespace).Get(name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		return cm, err
+	}
+	return nil, errors.NewNotFound(corev1.Resource("configmaps"), name)
+}
+
+// invalidConfigMapError is returned when an aggregator configmap is invalid, the configmap has to be changed to fix it
+type invalidConfigMapError struct {
+	message string
+}
+
+func (e *invalidConfigMapError) Error() string {
+	return e.message
+}
+
+func invalidConfigMapErrorf(format string, args ...interface{}) error {
+	return &invalidConfigMapError{message: fmt.Sprintf(format, args...)}
 }
 
 var aggregatorOptionsKey = []string{"service", "port", "path", "sub-resource", "use-id", "secret"}
@@ -186,48 +330,186 @@ var aggregatorOptionsKey = []string{"service", "port", "path", "sub-resource", "
 func (c *AggregatorServiceInfoController) generateAggregatorServiceInfo(cm *corev1.ConfigMap) (*getter.AggregatorServiceInfo, error) {
 	for _, key := range aggregatorOptionsKey {
 		if _, ok := cm.Data[key]; !ok {
-			return nil, fmt.Errorf("the '%s' key is required in configmap %s/%s", key, cm.Namespace, cm.Name)
+			return nil, invalidConfigMapErrorf("the '%s' key is required in configmap %s/%s", key, cm.Namespace, cm.Name)
 		}
 	}
 
 	serviceNamespace, serviceName, err := cache.SplitMetaNamespaceKey(cm.Data["service"])
 	if err != nil {
-		return nil, fmt.Errorf("the service format is wrong in configmap %s/%s, %v", cm.Namespace, cm.Name, err)
+		return nil, invalidConfigMapErrorf("the service format is wrong in configmap %s/%s, %v", cm.Namespace, cm.Name, err)
+	}
+
+	secretNamespace, secretName, err := secretOfConfigMap(cm)
+	if err != nil {
+		return nil, invalidConfigMapErrorf("%v", err)
+	}
+
+	secret, unavailableReason, err := getTLSSecret(c.secrets, secretNamespace, secretName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret in configmap %s/%s, %v", cm.Namespace, cm.Name, err)
+	}
+	restConfig := &rest.Config{}
+	if secret != nil {
+		restConfig = restConfigForSecret(secret)
+	} else {
+		klog.Warningf("The aggregator service configmap %s/%s is unavailable: %s", cm.Namespace, cm.Name, unavailableReason)
+	}
+
+	subResource := strings.Trim(cm.Data["sub-resource"], "/")
+	if err := getter.ValidateSubResource(subResource); err != nil {
+		return nil, invalidConfigMapErrorf("%v in configmap %s/%s", err, cm.Namespace, cm.Name)
+	}
+
+	idPlacement, err := validateIDPlacement(cm.Data["id-placement"])
+	if err != nil {
+		return nil, invalidConfigMapErrorf("%v in configmap %s/%s", err, cm.Namespace, cm.Name)
+	}
+
+	allowedMethods, err := validateAllowedMethods(strings.Split(cm.Data["allowed-methods"], ","))
+	if err != nil {
+		return nil, invalidConfigMapErrorf("%v in configmap %s/%s", err, cm.Namespace, cm.Name)
+	}
+
+	identityForwarding, err := validateIdentityForwarding(cm.Data["identity-forwarding"])
+	if err != nil {
+		return nil, invalidConfigMapErrorf("%v in configmap %s/%s", err, cm.Namespace, cm.Name)
+	}
+
+	allowedPaths, err := validatePathRules(strings.Split(cm.Data["allowed-paths"], ","))
+	if err != nil {
+		return nil, invalidConfigMapErrorf("%v in configmap %s/%s", err, cm.Namespace, cm.Name)
+	}
+	deniedPaths, err := validatePathRules(strings.Split(cm.Data["denied-paths"], ","))
+	if err != nil {
+		return nil, invalidConfigMapErrorf("%v in configmap %s/%s", err, cm.Namespace, cm.Name)
+	}
+
+	// the health check of a configmap only has a path, the other fields are the defaults
+	var healthCheck *health.Config
+	if healthCheckPath, ok := cm.Data["health-check-path"]; ok {
+		healthCheck, err = validateHealthCheck(&proxyv1alpha1.HealthCheckSpec{Path: healthCheckPath})
+		if err != nil {
+			return nil, invalidConfigMapErrorf("%v in configmap %s/%s", err, cm.Namespace, cm.Name)
+		}
+	}
+
+	return &getter.AggregatorServiceInfo{
+		Name:               cm.Namespace + "/" + cm.Name,
+		SubResource:        subResource,
+		CreationTimestamp:  cm.CreationTimestamp.Time,
+		ServiceName:        serviceName,
+		ServiceNamespace:   serviceNamespace,
+		ServicePort:        cm.Data["port"],
+		RootPath:           strings.Trim(cm.Data["path"], "/"),
+		UseID:              cm.Data["use-id"] == "true",
+		IDPlacement:        idPlacement,
+		IdentityForwarding: identityForwarding,
+		AllowedMethods:     allowedMethods,
+		AllowedPaths:       allowedPaths,
+		DeniedPaths:        deniedPaths,
+		HealthCheck:        healthCheck,
+		RestConfig:         restConfig,
+		UnavailableReason:  unavailableReason,
+	}, nil
+}
+
+// secretOfConfigMap returns the client certificate secret of an aggregator configmap, the secret is in the
+// namespace of the service by default
+func secretOfConfigMap(cm *corev1.ConfigMap) (string, string, error) {
+	serviceNamespace, _, err := cache.SplitMetaNamespaceKey(cm.Data["service"])
+	if err != nil {
+		return "", "", fmt.Errorf("the service format is wrong in configmap %s/%s, %v", cm.Namespace, cm.Name, err)
 	}
 
 	secretNamespace, secretName, err := cache.SplitMetaNamespaceKey(cm.Data["secret"])
 	if err != nil {
-		return nil, fmt.Errorf("the secret format is wrong in configmap %s/%s, %v", cm.Namespace, cm.Name, err)
+		return "", "", fmt.Errorf("the secret format is wrong in configmap %s/%s, %v", cm.Namespace, cm.Name, err)
 	}
 
 	if secretNamespace == "" {
 		secretNamespace = serviceNamespace
 	}
+	return secretNamespace, secretName, nil
+}
 
-	secret, err := c.client.CoreV1().Secrets(secretNamespace).Get(secretName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get secret in configmap %s/%s, %v", cm.Namespace, cm.Name, err)
+// validateIDPlacement returns the placement of the cluster name, the cluster name is inserted into the path by default
+func validateIDPlacement(placement string) (string, error) {
+	switch placement {
+	case "":
+		return getter.IDPlacementPath, nil
+	case getter.IDPlacementPath, getter.IDPlacementQuery, getter.IDPlacementHeader:
+		return placement, nil
+	default:
+		return "", fmt.Errorf("the id-placement %q is not supported", placement)
 	}
+}
 
-	useID := false
-	if cm.Data["use-id"] == "true" {
-		useID = true
+// validateIdentityForwarding returns the mode to forward the users to an aggregator service, the users are not
+// forwarded by default
+func validateIdentityForwarding(mode string) (string, error) {
+	switch mode {
+	case "":
+		return getter.IdentityForwardingNone, nil
+	case getter.IdentityForwardingNone, getter.IdentityForwardingImpersonation, getter.IdentityForwardingFrontProxy:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("the identity-forwarding %q is not supported", mode)
 	}
+}
 
-	return &getter.AggregatorServiceInfo{
-		Name:             cm.Namespace + "/" + cm.Name,
-		SubResource:      strings.Trim(cm.Data["sub-resource"], "/"),
-		ServiceName:      serviceName,
-		ServiceNamespace: serviceNamespace,
-		ServicePort:      cm.Data["port"],
-		RootPath:         strings.Trim(cm.Data["path"], "/"),
-		UseID:            useID,
-		RestConfig: &rest.Config{
-			TLSClientConfig: rest.TLSClientConfig{
-				CertData: secret.Data["tls.crt"],
-				KeyData:  secret.Data["tls.key"],
-				CAData:   secret.Data["ca.crt"],
-			},
+// validatePathRules returns the path rules of an aggregator service, a rule is an absolute path prefix or an absolute
+// glob pattern of the upstream paths
+func validatePathRules(rules []string) ([]string, error) {
+	var validated []string
+	for _, rule := range rules {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		if !strings.HasPrefix(rule, "/") {
+			return nil, fmt.Errorf("the path rule %q is not an absolute path", rule)
+		}
+		if _, err := path.Match(rule, ""); err != nil {
+			return nil, fmt.Errorf("the path rule %q is not a valid pattern", rule)
+		}
+		validated = append(validated, rule)
+	}
+	return validated, nil
+}
+
+// validateAllowedMethods returns the upper-cased HTTP methods that an aggregator service allows, all proxy methods
+// are allowed if no method is specified
+func validateAllowedMethods(methods []string) ([]string, error) {
+	supported := sets.NewString(getter.ProxyMethods...)
+	seen := sets.NewString()
+	allowed := []string{}
+	for _, method := range methods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" {
+			continue
+		}
+		if !supported.Has(method) {
+			return nil, fmt.Errorf("the method %q is not supported, the supported methods are %s",
+				method, strings.Join(getter.ProxyMethods, ", "))
+		}
+		if !seen.Has(method) {
+			seen.Insert(method)
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+	return allowed, nil
+}
+
+// restConfigForSecret returns the rest config to access a backend with the client certificate in a tls secret
+func restConfigForSecret(secret *corev1.Secret) *rest.Config {
+	return &rest.Config{
+		TLSClientConfig: rest.TLSClientConfig{
+			CertData: secret.Data["tls.crt"],
+			KeyData:  secret.Data["tls.key"],
+			CAData:   secret.Data["ca.crt"],
 		},
-	}, nil
+	}
 }
@@ -0,0 +1,451 @@
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func newAggregatorConfigMap(namespace, name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{"config": "mcm-aggregator"},
+		},
+		Data: map[string]string{
+			"service":      "default/backend",
+			"port":         "443",
+			"path":         "/api",
+			"sub-resource": "/sub",
+			"use-id":       "false",
+			"secret":       "backend-tls",
+		},
+	}
+}
+
+// newTestSecretInformers returns the secret informers that are never started for the namespaces, so the secrets of
+// the namespaces are always read from the client
+func newTestSecretInformers(kubeClient kubernetes.Interface, namespaces ...string) *SecretInformers {
+	secretInformers := NewSecretInformers(kubeClient, 0, nil)
+	for _, namespace := range namespaces {
+		secretInformers.namespaces[namespace] = &namespaceSecretInformer{
+			informer: coreinformers.NewSecretInformer(kubeClient, namespace, 0, cache.Indexers{}),
+			stopCh:   make(chan struct{}),
+		}
+	}
+	return secretInformers
+}
+
+// newTestAggregatorServiceInfoController watches the aggregator configmaps of all namespaces with the informer factory
+func newTestAggregatorServiceInfoController(
+	kubeClient kubernetes.Interface,
+	informerFactory informers.SharedInformerFactory,
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter) *AggregatorServiceInfoController {
+	selector, err := labels.Parse(DefaultAggregatorConfigMapLabelSelector)
+	if err != nil {
+		panic(err)
+	}
+	return NewAggregatorServiceInfoController(kubeClient, newTestSecretInformers(kubeClient, "default"),
+		[]informers.SharedInformerFactory{informerFactory}, selector, serviceInfoGetter, nil)
+}
+
+func syncNextConfigMap(t *testing.T, ctrl *AggregatorServiceInfoController) {
+	if ctrl.workqueue.Len() == 0 {
+		t.Fatalf("expected the configmap is requeued")
+	}
+	if !ctrl.processNextWorkItem() {
+		t.Fatalf("unexpected workqueue shutdown")
+	}
+}
+
+// expectEvent drains the recorded events until an event has the prefix
+func expectEvent(t *testing.T, recorder *record.FakeRecorder, prefix string) {
+	for len(recorder.Events) > 0 {
+		if event := <-recorder.Events; strings.HasPrefix(event, prefix) {
+			return
+		}
+	}
+	t.Errorf("expected an event %q, but failed", prefix)
+}
+
+func TestSecretHotReload(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(newAggregatorConfigMap("default", "test"))
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	ctrl := newTestAggregatorServiceInfoController(kubeClient, informerFactory, serviceInfoGetter)
+
+	configMapStore := informerFactory.Core().V1().ConfigMaps().Informer().GetIndexer()
+	if err := configMapStore.Add(newAggregatorConfigMap("default", "test")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secretHandler := newSecretEventHandler(configMapStore, ctrl.workqueue)
+	secrets := kubeClient.CoreV1().Secrets("default")
+
+	secret := newTLSSecret("default", "backend-tls")
+	if _, err := secrets.Create(secret); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secretHandler.OnAdd(secret)
+	syncNextConfigMap(t, ctrl)
+
+	serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("sub")
+	if serviceInfo == nil || serviceInfo.UnavailableReason != "" || string(serviceInfo.RestConfig.CertData) != "cert" {
+		t.Fatalf("unexpected service info: %#v", serviceInfo)
+	}
+
+	// rotate the client certificate
+	rotated := secret.DeepCopy()
+	rotated.Data["tls.crt"] = []byte("rotated-cert")
+	if _, err := secrets.Update(rotated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secretHandler.OnUpdate(secret, rotated)
+	syncNextConfigMap(t, ctrl)
+
+	serviceInfo = serviceInfoGetter.GetAggregatorServiceInfo("sub")
+	if serviceInfo == nil || string(serviceInfo.RestConfig.CertData) != "rotated-cert" {
+		t.Fatalf("expected the rotated certificate is used, but %#v", serviceInfo)
+	}
+
+	// an unrelated secret does not requeue the configmap
+	secretHandler.OnAdd(newTLSSecret("default", "unrelated"))
+	if ctrl.workqueue.Len() != 0 {
+		t.Errorf("expected the configmap is not requeued for an unrelated secret")
+	}
+
+	if err := secrets.Delete(rotated.Name, &metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secretHandler.OnDelete(rotated)
+	syncNextConfigMap(t, ctrl)
+
+	serviceInfo = serviceInfoGetter.GetAggregatorServiceInfo("sub")
+	if serviceInfo == nil || serviceInfo.UnavailableReason == "" || len(serviceInfo.RestConfig.CertData) != 0 {
+		t.Fatalf("expected the service is unavailable without stale certificate, but %#v", serviceInfo)
+	}
+}
+
+func TestSubResourceConflict(t *testing.T) {
+	older := newAggregatorConfigMap("default", "older")
+	older.CreationTimestamp = metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := newAggregatorConfigMap("default", "newer")
+	newer.CreationTimestamp = metav1.NewTime(older.CreationTimestamp.Add(time.Hour))
+
+	kubeClient := kubefake.NewSimpleClientset(older, newer, newTLSSecret("default", "backend-tls"))
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	ctrl := newTestAggregatorServiceInfoController(kubeClient, informerFactory, serviceInfoGetter)
+	recorder := record.NewFakeRecorder(10)
+	ctrl.recorder = recorder
+
+	configMapStore := informerFactory.Core().V1().ConfigMaps().Informer().GetIndexer()
+	for _, obj := range []interface{}{older, newer} {
+		if err := configMapStore.Add(obj); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// the informer is not started, the updates of the configmaps are synced to the store manually
+	syncStore := func(name string) {
+		cm, err := kubeClient.CoreV1().ConfigMaps("default").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := configMapStore.Update(cm); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// the newer configmap is synced first, it is demoted when the older one is synced
+	if err := ctrl.syncHandler("default/newer"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ctrl.syncHandler("default/older"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	syncNextConfigMap(t, ctrl)
+	syncStore("newer")
+
+	if serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("sub"); serviceInfo == nil || serviceInfo.Name != "default/older" {
+		t.Errorf("expected sub is routed to default/older, but %#v", serviceInfo)
+	}
+	cm, _ := ctrl.getConfigMap("default", "newer")
+	if message := cm.Annotations[SubResourceConflictAnnotation]; message == "" {
+		t.Errorf("expected the conflict annotation, but failed")
+	}
+	expectEvent(t, recorder, "Warning "+SubResourceConflictReason)
+
+	// the resync of the conflicting configmap does not emit the event again
+	if err := ctrl.syncHandler("default/newer"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event, but %q", <-recorder.Events)
+	}
+
+	// the newer configmap is promoted when the older one is deleted
+	if err := configMapStore.Delete(older); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ctrl.syncHandler("default/older"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	syncNextConfigMap(t, ctrl)
+	syncStore("newer")
+
+	if serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("sub"); serviceInfo == nil || serviceInfo.Name != "default/newer" {
+		t.Errorf("expected sub is routed to default/newer, but %#v", serviceInfo)
+	}
+	cm, _ = ctrl.getConfigMap("default", "newer")
+	if _, ok := cm.Annotations[SubResourceConflictAnnotation]; ok {
+		t.Errorf("expected the conflict annotation is removed, but failed")
+	}
+	expectEvent(t, recorder, "Normal "+SubResourceRegisteredReason)
+}
+
+func TestConfigMapStatus(t *testing.T) {
+	invalid := newAggregatorConfigMap("default", "test")
+	delete(invalid.Data, "port")
+
+	kubeClient := kubefake.NewSimpleClientset(invalid)
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	ctrl := newTestAggregatorServiceInfoController(kubeClient, informerFactory, serviceInfoGetter)
+	recorder := record.NewFakeRecorder(10)
+	ctrl.recorder = recorder
+
+	configMapStore := informerFactory.Core().V1().ConfigMaps().Informer().GetIndexer()
+	sync := func(cm *corev1.ConfigMap) *ConfigMapStatus {
+		if err := configMapStore.Update(cm); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// the invalid configmap is not requeued
+		if err := ctrl.syncHandler("default/test"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		updated, err := kubeClient.CoreV1().ConfigMaps("default").Get("test", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		status := configMapStatusOf(updated)
+		if status == nil {
+			t.Fatalf("expected the status annotation, but %v", updated.Annotations)
+		}
+		return status
+	}
+
+	status := sync(invalid)
+	if status.Result != ConfigMapInvalid || status.Reason != InvalidConfigReason {
+		t.Errorf("expected invalid status, but %#v", status)
+	}
+	expectEvent(t, recorder, "Warning "+InvalidConfigReason)
+
+	valid := newAggregatorConfigMap("default", "test")
+	if _, err := kubeClient.CoreV1().Secrets("default").Create(newTLSSecret("default", "backend-tls")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	status = sync(valid)
+	if status.Result != ConfigMapSynced || status.Backend != "backend.default.svc:443" ||
+		status.ObservedDataHash != configMapDataHash(valid) {
+		t.Errorf("expected synced status, but %#v", status)
+	}
+	expectEvent(t, recorder, "Normal "+SyncedReason)
+
+	// the observed hash is changed when the data is edited, even if the result is not changed
+	edited, _ := kubeClient.CoreV1().ConfigMaps("default").Get("test", metav1.GetOptions{})
+	edited.Data["health-check-path"] = "/healthz"
+	status = sync(edited)
+	if status.Result != ConfigMapSynced || status.ObservedDataHash != configMapDataHash(edited) ||
+		status.ObservedDataHash == configMapDataHash(valid) {
+		t.Errorf("expected the hash of the edited data, but %#v", status)
+	}
+
+	// the configmap is not updated again if its status is not changed
+	updated, _ := kubeClient.CoreV1().ConfigMaps("default").Get("test", metav1.GetOptions{})
+	actions := len(kubeClient.Actions())
+	sync(updated)
+	for _, action := range kubeClient.Actions()[actions:] {
+		if action.GetVerb() == "update" {
+			t.Errorf("expected no update, but %v", kubeClient.Actions()[actions:])
+		}
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no event, but %q", <-recorder.Events)
+	}
+}
+
+func TestValidateAllowedMethods(t *testing.T) {
+	cases := []struct {
+		name          string
+		methods       []string
+		expected      []string
+		expectedError bool
+	}{
+		{
+			name:     "all methods by default",
+			methods:  []string{""},
+			expected: nil,
+		},
+		{
+			name:     "read-only methods",
+			methods:  []string{" get", "HEAD", "Get"},
+			expected: []string{"GET", "HEAD"},
+		},
+		{
+			name:          "unsupported method",
+			methods:       []string{"GET", "TRACE"},
+			expectedError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			methods, err := validateAllowedMethods(c.methods)
+			if c.expectedError != (err != nil) {
+				t.Fatalf("expected error %v, but %v", c.expectedError, err)
+			}
+			if !reflect.DeepEqual(methods, c.expected) {
+				t.Errorf("expected methods %v, but %v", c.expected, methods)
+			}
+		})
+	}
+}
+
+func TestValidateIdentityForwarding(t *testing.T) {
+	cases := []struct {
+		mode          string
+		expected      string
+		expectedError bool
+	}{
+		{mode: "", expected: getter.IdentityForwardingNone},
+		{mode: getter.IdentityForwardingImpersonation, expected: getter.IdentityForwardingImpersonation},
+		{mode: getter.IdentityForwardingFrontProxy, expected: getter.IdentityForwardingFrontProxy},
+		{mode: "token", expectedError: true},
+	}
+
+	for _, c := range cases {
+		mode, err := validateIdentityForwarding(c.mode)
+		if c.expectedError != (err != nil) {
+			t.Errorf("expected error %v for %q, but %v", c.expectedError, c.mode, err)
+		}
+		if mode != c.expected {
+			t.Errorf("expected mode %q, but %q", c.expected, mode)
+		}
+	}
+}
+
+func TestValidatePathRules(t *testing.T) {
+	rules, err := validatePathRules([]string{" /api/v1/nodes", "", "/api/v1/namespaces/*/pods"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(rules, []string{"/api/v1/nodes", "/api/v1/namespaces/*/pods"}) {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	if _, err := validatePathRules([]string{"api/v1"}); err == nil {
+		t.Errorf("expected error for the relative path")
+	}
+	if _, err := validatePathRules([]string{"/api/[v1"}); err == nil {
+		t.Errorf("expected error for the invalid pattern")
+	}
+}
+
+func TestConfigMapInformerScope(t *testing.T) {
+	unlabelled := newAggregatorConfigMap("ns1", "unlabelled")
+	unlabelled.Labels = nil
+	kubeClient := kubefake.NewSimpleClientset(
+		newAggregatorConfigMap("ns1", "test"), unlabelled, newAggregatorConfigMap("ns3", "test"))
+	selector, err := labels.Parse(DefaultAggregatorConfigMapLabelSelector)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	factories := NewConfigMapInformerFactories(kubeClient, 0, []string{"ns1", "ns2", "ns1"}, selector)
+	if len(factories) != 2 {
+		t.Fatalf("expected an informer factory per namespace, but %d", len(factories))
+	}
+	ctrl := NewAggregatorServiceInfoController(kubeClient, newTestSecretInformers(kubeClient),
+		factories, selector, getter.NewAggregatorServiceInfoGetter(), nil)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	for _, factory := range factories {
+		factory.Start(stopCh)
+		factory.WaitForCacheSync(stopCh)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return ctrl.workqueue.Len() > 0, nil
+	}); err != nil {
+		t.Fatalf("expected the configmap is enqueued, but %v", err)
+	}
+
+	cached := []string{}
+	for _, factory := range factories {
+		cms, err := factory.Core().V1().ConfigMaps().Lister().List(labels.Everything())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, cm := range cms {
+			cached = append(cached, cm.Namespace+"/"+cm.Name)
+		}
+	}
+	if !reflect.DeepEqual(cached, []string{"ns1/test"}) {
+		t.Errorf("expected only ns1/test is cached, but %v", cached)
+	}
+	if key, _ := ctrl.workqueue.Get(); key != "ns1/test" || ctrl.workqueue.Len() != 0 {
+		t.Errorf("expected only ns1/test is enqueued, but %v", key)
+	}
+}
+
+func TestDeleteTombstone(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset()
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	ctrl := newTestAggregatorServiceInfoController(kubeClient, informerFactory, getter.NewAggregatorServiceInfoGetter())
+
+	ctrl.deleteObj(cache.DeletedFinalStateUnknown{Key: "default/test", Obj: newAggregatorConfigMap("default", "test")})
+	ctrl.deleteObj(cache.DeletedFinalStateUnknown{Key: "default/unknown", Obj: "unknown"})
+	if key, _ := ctrl.workqueue.Get(); key != "default/test" || ctrl.workqueue.Len() != 0 {
+		t.Errorf("expected only default/test is enqueued, but %v", key)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(newAggregatorConfigMap("default", "a"), newAggregatorConfigMap("default", "b"))
+	informerFactory := informers.NewSharedInformerFactory(kubeClient, 0)
+	ctrl := newTestAggregatorServiceInfoController(kubeClient, informerFactory, getter.NewAggregatorServiceInfoGetter())
+	ctrl.recorder = record.NewFakeRecorder(10)
+
+	configMapStore := informerFactory.Core().V1().ConfigMaps().Informer().GetIndexer()
+	for _, name := range []string{"a", "b"} {
+		if err := configMapStore.Add(newAggregatorConfigMap("default", name)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ctrl.workqueue.Add("default/" + name)
+	}
+	if ctrl.HasSynced() {
+		t.Errorf("expected not synced before the informer caches have synced")
+	}
+
+	ctrl.warmUp.start(ctrl.cachedKeys())
+	syncNextConfigMap(t, ctrl)
+	if ctrl.HasSynced() {
+		t.Errorf("expected not synced before all cached configmaps have been synced")
+	}
+	syncNextConfigMap(t, ctrl)
+	if !ctrl.HasSynced() {
+		t.Errorf("expected synced after all cached configmaps have been synced")
+	}
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+)
+
+// eventComponent is the source component of the events that the controllers emit
+const eventComponent = "aggregator-proxy-server"
+
+// The reasons of the events that the controllers emit
+const (
+	// SubResourceConflictReason is the reason of the events when an aggregator service is not routed because an
+	// older one claims the same sub-resource
+	SubResourceConflictReason = "SubResourceConflict"
+	// SubResourceRegisteredReason is the reason of the events when a conflicting aggregator service is promoted
+	SubResourceRegisteredReason = "SubResourceRegistered"
+	// SyncedReason is the reason of the events when an aggregator configmap is served
+	SyncedReason = "Synced"
+	// InvalidConfigReason is the reason of the events when an aggregator configmap is invalid
+	InvalidConfigReason = "InvalidConfig"
+	// SecretUnavailableReason is the reason of the events when the client certificate secret of an aggregator
+	// configmap is missing or invalid
+	SecretUnavailableReason = "SecretUnavailable"
+)
+
+// SubResourceConflictAnnotation is set on an aggregator configmap with the conflict message while the configmap is
+// not routed because an older aggregator service claims the same sub-resource
+const SubResourceConflictAnnotation = "aggregation.open-cluster-management.io/sub-resource-conflict"
+
+// newEventRecorder returns an event broadcaster and a recorder of a controller, the events are sent to the
+// apiserver after startRecording is called
+func newEventRecorder() (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+	return broadcaster, recorder
+}
+
+// startRecording sends the events of a broadcaster to the apiserver until the stop channel is closed
+func startRecording(broadcaster record.EventBroadcaster, client kubernetes.Interface, stopCh <-chan struct{}) {
+	broadcaster.StartLogging(klog.Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	go func() {
+		<-stopCh
+		broadcaster.Shutdown()
+	}()
+}
@@ -0,0 +1,353 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	proxyv1alpha1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/proxy/v1alpha1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// fileSourceName is the name of the metrics of the FileSource
+const fileSourceName = "fileSource"
+
+// staticServiceInfoPrefix prefixes the service info names of the static services, the names cannot conflict with
+// the names of the configmaps and the aggregator services
+const staticServiceInfoPrefix = "static:"
+
+// DefaultFileSourceSyncPeriod is how often the static services file is resynced by default, the changes of the file
+// are watched, so the resync only picks up the missed events and the TLS files in the other directories
+const DefaultFileSourceSyncPeriod = 10 * time.Second
+
+// StaticServicesConfig is the content of a static services file, in yaml or json
+type StaticServicesConfig struct {
+	Services []StaticService `json:"services"`
+}
+
+// StaticService is an aggregator service that is not registered in a cluster, e.g. for the development and the CI
+type StaticService struct {
+	// Name is unique in the file
+	Name string `json:"name"`
+	// SubResource is the path after clusterstatuses/{name}/aggregator that is routed to the service
+	SubResource string `json:"subResource"`
+	// Address is the host:port of the backend, the backend is always accessed with https
+	Address            string                            `json:"address"`
+	RootPath           string                            `json:"rootPath,omitempty"`
+	UseID              bool                              `json:"useID,omitempty"`
+	IDPlacement        string                            `json:"idPlacement,omitempty"`
+	IdentityForwarding string                            `json:"identityForwarding,omitempty"`
+	AllowedMethods     []string                          `json:"allowedMethods,omitempty"`
+	AllowedPaths       []string                          `json:"allowedPaths,omitempty"`
+	DeniedPaths        []string                          `json:"deniedPaths,omitempty"`
+	CircuitBreaker     *proxyv1alpha1.CircuitBreakerSpec `json:"circuitBreaker,omitempty"`
+	RetryPolicy        *proxyv1alpha1.RetryPolicySpec    `json:"retryPolicy,omitempty"`
+	HealthCheck        *proxyv1alpha1.HealthCheckSpec    `json:"healthCheck,omitempty"`
+	TLS                StaticTLSConfig                   `json:"tls,omitempty"`
+}
+
+// StaticTLSConfig is the files of the client certificate and the CA bundle to access a static service
+type StaticTLSConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	CAFile   string `json:"caFile,omitempty"`
+	// ServerName verifies the server certificate, defaults to the host of the address
+	ServerName string `json:"serverName,omitempty"`
+	// Insecure skips verifying the server certificate
+	Insecure bool `json:"insecure,omitempty"`
+}
+
+// FileSource registers the aggregator services of a static file. The file is reloaded when its directory is changed,
+// so a file that is mounted from a configmap is reloaded when the mount is swapped, and the file and the TLS files that
+// it references are also reloaded periodically. The services are applied at once, and an invalid file is rejected
+// with the previous services kept.
+type FileSource struct {
+	path              string
+	period            time.Duration
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter
+	stopCh            <-chan struct{}
+
+	mutex sync.Mutex
+	// applied are the service infos of the last valid file, nil if no valid file is loaded
+	applied []*getter.AggregatorServiceInfo
+}
+
+var _ = getter.ServiceInfoSource(&FileSource{})
+
+func NewFileSource(
+	path string,
+	period time.Duration,
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter,
+	stopCh <-chan struct{}) *FileSource {
+	return &FileSource{
+		path:              path,
+		period:            period,
+		serviceInfoGetter: serviceInfoGetter,
+		stopCh:            stopCh,
+	}
+}
+
+// staticServicesSourceName is the name of the readiness check of the FileSource
+const staticServicesSourceName = "static-aggregator-services"
+
+func (s *FileSource) Name() string {
+	return staticServicesSourceName
+}
+
+// HasSynced returns true if a valid file has been loaded
+func (s *FileSource) HasSynced() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.applied != nil
+}
+
+func (s *FileSource) Run() {
+	klog.Infof("Loading static aggregator services from %s", s.path)
+	defer klog.Info("Shutting static aggregator service file source")
+
+	// the directory is watched instead of the file, a configmap volume replaces the file by swapping a symlink
+	var events <-chan fsnotify.Event
+	var errors <-chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		err = watcher.Add(filepath.Dir(s.path))
+		events, errors = watcher.Events, watcher.Errors
+	}
+	if err != nil {
+		klog.Errorf("failed to watch %s, the file is reloaded every %v: %v", s.path, s.period, err)
+	}
+
+	ticker := time.NewTicker(s.period)
+	defer ticker.Stop()
+	for {
+		s.load()
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		case event := <-events:
+			klog.V(4).Infof("Reloading static aggregator services for %v", event)
+		case err := <-errors:
+			klog.Warningf("failed to watch %s: %v", s.path, err)
+		}
+	}
+}
+
+// load syncs the file and records the result
+func (s *FileSource) load() {
+	startTime := time.Now()
+	err := s.sync()
+	metrics.RecordControllerSync(fileSourceName, err, time.Since(startTime))
+	if err != nil {
+		klog.Errorf("failed to load static aggregator services from %s, the previous services are kept: %v", s.path, err)
+	}
+}
+
+// sync loads the file and applies the service infos if they are changed
+func (s *FileSource) sync() error {
+	serviceInfos, err := loadStaticServices(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// a static service is created when it is loaded first, it keeps the time while it is in the file, so it takes
+	// part in the conflict resolution by the age like the other services, and an edit does not change its priority
+	loaded := map[string]time.Time{}
+	for _, serviceInfo := range s.applied {
+		loaded[serviceInfo.Name] = serviceInfo.CreationTimestamp
+	}
+	now := time.Now()
+	for _, serviceInfo := range serviceInfos {
+		serviceInfo.CreationTimestamp = now
+		if created, ok := loaded[serviceInfo.Name]; ok {
+			serviceInfo.CreationTimestamp = created
+		}
+	}
+
+	if s.applied != nil && reflect.DeepEqual(s.applied, serviceInfos) {
+		return nil
+	}
+
+	names := sets.NewString()
+	for _, serviceInfo := range serviceInfos {
+		names.Insert(serviceInfo.Name)
+	}
+	removed := []string{}
+	for _, serviceInfo := range s.applied {
+		if !names.Has(serviceInfo.Name) {
+			removed = append(removed, serviceInfo.Name)
+		}
+	}
+
+	// the static services that conflict with the older services are promoted when the older ones are removed
+	for _, err := range s.serviceInfoGetter.ApplyAggregatorServiceInfos(removed, serviceInfos) {
+		klog.Warningf("The static aggregator service is not served: %v", err)
+	}
+	s.applied = serviceInfos
+	klog.Infof("Applied %d static aggregator services from %s", len(serviceInfos), s.path)
+	return nil
+}
+
+// loadStaticServices reads and validates a static services file, it returns the errors of all invalid services
+func loadStaticServices(path string) ([]*getter.AggregatorServiceInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &StaticServicesConfig{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	serviceInfos := []*getter.AggregatorServiceInfo{}
+	errs := []error{}
+	names, subResources := sets.NewString(), sets.NewString()
+	for i := range config.Services {
+		service := &config.Services[i]
+		serviceInfo, err := staticServiceInfo(service)
+		if err == nil && names.Has(service.Name) {
+			err = fmt.Errorf("the name is duplicated")
+		}
+		if err == nil && subResources.Has(serviceInfo.SubResource) {
+			err = fmt.Errorf("the subResource %s is duplicated", serviceInfo.SubResource)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid service %q: %v", service.Name, err))
+			continue
+		}
+		names.Insert(service.Name)
+		subResources.Insert(serviceInfo.SubResource)
+		serviceInfos = append(serviceInfos, serviceInfo)
+	}
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return serviceInfos, nil
+}
+
+// staticServiceInfo validates a static service and builds its service info with the content of its TLS files
+func staticServiceInfo(service *StaticService) (*getter.AggregatorServiceInfo, error) {
+	if errs := validation.IsDNS1123Subdomain(service.Name); len(errs) > 0 {
+		return nil, fmt.Errorf("the name is invalid: %s", strings.Join(errs, ", "))
+	}
+	subResource := strings.Trim(service.SubResource, "/")
+	if err := getter.ValidateSubResource(subResource); err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(service.Address)
+	if err != nil {
+		return nil, fmt.Errorf("the address %q is invalid: %v", service.Address, err)
+	}
+	if portNumber, err := strconv.Atoi(port); err != nil || host == "" || portNumber <= 0 || portNumber > 65535 {
+		return nil, fmt.Errorf("the address %q is invalid", service.Address)
+	}
+
+	idPlacement, err := validateIDPlacement(service.IDPlacement)
+	if err != nil {
+		return nil, err
+	}
+	identityForwarding, err := validateIdentityForwarding(service.IdentityForwarding)
+	if err != nil {
+		return nil, err
+	}
+	allowedMethods, err := validateAllowedMethods(service.AllowedMethods)
+	if err != nil {
+		return nil, err
+	}
+	allowedPaths, err := validatePathRules(service.AllowedPaths)
+	if err != nil {
+		return nil, err
+	}
+	deniedPaths, err := validatePathRules(service.DeniedPaths)
+	if err != nil {
+		return nil, err
+	}
+	circuitBreaker, err := validateCircuitBreaker(service.CircuitBreaker)
+	if err != nil {
+		return nil, err
+	}
+	retryPolicy, err := validateRetryPolicy(service.RetryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	healthCheck, err := validateHealthCheck(service.HealthCheck)
+	if err != nil {
+		return nil, err
+	}
+	restConfig, err := restConfigForTLSFiles(&service.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return &getter.AggregatorServiceInfo{
+		Name:               staticServiceInfoPrefix + service.Name,
+		SubResource:        subResource,
+		Address:            service.Address,
+		RootPath:           strings.Trim(service.RootPath, "/"),
+		UseID:              service.UseID,
+		IDPlacement:        idPlacement,
+		IdentityForwarding: identityForwarding,
+		AllowedMethods:     allowedMethods,
+		AllowedPaths:       allowedPaths,
+		DeniedPaths:        deniedPaths,
+		CircuitBreaker:     circuitBreaker,
+		RetryPolicy:        retryPolicy,
+		HealthCheck:        healthCheck,
+		RestConfig:         restConfig,
+	}, nil
+}
+
+// restConfigForTLSFiles reads the TLS files of a static service, the contents are kept in the rest config, so a
+// rotated certificate is applied when the file source is synced
+func restConfigForTLSFiles(tlsConfig *StaticTLSConfig) (*rest.Config, error) {
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return nil, fmt.Errorf("the certFile and the keyFile must be set together")
+	}
+	if tlsConfig.Insecure && tlsConfig.CAFile != "" {
+		return nil, fmt.Errorf("the caFile cannot be set with insecure")
+	}
+
+	restConfig := &rest.Config{
+		TLSClientConfig: rest.TLSClientConfig{
+			ServerName: tlsConfig.ServerName,
+			Insecure:   tlsConfig.Insecure,
+		},
+	}
+	for _, file := range []struct {
+		path string
+		data *[]byte
+	}{
+		{path: tlsConfig.CertFile, data: &restConfig.CertData},
+		{path: tlsConfig.KeyFile, data: &restConfig.KeyData},
+		{path: tlsConfig.CAFile, data: &restConfig.CAData},
+	} {
+		if file.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return nil, err
+		}
+		*file.data = data
+	}
+	return restConfig, nil
+}
@@ -0,0 +1,240 @@
+package controller
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const testStaticServices = `
+services:
+- name: metrics
+  subResource: metrics/v1
+  address: localhost:8443
+  rootPath: /api
+  allowedMethods: [GET]
+  tls:
+    certFile: %[1]s/tls.crt
+    keyFile: %[1]s/tls.key
+    caFile: %[1]s/ca.crt
+- name: logs
+  subResource: logs
+  address: 127.0.0.1:9443
+  tls:
+    insecure: true
+`
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-services")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{"tls.crt": "cert", "tls.key": "key", "ca.crt": "ca"} {
+		writeTestFile(t, filepath.Join(dir, name), content)
+	}
+	path := filepath.Join(dir, "services.yaml")
+	writeTestFile(t, path, fmt.Sprintf(testStaticServices, dir))
+
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	source := NewFileSource(path, time.Second, serviceInfoGetter, nil)
+	if source.HasSynced() {
+		t.Errorf("expected not synced before the file is loaded")
+	}
+	if err := source.sync(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !source.HasSynced() {
+		t.Errorf("expected synced after the file is loaded")
+	}
+
+	metrics := serviceInfoGetter.GetAggregatorServiceInfo("metrics/v1/pods")
+	if metrics == nil || metrics.Name != "static:metrics" || metrics.Host() != "localhost:8443" || metrics.RootPath != "api" {
+		t.Fatalf("unexpected service info: %#v", metrics)
+	}
+	if string(metrics.RestConfig.CertData) != "cert" || string(metrics.RestConfig.CAData) != "ca" {
+		t.Errorf("expected the TLS files are loaded, but %#v", metrics.RestConfig.TLSClientConfig)
+	}
+	if logs := serviceInfoGetter.GetAggregatorServiceInfo("logs"); logs == nil || !logs.RestConfig.Insecure {
+		t.Errorf("unexpected service info: %#v", logs)
+	}
+
+	created := metrics.CreationTimestamp
+	if created.IsZero() {
+		t.Errorf("expected the static service is created when it is loaded")
+	}
+
+	// an invalid edit is rejected, the previous services are kept
+	writeTestFile(t, path, `
+services:
+- name: metrics
+  subResource: metrics/v1
+  address: localhost
+`)
+	if err := source.sync(); err == nil {
+		t.Errorf("expected invalid address error, but failed")
+	}
+	if serviceInfoGetter.GetAggregatorServiceInfo("logs") == nil {
+		t.Errorf("expected the previous services are kept")
+	}
+
+	// the rotated certificate is applied
+	writeTestFile(t, path, fmt.Sprintf(testStaticServices, dir))
+	writeTestFile(t, filepath.Join(dir, "tls.crt"), "rotated-cert")
+	if err := source.sync(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	metrics = serviceInfoGetter.GetAggregatorServiceInfo("metrics/v1")
+	if metrics == nil || string(metrics.RestConfig.CertData) != "rotated-cert" {
+		t.Errorf("expected the rotated certificate is used, but %#v", metrics)
+	}
+	if metrics != nil && !metrics.CreationTimestamp.Equal(created) {
+		t.Errorf("expected the creation time %v is kept, but %v", created, metrics.CreationTimestamp)
+	}
+
+	// the removed services are not routed any more
+	writeTestFile(t, path, "services:\n- {name: logs, subResource: logs, address: '127.0.0.1:9443'}\n")
+	if err := source.sync(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("metrics/v1"); serviceInfo != nil {
+		t.Errorf("expected metrics/v1 is not routed, but %#v", serviceInfo)
+	}
+	if serviceInfoGetter.GetAggregatorServiceInfo("logs") == nil {
+		t.Errorf("expected logs is routed")
+	}
+}
+
+func TestLoadStaticServicesInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-services")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]string{
+		"unknown field":       "services:\n- {name: a, subResource: a, address: 'h:1', unknown: true}\n",
+		"invalid name":        "services:\n- {name: A_B, subResource: a, address: 'h:1'}\n",
+		"duplicated name":     "services:\n- {name: a, subResource: a, address: 'h:1'}\n- {name: a, subResource: b, address: 'h:1'}\n",
+		"duplicated resource": "services:\n- {name: a, subResource: a, address: 'h:1'}\n- {name: b, subResource: /a/, address: 'h:1'}\n",
+		"invalid port":        "services:\n- {name: a, subResource: a, address: 'h:0'}\n",
+		"missing key file":    "services:\n- {name: a, subResource: a, address: 'h:1', tls: {certFile: /tmp/tls.crt}}\n",
+		"insecure with ca":    "services:\n- {name: a, subResource: a, address: 'h:1', tls: {caFile: /tmp/ca.crt, insecure: true}}\n",
+	}
+	for name, content := range cases {
+		path := filepath.Join(dir, "services.yaml")
+		writeTestFile(t, path, content)
+		if _, err := loadStaticServices(path); err == nil {
+			t.Errorf("expected %s error, but failed", name)
+		}
+	}
+}
+
+func TestFileSourceConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-services")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "services.yaml")
+	writeTestFile(t, path, "services:\n- {name: logs, subResource: logs, address: '127.0.0.1:9443'}\n")
+
+	// an older configmap wins the sub-resource over a static service that is loaded later
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	older := &getter.AggregatorServiceInfo{
+		Name:              "default/logs",
+		SubResource:       "logs",
+		Address:           "logs.default.svc:443",
+		CreationTimestamp: time.Now().Add(-time.Hour),
+	}
+	if err := serviceInfoGetter.AddAggregatorServiceInfo(older); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	source := NewFileSource(path, time.Second, serviceInfoGetter, nil)
+	if err := source.sync(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("logs"); serviceInfo == nil ||
+		serviceInfo.Name != "default/logs" {
+		t.Errorf("expected the older configmap is routed, but %#v", serviceInfo)
+	}
+
+	// a configmap that is created after the static service is loaded does not win the sub-resource
+	newer := &getter.AggregatorServiceInfo{
+		Name:              "default/newer-logs",
+		SubResource:       "logs",
+		Address:           "logs.default.svc:443",
+		CreationTimestamp: time.Now().Add(time.Hour),
+	}
+	if err := serviceInfoGetter.AddAggregatorServiceInfo(newer); err == nil {
+		t.Errorf("expected conflict error, but failed")
+	}
+	serviceInfoGetter.RemoveAggregatorServiceInfo(older.Name)
+	if serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("logs"); serviceInfo == nil ||
+		serviceInfo.Name != "static:logs" {
+		t.Errorf("expected the static service is promoted, but %#v", serviceInfo)
+	}
+}
+
+func TestFileSourceWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static-services")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the file is mounted like a configmap volume, the data directory is replaced by swapping the ..data symlink
+	mount := func(version, content string) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0700); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		writeTestFile(t, filepath.Join(dir, version, "services.yaml"), content)
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	mount("v1", "services:\n- {name: logs, subResource: logs, address: '127.0.0.1:9443'}\n")
+	path := filepath.Join(dir, "services.yaml")
+	if err := os.Symlink(filepath.Join("..data", "services.yaml"), path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	source := NewFileSource(path, time.Hour, serviceInfoGetter, stopCh)
+	go source.Run()
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return source.HasSynced(), nil
+	}); err != nil {
+		t.Fatalf("expected the file is loaded, but %v", err)
+	}
+
+	// the swapped file is reloaded without waiting for the resync
+	mount("v2", "services:\n- {name: metrics, subResource: metrics, address: '127.0.0.1:9443'}\n")
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return serviceInfoGetter.GetAggregatorServiceInfo("metrics") != nil, nil
+	}); err != nil {
+		t.Errorf("expected the swapped file is reloaded, but %v", err)
+	}
+	if serviceInfo := serviceInfoGetter.GetAggregatorServiceInfo("logs"); serviceInfo != nil {
+		t.Errorf("expected logs is not routed, but %#v", serviceInfo)
+	}
+}
@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+)
+
+// secretReferenceIndex indexes the aggregator service objects by the keys of the secrets that they reference
+const secretReferenceIndex = "secretReference"
+
+// secretNamespacesPrunePeriod is how often the secret informers of the namespaces that are not referenced any more
+// are stopped
+const secretNamespacesPrunePeriod = time.Minute
+
+// secretGetter gets the client certificate secrets of the backends
+type secretGetter interface {
+	Get(namespace, name string) (*corev1.Secret, error)
+}
+
+// SecretInformers caches the secrets of the namespaces that the aggregator services reference, so the proxy does not
+// cache all secrets of the cluster and only needs to list and watch the secrets of these namespaces. The secrets of a
+// namespace are watched when a secret of the namespace is got the first time, and they are read from the
+// kube-apiserver until the informer of the namespace has synced.
+type SecretInformers struct {
+	client kubernetes.Interface
+	resync time.Duration
+	stopCh <-chan struct{}
+
+	mutex      sync.Mutex
+	namespaces map[string]*namespaceSecretInformer
+	handlers   []cache.ResourceEventHandler
+	indexers   []cache.Indexer
+}
+
+// namespaceSecretInformer is the secret informer of a namespace, it is stopped by closing stopCh
+type namespaceSecretInformer struct {
+	informer cache.SharedIndexInformer
+	stopCh   chan struct{}
+}
+
+func NewSecretInformers(client kubernetes.Interface, resync time.Duration, stopCh <-chan struct{}) *SecretInformers {
+	return &SecretInformers{
+		client:     client,
+		resync:     resync,
+		stopCh:     stopCh,
+		namespaces: map[string]*namespaceSecretInformer{},
+	}
+}
+
+var _ = secretGetter(&SecretInformers{})
+
+// AddReferences requeues the keys of the objects in the indexer when the secrets that they reference are changed, the
+// indexer has the secretReferenceIndex, and its referenced namespaces are kept watched
+func (s *SecretInformers) AddReferences(indexer cache.Indexer, queue workqueue.Interface) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	handler := newSecretEventHandler(indexer, queue)
+	s.handlers = append(s.handlers, handler)
+	s.indexers = append(s.indexers, indexer)
+	for _, namespaceInformer := range s.namespaces {
+		namespaceInformer.informer.AddEventHandler(handler)
+	}
+}
+
+// Get returns a secret, the secrets of its namespace are watched from now on
+func (s *SecretInformers) Get(namespace, name string) (*corev1.Secret, error) {
+	informer := s.informerFor(namespace)
+	if !informer.HasSynced() {
+		return s.client.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	}
+
+	obj, exists, err := informer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+	return obj.(*corev1.Secret), nil
+}
+
+// informerFor returns the secret informer of a namespace, it is started if the namespace is not watched
+func (s *SecretInformers) informerFor(namespace string) cache.SharedIndexInformer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if namespaceInformer, ok := s.namespaces[namespace]; ok {
+		return namespaceInformer.informer
+	}
+
+	klog.Infof("Start watching the secrets of namespace %s", namespace)
+	informer := coreinformers.NewSecretInformer(s.client, namespace, s.resync, cache.Indexers{})
+	for _, handler := range s.handlers {
+		informer.AddEventHandler(handler)
+	}
+	namespaceInformer := &namespaceSecretInformer{informer: informer, stopCh: make(chan struct{})}
+	s.namespaces[namespace] = namespaceInformer
+	go informer.Run(namespaceInformer.stopCh)
+	return informer
+}
+
+// Run stops the secret informers of the namespaces that are not referenced any more until the stop channel is closed
+func (s *SecretInformers) Run() {
+	wait.Until(s.prune, secretNamespacesPrunePeriod, s.stopCh)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for namespace, namespaceInformer := range s.namespaces {
+		close(namespaceInformer.stopCh)
+		delete(s.namespaces, namespace)
+	}
+}
+
+func (s *SecretInformers) prune() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	referenced := sets.NewString()
+	for _, indexer := range s.indexers {
+		for _, secretKey := range indexer.ListIndexFuncValues(secretReferenceIndex) {
+			namespace, _, err := cache.SplitMetaNamespaceKey(secretKey)
+			if err != nil {
+				utilruntime.HandleError(err)
+				continue
+			}
+			referenced.Insert(namespace)
+		}
+	}
+	for namespace, namespaceInformer := range s.namespaces {
+		if referenced.Has(namespace) {
+			continue
+		}
+		klog.Infof("Stop watching the secrets of namespace %s", namespace)
+		close(namespaceInformer.stopCh)
+		delete(s.namespaces, namespace)
+	}
+}
+
+// newSecretEventHandler returns an event handler that requeues the objects referencing a changed secret, so the
+// new client certificate is used without changing the objects
+func newSecretEventHandler(indexer cache.Indexer, queue workqueue.Interface) cache.ResourceEventHandler {
+	enqueueReferences := func(obj interface{}) {
+		secretKey, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+
+		objs, err := indexer.ByIndex(secretReferenceIndex, secretKey)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+		for _, obj := range objs {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil {
+				utilruntime.HandleError(err)
+				continue
+			}
+			queue.Add(key)
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueueReferences,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			enqueueReferences(newObj)
+		},
+		DeleteFunc: enqueueReferences,
+	}
+}
+
+// getTLSSecret returns the client certificate secret of a backend, the returned reason is not empty if the secret
+// is deleted or it does not contain a client certificate, the backend should be unavailable in this case
+func getTLSSecret(secrets secretGetter, namespace, name string) (*corev1.Secret, string, error) {
+	secret, err := secrets.Get(namespace, name)
+	if errors.IsNotFound(err) {
+		return nil, fmt.Sprintf("the secret %s/%s is not found", namespace, name), nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, key := range []string{"tls.crt", "tls.key"} {
+		if len(secret.Data[key]) == 0 {
+			return nil, fmt.Sprintf("the '%s' key is required in secret %s/%s", key, namespace, name), nil
+		}
+	}
+	return secret, "", nil
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestSecretInformers(t *testing.T) {
+	kubeClient := kubefake.NewSimpleClientset(newTLSSecret("certs", "backend-tls"), newTLSSecret("other", "other-tls"))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	secretInformers := NewSecretInformers(kubeClient, 0, stopCh)
+
+	// a configmap that references the secret certs/backend-tls
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		secretReferenceIndex: func(obj interface{}) ([]string, error) {
+			return []string{"certs/backend-tls"}, nil
+		},
+	})
+	if err := indexer.Add(newAggregatorConfigMap("default", "test")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	queue := workqueue.New()
+	defer queue.ShutDown()
+	secretInformers.AddReferences(indexer, queue)
+
+	secret, err := secretInformers.Get("certs", "backend-tls")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(secret.Data["tls.crt"]) != "cert" {
+		t.Errorf("unexpected secret: %#v", secret)
+	}
+	if len(secretInformers.namespaces) != 1 || secretInformers.namespaces["certs"] == nil {
+		t.Fatalf("expected only the secrets of namespace certs are watched, but %v", secretInformers.namespaces)
+	}
+
+	informer := secretInformers.namespaces["certs"].informer
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return informer.HasSynced() && queue.Len() > 0, nil
+	}); err != nil {
+		t.Fatalf("expected the configmap is requeued when the secrets are synced, but %v", err)
+	}
+	key, _ := queue.Get()
+	if key != "default/test" {
+		t.Errorf("expected default/test is requeued, but %v", key)
+	}
+	queue.Done(key)
+
+	// the cached secrets are got after the informer has synced
+	if _, err := secretInformers.Get("certs", "unknown"); !errors.IsNotFound(err) {
+		t.Errorf("expected not found error, but %v", err)
+	}
+
+	// the rotated secret requeues the configmap
+	rotated := newTLSSecret("certs", "backend-tls")
+	rotated.Data["tls.crt"] = []byte("rotated-cert")
+	if _, err := kubeClient.CoreV1().Secrets("certs").Update(rotated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return queue.Len() > 0, nil
+	}); err != nil {
+		t.Fatalf("expected the configmap is requeued when the secret is rotated, but %v", err)
+	}
+
+	// the namespace is not watched when no configmap references it
+	if err := indexer.Delete(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secretInformers.prune()
+	if len(secretInformers.namespaces) != 0 {
+		t.Errorf("expected no namespace is watched, but %v", secretInformers.namespaces)
+	}
+}
@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// warmUp tracks the keys of the objects that are cached when the informers have synced. A controller is warmed up
+// after each of them has been synced once, so it is not ready before the initial service infos are registered.
+type warmUp struct {
+	mutex   sync.Mutex
+	started bool
+	pending sets.String
+}
+
+// start is called with the keys of the cached objects after the informers have synced and before the workers start
+func (w *warmUp) start(keys []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.started = true
+	w.pending = sets.NewString(keys...)
+}
+
+// synced is called after a key is synced, a failed sync also counts since the key is retried by the workqueue
+func (w *warmUp) synced(key string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.started {
+		w.pending.Delete(key)
+	}
+}
+
+// done returns true if the initial keys have been synced
+func (w *warmUp) done() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.started && w.pending.Len() == 0
+}
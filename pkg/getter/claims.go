@@ -0,0 +1,166 @@
+package getter
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog"
+)
+
+// ConflictError is returned when a service info is not routed because an older service info claims the same
+// sub-resource
+type ConflictError struct {
+	SubResource string
+	// Winner is the name of the service info that the sub-resource is routed to
+	Winner string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("the subResource %s is already registered by %s", e.SubResource, e.Winner)
+}
+
+// IsConflict returns true if the error is a ConflictError
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+// AddRegistrationHandler adds a handler that is called with the name of a service info when it is promoted to the
+// routed one of its sub-resource, or it is demoted because an older service info claims the sub-resource. The
+// handlers are not called for the service infos that are added or removed by the caller.
+func (g *AggregatorServiceInfoGetter) AddRegistrationHandler(handler func(serviceInfoName string)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.handlers = append(g.handlers, handler)
+}
+
+// Conflicts returns the names of the service infos that are not routed because of the conflicts, keyed by the
+// names of the service infos that their sub-resources are routed to
+func (g *AggregatorServiceInfoGetter) Conflicts() map[string][]string {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	conflicts := map[string][]string{}
+	for _, claims := range g.claims {
+		for _, claim := range claims[1:] {
+			conflicts[claims[0].Name] = append(conflicts[claims[0].Name], claim.Name)
+		}
+	}
+	return conflicts
+}
+
+// addClaim adds or replaces the claim of a service info and keeps the claims of its sub-resource sorted by the
+// creation timestamps, the names break the ties. It is called with the lock held.
+func (g *AggregatorServiceInfoGetter) addClaim(serviceInfo *AggregatorServiceInfo) {
+	claims := g.claims[serviceInfo.SubResource]
+	replaced := false
+	for i, claim := range claims {
+		if claim.Name == serviceInfo.Name {
+			if !reflect.DeepEqual(claim, serviceInfo) {
+				claims[i] = serviceInfo
+			}
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		claims = append(claims, serviceInfo)
+	}
+
+	sort.SliceStable(claims, func(i, j int) bool {
+		if !claims[i].CreationTimestamp.Equal(claims[j].CreationTimestamp) {
+			return claims[i].CreationTimestamp.Before(claims[j].CreationTimestamp)
+		}
+		return claims[i].Name < claims[j].Name
+	})
+	g.claims[serviceInfo.SubResource] = claims
+	g.subResources[serviceInfo.Name] = serviceInfo.SubResource
+}
+
+// removeClaim removes the claim of a service info from a sub-resource, it is called with the lock held
+func (g *AggregatorServiceInfoGetter) removeClaim(serviceInfoName, subResource string) {
+	claims := g.claims[subResource]
+	for i, claim := range claims {
+		if claim.Name == serviceInfoName {
+			claims = append(claims[:i:i], claims[i+1:]...)
+			break
+		}
+	}
+	if len(claims) == 0 {
+		delete(g.claims, subResource)
+	} else {
+		g.claims[subResource] = claims
+	}
+	delete(g.subResources, serviceInfoName)
+}
+
+// activate routes a sub-resource to its oldest claimant, and returns the names of the service infos that are
+// promoted or demoted. It is called with the lock held.
+func (g *AggregatorServiceInfoGetter) activate(subResource string) []string {
+	var active *AggregatorServiceInfo
+	if claims := g.claims[subResource]; len(claims) > 0 {
+		active = claims[0]
+	}
+	old := g.serviceInfos[subResource]
+	if old == active {
+		return nil
+	}
+
+	changed := []string{}
+	if old != nil {
+		g.transports.evict(old)
+		if active == nil || old.Name != active.Name {
+			g.removeCircuitBreaker(old.Name)
+			g.removeHealthStatus(old.Name)
+			if _, claimed := g.subResources[old.Name]; claimed {
+				// the demoted service info may have claimed another sub-resource, no one is active on this one then
+				if active != nil {
+					klog.Warningf("Aggregator service info %s conflicts with %s on %s", old.Name, active.Name, subResource)
+				}
+				changed = append(changed, old.Name)
+			}
+		}
+	}
+
+	switch {
+	case active == nil:
+		klog.Infof("Delete aggregator service info %s", old.Name)
+		delete(g.serviceInfos, subResource)
+		g.routes.remove(subResource)
+	case old == nil || old.Name != active.Name:
+		klog.Infof("Add aggregator service info %s", active.Name)
+		g.serviceInfos[subResource] = active
+		g.routes.insert(active)
+		g.syncCircuitBreaker(active)
+		g.syncHealthStatus(active)
+		changed = append(changed, active.Name)
+	default:
+		klog.Infof("Update aggregator service info %s", active.Name)
+		g.serviceInfos[subResource] = active
+		g.routes.insert(active)
+		g.syncCircuitBreaker(active)
+		g.syncHealthStatus(active)
+	}
+	g.updateMetrics()
+	return changed
+}
+
+// notify calls the handlers with the changed service infos except the ones that are added or removed by the caller
+func (g *AggregatorServiceInfoGetter) notify(changed []string, excluded ...string) {
+	g.mutex.RLock()
+	handlers := g.handlers
+	g.mutex.RUnlock()
+
+	excludedNames := sets.NewString(excluded...)
+	for _, name := range sets.NewString(changed...).List() {
+		if excludedNames.Has(name) {
+			continue
+		}
+		for _, handler := range handlers {
+			handler(name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package getter
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newClaim(name, subResource string, created time.Time) *AggregatorServiceInfo {
+	serviceInfo := newTestServiceInfo(name, subResource, nil)
+	serviceInfo.CreationTimestamp = created
+	return serviceInfo
+}
+
+func routedName(g *AggregatorServiceInfoGetter, subResource string) string {
+	if serviceInfo := g.GetAggregatorServiceInfo(subResource); serviceInfo != nil {
+		return serviceInfo.Name
+	}
+	return ""
+}
+
+func TestOldestClaimWins(t *testing.T) {
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+
+	g := NewAggregatorServiceInfoGetter()
+	notified := []string{}
+	g.AddRegistrationHandler(func(serviceInfoName string) {
+		notified = append(notified, serviceInfoName)
+	})
+
+	// the newer one is registered first, and it is demoted when the older one is added
+	if err := g.AddAggregatorServiceInfo(newClaim("default/newer", "sub", newer)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := g.AddAggregatorServiceInfo(newClaim("default/older", "sub", older)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name := routedName(g, "sub"); name != "default/older" {
+		t.Errorf("expected sub is routed to default/older, but %q", name)
+	}
+	if !reflect.DeepEqual(notified, []string{"default/newer"}) {
+		t.Errorf("expected default/newer is notified, but %v", notified)
+	}
+
+	// the resync of the loser does not change the routing
+	err := g.AddAggregatorServiceInfo(newClaim("default/newer", "sub", newer))
+	if !IsConflict(err) {
+		t.Errorf("expected conflict error, but %v", err)
+	}
+	if conflict, ok := err.(*ConflictError); ok && conflict.Winner != "default/older" {
+		t.Errorf("expected the winner default/older, but %s", conflict.Winner)
+	}
+	if conflicts := g.Conflicts(); !reflect.DeepEqual(conflicts, map[string][]string{"default/older": {"default/newer"}}) {
+		t.Errorf("unexpected conflicts: %v", conflicts)
+	}
+
+	// the loser is promoted when the winner is removed
+	notified = []string{}
+	g.RemoveAggregatorServiceInfo("default/older")
+	if name := routedName(g, "sub"); name != "default/newer" {
+		t.Errorf("expected sub is routed to default/newer, but %q", name)
+	}
+	if !reflect.DeepEqual(notified, []string{"default/newer"}) {
+		t.Errorf("expected default/newer is notified, but %v", notified)
+	}
+	if conflicts := g.Conflicts(); len(conflicts) != 0 {
+		t.Errorf("expected no conflicts, but %v", conflicts)
+	}
+
+	g.RemoveAggregatorServiceInfo("default/newer")
+	if name := routedName(g, "sub"); name != "" {
+		t.Errorf("expected sub is not routed, but %q", name)
+	}
+}
+
+func TestClaimSubResourceChanged(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	g := NewAggregatorServiceInfoGetter()
+	notified := []string{}
+	g.AddRegistrationHandler(func(serviceInfoName string) {
+		notified = append(notified, serviceInfoName)
+	})
+
+	if err := g.AddAggregatorServiceInfo(newClaim("default/a", "sub", created)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := g.AddAggregatorServiceInfo(newClaim("default/b", "sub", created.Add(time.Hour))); !IsConflict(err) {
+		t.Fatalf("expected conflict error, but %v", err)
+	}
+
+	// the winner moves to another sub-resource, the loser is promoted
+	if err := g.AddAggregatorServiceInfo(newClaim("default/a", "other", created)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name := routedName(g, "sub"); name != "default/b" {
+		t.Errorf("expected sub is routed to default/b, but %q", name)
+	}
+	if name := routedName(g, "other"); name != "default/a" {
+		t.Errorf("expected other is routed to default/a, but %q", name)
+	}
+	if !reflect.DeepEqual(notified, []string{"default/b"}) {
+		t.Errorf("expected default/b is notified, but %v", notified)
+	}
+}
+
+func TestServiceInfoStatuses(t *testing.T) {
+	older := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	g := NewAggregatorServiceInfoGetter()
+	unavailable := newClaim("default/unavailable", "logs", older)
+	unavailable.UnavailableReason = "the secret default/tls is not found"
+	for _, serviceInfo := range []*AggregatorServiceInfo{
+		newClaim("default/older", "sub", older),
+		newClaim("default/newer", "sub", older.Add(time.Hour)),
+		unavailable,
+	} {
+		if err := g.AddAggregatorServiceInfo(serviceInfo); err != nil && !IsConflict(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	statuses := g.ServiceInfoStatuses()
+	if len(statuses) != 3 {
+		t.Fatalf("expected 3 statuses, but %#v", statuses)
+	}
+	if s := statuses[0]; s.Name != "default/newer" || s.Registered || s.Usable || s.Reason == "" {
+		t.Errorf("expected default/newer is not registered, but %#v", s)
+	}
+	if s := statuses[1]; s.Name != "default/older" || !s.Registered || !s.Usable || s.Backend == "" {
+		t.Errorf("expected default/older is usable, but %#v", s)
+	}
+	if s := statuses[2]; s.Name != "default/unavailable" || !s.Registered || s.Usable || s.Reason != unavailable.UnavailableReason {
+		t.Errorf("expected default/unavailable is not usable, but %#v", s)
+	}
+}
+
+func TestActivateReleasedSubResource(t *testing.T) {
+	g := NewAggregatorServiceInfoGetter()
+	if err := g.AddAggregatorServiceInfo(newClaim("default/a", "sub", time.Now())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the only claim is released while the service info is still claiming, e.g. it moves to another sub-resource
+	g.mutex.Lock()
+	g.claims["sub"] = nil
+	changed := g.activate("sub")
+	g.mutex.Unlock()
+	if !reflect.DeepEqual(changed, []string{"default/a"}) {
+		t.Errorf("expected default/a is changed, but %v", changed)
+	}
+	if name := routedName(g, "sub"); name != "" {
+		t.Errorf("expected sub is not routed, but %q", name)
+	}
+}
@@ -1,67 +1,347 @@
 package getter
 
 import (
-	"reflect"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/skeeey/aggregator-proxy-server/pkg/circuitbreaker"
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+	"github.com/skeeey/aggregator-proxy-server/pkg/retry"
+	proxyutil "k8s.io/apimachinery/pkg/util/proxy"
 	"k8s.io/client-go/rest"
-	"k8s.io/klog"
 )
 
+// The placements of the cluster name in an upstream request when UseID is true
+const (
+	// IDPlacementPath inserts the cluster name as a path segment after the RootPath
+	IDPlacementPath = "path"
+	// IDPlacementQuery adds the cluster name as the ClusterNameQueryParameter query parameter
+	IDPlacementQuery = "query"
+	// IDPlacementHeader sets the cluster name to the ClusterNameHeader header
+	IDPlacementHeader = "header"
+)
+
+// The modes to forward the authenticated user to an aggregator service
+const (
+	// IdentityForwardingNone does not forward the user, the service only sees the client certificate of the proxy
+	IdentityForwardingNone = "none"
+	// IdentityForwardingImpersonation sets the Impersonate-User, Impersonate-Group and Impersonate-Extra-* headers,
+	// e.g. for kube-apiserver backends
+	IdentityForwardingImpersonation = "impersonation"
+	// IdentityForwardingFrontProxy sets the X-Remote-User, X-Remote-Group and X-Remote-Extra-* headers
+	IdentityForwardingFrontProxy = "front-proxy"
+)
+
+const (
+	ClusterNameQueryParameter = "cluster"
+	ClusterNameHeader         = "X-Cluster-Name"
+)
+
+// ProxyMethods are the HTTP methods that can be proxied to the aggregator services
+var ProxyMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
 type AggregatorServiceInfo struct {
 	Name             string
 	SubResource      string
 	ServiceName      string
 	ServiceNamespace string
 	ServicePort      string
-	RootPath         string
-	UseID            bool
-	RestConfig       *rest.Config
+	// Address is the host:port that the requests are sent to instead of the service DNS name, e.g. a backend of
+	// a static file outside of the cluster, the requests are not routed to the endpoints of the service
+	Address     string
+	RootPath    string
+	UseID       bool
+	IDPlacement string
+	// IdentityForwarding is how the authenticated user is forwarded to the service
+	IdentityForwarding string
+	// AllowedMethods is the HTTP methods that the service allows, all ProxyMethods are allowed if it is empty
+	AllowedMethods []string
+	// AllowedPaths and DeniedPaths are the prefixes or the glob patterns of the upstream paths that the requests
+	// can be proxied to, all paths under the RootPath are allowed if both are empty
+	AllowedPaths []string
+	DeniedPaths  []string
+	// CircuitBreaker is the thresholds of the circuit breaker of the service, the requests are always proxied if
+	// it is nil
+	CircuitBreaker *circuitbreaker.Config
+	// RetryPolicy is the retry policy of the service, the requests are not retried if it is nil
+	RetryPolicy *retry.Policy
+	// HealthCheck is the active health check of the service, the service is not probed if it is nil
+	HealthCheck *health.Config
+	RestConfig  *rest.Config
+	// CreationTimestamp is when the service is registered, the oldest service is routed if the services claim the
+	// same sub-resource
+	CreationTimestamp time.Time
+	// UnavailableReason is the reason why the requests cannot be proxied to the service, e.g. the client
+	// certificate secret is deleted, it is empty if the service is available
+	UnavailableReason string
+}
+
+// Host returns the host:port that the requests are sent to, it is the Address or the service DNS name
+func (i *AggregatorServiceInfo) Host() string {
+	if i.Address != "" {
+		return i.Address
+	}
+	return net.JoinHostPort(fmt.Sprintf("%s.%s.svc", i.ServiceName, i.ServiceNamespace), i.ServicePort)
+}
+
+// Allows returns true if the HTTP method is allowed by the service
+func (i *AggregatorServiceInfo) Allows(method string) bool {
+	for _, allowed := range i.Methods() {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Methods returns the HTTP methods that the service allows
+func (i *AggregatorServiceInfo) Methods() []string {
+	if len(i.AllowedMethods) == 0 {
+		return ProxyMethods
+	}
+	return i.AllowedMethods
 }
 
 type AggregatorServiceInfoGetter struct {
-	mutex        sync.RWMutex
+	mutex sync.RWMutex
+	// serviceInfos are the routed service infos keyed by their sub-resources, and routes route the request
+	// paths to them by the longest sub-resource prefix
 	serviceInfos map[string]*AggregatorServiceInfo
+	routes       *routeTable
+	// claims are all service infos of the sub-resources, the oldest first, and subResources are the sub-resources
+	// that the service infos claim, keyed by the service info names
+	claims       map[string][]*AggregatorServiceInfo
+	subResources map[string]string
+	// handlers are notified when the service infos are promoted to or demoted from the routed ones
+	handlers   []func(serviceInfoName string)
+	transports *transportCache
+	// breakers are the circuit breakers of the services, keyed by the service info names, a breaker is kept when
+	// its service info is updated without changing the thresholds
+	breakers map[string]*circuitbreaker.Breaker
+	// health are the health states of the probed services, keyed by the service info names, a state is kept when
+	// its service info is updated without changing the health check
+	health map[string]*health.Status
 }
 
 func NewAggregatorServiceInfoGetter() *AggregatorServiceInfoGetter {
 	return &AggregatorServiceInfoGetter{
 		serviceInfos: make(map[string]*AggregatorServiceInfo),
+		routes:       newRouteTable(),
+		claims:       make(map[string][]*AggregatorServiceInfo),
+		subResources: make(map[string]string),
+		transports:   newTransportCache(),
+		breakers:     make(map[string]*circuitbreaker.Breaker),
+		health:       make(map[string]*health.Status),
+	}
+}
+
+// GetAggregatorServiceInfo returns the service info that a sub-resource path is routed to, the path is the part of
+// the request path after aggregator, e.g. metrics/v1/pods, and it is routed to the longest registered sub-resource
+// that is a prefix of it
+func (g *AggregatorServiceInfoGetter) GetAggregatorServiceInfo(subResourcePath string) *AggregatorServiceInfo {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return g.routes.lookup(subResourcePath)
+}
+
+// GetTransport returns the cached transport of an aggregator service info, the transport is reused until the
+// service info is replaced or removed
+func (g *AggregatorServiceInfoGetter) GetTransport(serviceInfo *AggregatorServiceInfo) (http.RoundTripper, error) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	if g.serviceInfos[serviceInfo.SubResource] != serviceInfo {
+		// the service info was replaced or removed after it was got, do not cache a transport for it
+		return rest.TransportFor(restConfigFor(serviceInfo))
+	}
+
+	cached, err := g.transports.get(serviceInfo)
+	if err != nil {
+		return nil, err
 	}
+	return cached.roundTripper, nil
+}
+
+// GetUpgradeTransport returns the cached transport of an aggregator service info for the upgrade requests,
+// e.g. websocket and SPDY, the upgraded connections are dialed with the client certificate of the service
+func (g *AggregatorServiceInfoGetter) GetUpgradeTransport(
+	serviceInfo *AggregatorServiceInfo) (proxyutil.UpgradeRequestRoundTripper, error) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	var cached *cachedTransport
+	var err error
+	if g.serviceInfos[serviceInfo.SubResource] != serviceInfo {
+		// the service info was replaced or removed after it was got, do not cache a transport for it
+		cached, err = newTransport(restConfigFor(serviceInfo))
+	} else {
+		cached, err = g.transports.get(serviceInfo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cached.upgradeTransport, nil
+}
+
+// GetCircuitBreaker returns the circuit breaker of an aggregator service info, it is nil if the service has no
+// circuit breaker
+func (g *AggregatorServiceInfoGetter) GetCircuitBreaker(serviceInfo *AggregatorServiceInfo) *circuitbreaker.Breaker {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return g.breakers[serviceInfo.Name]
 }
 
-func (g *AggregatorServiceInfoGetter) GetAggregatorServiceInfo(subResource string) *AggregatorServiceInfo {
+// CircuitBreakers returns the observed states of the circuit breakers, sorted by the service info names
+func (g *AggregatorServiceInfoGetter) CircuitBreakers() []circuitbreaker.Snapshot {
 	g.mutex.RLock()
 	defer g.mutex.RUnlock()
 
-	return g.serviceInfos[subResource]
+	snapshots := []circuitbreaker.Snapshot{}
+	for _, breaker := range g.breakers {
+		snapshots = append(snapshots, breaker.Snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots
+}
+
+// AddAggregatorServiceInfo adds or updates a service info as a claimant of its sub-resource, the oldest claimant
+// of a sub-resource is routed. It returns a ConflictError if the service info is not routed because an older
+// service info claims the same sub-resource, the service info is promoted when the older ones are removed.
+func (g *AggregatorServiceInfoGetter) AddAggregatorServiceInfo(serviceInfo *AggregatorServiceInfo) error {
+	g.mutex.Lock()
+	changed, err := g.add(serviceInfo)
+	g.mutex.Unlock()
+
+	g.notify(changed, serviceInfo.Name)
+	return err
+}
+
+func (g *AggregatorServiceInfoGetter) RemoveAggregatorServiceInfo(serviceInfoName string) {
+	g.mutex.Lock()
+	changed := g.remove(serviceInfoName)
+	g.mutex.Unlock()
+
+	g.notify(changed, serviceInfoName)
 }
 
-func (g *AggregatorServiceInfoGetter) AddAggregatorServiceInfo(serviceInfo *AggregatorServiceInfo) {
+// ApplyAggregatorServiceInfos removes and adds the service infos at once, so the requests are never routed to a
+// part of them. It returns the ConflictErrors of the added service infos that are not routed.
+func (g *AggregatorServiceInfoGetter) ApplyAggregatorServiceInfos(
+	removed []string, added []*AggregatorServiceInfo) []error {
 	g.mutex.Lock()
-	defer g.mutex.Unlock()
+	changed := []string{}
+	applied := append([]string{}, removed...)
+	for _, serviceInfoName := range removed {
+		changed = append(changed, g.remove(serviceInfoName)...)
+	}
+	errs := []error{}
+	for _, serviceInfo := range added {
+		addChanged, err := g.add(serviceInfo)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		changed = append(changed, addChanged...)
+		applied = append(applied, serviceInfo.Name)
+	}
+	g.mutex.Unlock()
+
+	g.notify(changed, applied...)
+	return errs
+}
+
+// add adds a service info and returns the names of the other service infos that are promoted or demoted, it is
+// called with the lock held
+func (g *AggregatorServiceInfoGetter) add(serviceInfo *AggregatorServiceInfo) ([]string, error) {
+	changed := []string{}
+	if subResource, existed := g.subResources[serviceInfo.Name]; existed && subResource != serviceInfo.SubResource {
+		// the sub-resource of the service info is changed, its old sub-resource is released to the other claimants
+		g.removeClaim(serviceInfo.Name, subResource)
+		changed = append(changed, g.activate(subResource)...)
+	}
+	g.addClaim(serviceInfo)
+	changed = append(changed, g.activate(serviceInfo.SubResource)...)
+
+	if winner := g.serviceInfos[serviceInfo.SubResource]; winner.Name != serviceInfo.Name {
+		return changed, &ConflictError{SubResource: serviceInfo.SubResource, Winner: winner.Name}
+	}
+	return changed, nil
+}
+
+// remove removes a service info and returns the names of the service infos that are promoted, it is called with
+// the lock held
+func (g *AggregatorServiceInfoGetter) remove(serviceInfoName string) []string {
+	subResource, existed := g.subResources[serviceInfoName]
+	if !existed {
+		return nil
+	}
+	g.removeClaim(serviceInfoName, subResource)
+	return g.activate(subResource)
+}
 
-	if old, existed := g.serviceInfos[serviceInfo.SubResource]; existed {
-		if !reflect.DeepEqual(old, serviceInfo) {
-			klog.Infof("Update aggregator service info %s", serviceInfo.Name)
-			g.serviceInfos[serviceInfo.SubResource] = serviceInfo
+// syncCircuitBreaker creates the circuit breaker of a service info, the breaker is recreated only if the thresholds
+// are changed, it is called with the lock held
+func (g *AggregatorServiceInfoGetter) syncCircuitBreaker(serviceInfo *AggregatorServiceInfo) {
+	if serviceInfo.CircuitBreaker == nil {
+		g.removeCircuitBreaker(serviceInfo.Name)
+		return
+	}
+
+	if breaker, ok := g.breakers[serviceInfo.Name]; ok {
+		if breaker.Config() == serviceInfo.CircuitBreaker.Complete() {
+			return
 		}
+		breaker.Close()
+	}
+	g.breakers[serviceInfo.Name] = circuitbreaker.New(serviceInfo.Name, *serviceInfo.CircuitBreaker)
+}
+
+// removeCircuitBreaker removes the circuit breaker of a service info, it is called with the lock held
+func (g *AggregatorServiceInfoGetter) removeCircuitBreaker(serviceInfoName string) {
+	if breaker, ok := g.breakers[serviceInfoName]; ok {
+		breaker.Close()
+		delete(g.breakers, serviceInfoName)
+	}
+}
+
+// syncHealthStatus creates the health state of a service info, the state is recreated only if the health check is
+// changed, it is called with the lock held
+func (g *AggregatorServiceInfoGetter) syncHealthStatus(serviceInfo *AggregatorServiceInfo) {
+	if serviceInfo.HealthCheck == nil {
+		g.removeHealthStatus(serviceInfo.Name)
 		return
 	}
 
-	klog.Infof("Add aggregator service info %s", serviceInfo.Name)
-	g.serviceInfos[serviceInfo.SubResource] = serviceInfo
+	if status, ok := g.health[serviceInfo.Name]; ok {
+		if status.Config() == serviceInfo.HealthCheck.Complete() {
+			return
+		}
+		status.Close()
+	}
+	g.health[serviceInfo.Name] = health.NewStatus(serviceInfo.Name, *serviceInfo.HealthCheck)
 }
 
-func (g *AggregatorServiceInfoGetter) RemoveAggregatorServiceInfo(serviceInfoName string) {
-	g.mutex.Lock()
-	defer g.mutex.Unlock()
+// removeHealthStatus removes the health state of a service info, it is called with the lock held
+func (g *AggregatorServiceInfoGetter) removeHealthStatus(serviceInfoName string) {
+	if status, ok := g.health[serviceInfoName]; ok {
+		status.Close()
+		delete(g.health, serviceInfoName)
+	}
+}
 
-	for key, serviceInfo := range g.serviceInfos {
-		if serviceInfo.Name == serviceInfoName {
-			klog.Infof("Delete aggregator service info %s", serviceInfoName)
-			delete(g.serviceInfos, key)
-			break
+// updateMetrics counts the registered aggregator services, it is called with the lock held
+func (g *AggregatorServiceInfoGetter) updateMetrics() {
+	available := 0
+	for _, serviceInfo := range g.serviceInfos {
+		if serviceInfo.UnavailableReason == "" {
+			available++
 		}
 	}
+	metrics.SetAggregatorServices(available, len(g.serviceInfos)-available)
 }
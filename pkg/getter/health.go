@@ -0,0 +1,91 @@
+package getter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"k8s.io/klog"
+)
+
+// HealthSummary is the health of the probed aggregator services
+type HealthSummary struct {
+	// Probed is the number of the routed services that have a health check
+	Probed int
+	// Unhealthy are the sub-resources of the unhealthy services, sorted
+	Unhealthy []string
+	// LastTransitionTime is the latest time that a probed service became healthy or unhealthy
+	LastTransitionTime time.Time
+}
+
+// GetHealthStatus returns the health state of an aggregator service info, it is nil if the service has no health
+// check
+func (g *AggregatorServiceInfoGetter) GetHealthStatus(serviceInfo *AggregatorServiceInfo) *health.Status {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return g.health[serviceInfo.Name]
+}
+
+// HealthStatuses returns the observed health of the probed services, sorted by the service info names
+func (g *AggregatorServiceInfoGetter) HealthStatuses() []health.Snapshot {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	snapshots := []health.Snapshot{}
+	for _, status := range g.health {
+		snapshots = append(snapshots, status.Snapshot())
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name < snapshots[j].Name })
+	return snapshots
+}
+
+// ProbeTargets returns the backends of the routed service infos that have a health check, the unavailable ones are
+// not probed since the requests are not proxied to them anyway
+func (g *AggregatorServiceInfoGetter) ProbeTargets() []health.Target {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	targets := []health.Target{}
+	for _, serviceInfo := range g.serviceInfos {
+		status, ok := g.health[serviceInfo.Name]
+		if !ok || serviceInfo.UnavailableReason != "" {
+			continue
+		}
+		cached, err := g.transports.get(serviceInfo)
+		if err != nil {
+			klog.Errorf("failed to build the transport to probe aggregator service info %s: %v", serviceInfo.Name, err)
+			continue
+		}
+		targets = append(targets, health.Target{
+			Status:    status,
+			URL:       "https://" + serviceInfo.Host() + status.Config().Path,
+			Transport: cached.roundTripper,
+		})
+	}
+	return targets
+}
+
+// HealthSummary returns the health of the routed service infos that have a health check
+func (g *AggregatorServiceInfoGetter) HealthSummary() HealthSummary {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	summary := HealthSummary{}
+	for subResource, serviceInfo := range g.serviceInfos {
+		status, ok := g.health[serviceInfo.Name]
+		if !ok {
+			continue
+		}
+		summary.Probed++
+		snapshot := status.Snapshot()
+		if !snapshot.Healthy {
+			summary.Unhealthy = append(summary.Unhealthy, subResource)
+		}
+		if snapshot.LastTransitionTime.After(summary.LastTransitionTime) {
+			summary.LastTransitionTime = snapshot.LastTransitionTime
+		}
+	}
+	sort.Strings(summary.Unhealthy)
+	return summary
+}
@@ -0,0 +1,68 @@
+package getter
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+)
+
+func newProbedServiceInfo(name, subResource string) *AggregatorServiceInfo {
+	serviceInfo := newTestServiceInfo(name, subResource, nil)
+	serviceInfo.HealthCheck = &health.Config{Path: "/healthz", FailureThreshold: 1}
+	return serviceInfo
+}
+
+func TestHealthStatus(t *testing.T) {
+	g := NewAggregatorServiceInfoGetter()
+	metrics := newProbedServiceInfo("default/metrics", "metrics")
+	unavailable := newProbedServiceInfo("default/logs", "logs")
+	unavailable.UnavailableReason = "the secret default/tls is not found"
+	for _, serviceInfo := range []*AggregatorServiceInfo{metrics, unavailable, newTestServiceInfo("default/sub", "sub", nil)} {
+		if err := g.AddAggregatorServiceInfo(serviceInfo); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// the unavailable services and the services without a health check are not probed
+	targets := g.ProbeTargets()
+	if len(targets) != 1 || targets[0].URL != "https://backend.default.svc:443/healthz" {
+		t.Fatalf("expected default/metrics is probed, but %#v", targets)
+	}
+	status := g.GetHealthStatus(metrics)
+	if targets[0].Status != status {
+		t.Errorf("expected the target has the health state of default/metrics")
+	}
+
+	status.Record(fmt.Errorf("connection refused"))
+	summary := g.HealthSummary()
+	if summary.Probed != 2 || !reflect.DeepEqual(summary.Unhealthy, []string{"metrics"}) {
+		t.Errorf("expected metrics is unhealthy, but %#v", summary)
+	}
+	for _, s := range g.ServiceInfoStatuses() {
+		if s.Name == "default/metrics" && (s.Usable || s.Reason != "the backend is unhealthy") {
+			t.Errorf("expected default/metrics is not usable, but %#v", s)
+		}
+	}
+
+	// the health state is kept if the health check is not changed
+	updated := newProbedServiceInfo("default/metrics", "metrics")
+	g.AddAggregatorServiceInfo(updated)
+	if g.GetHealthStatus(updated) != status {
+		t.Errorf("expected the health state is kept")
+	}
+
+	// the health state is recreated if the health check is changed
+	updated = newProbedServiceInfo("default/metrics", "metrics")
+	updated.HealthCheck.Path = "/readyz"
+	g.AddAggregatorServiceInfo(updated)
+	if recreated := g.GetHealthStatus(updated); recreated == status || !recreated.Healthy() {
+		t.Errorf("expected a new healthy state, but %#v", recreated)
+	}
+
+	g.RemoveAggregatorServiceInfo("default/metrics")
+	if statuses := g.HealthStatuses(); len(statuses) != 1 || statuses[0].Name != "default/logs" {
+		t.Errorf("expected only default/logs has a health state, but %#v", statuses)
+	}
+}
@@ -0,0 +1,106 @@
+package getter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// routeTable routes the sub-resource paths of the requests to the aggregator services, a sub-resource may have
+// multiple segments, e.g. metrics/v1, and a path is routed to the service of its longest sub-resource prefix
+type routeTable struct {
+	root *routeNode
+}
+
+// routeNode is a path segment of the route table, it has a service info if a sub-resource ends with the segment
+type routeNode struct {
+	children    map[string]*routeNode
+	serviceInfo *AggregatorServiceInfo
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{root: &routeNode{}}
+}
+
+// insert adds the service info by its sub-resource, it replaces the service info that has the same sub-resource
+func (t *routeTable) insert(serviceInfo *AggregatorServiceInfo) {
+	node := t.root
+	for _, segment := range splitSubResource(serviceInfo.SubResource) {
+		child, ok := node.children[segment]
+		if !ok {
+			if node.children == nil {
+				node.children = map[string]*routeNode{}
+			}
+			child = &routeNode{}
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.serviceInfo = serviceInfo
+}
+
+// remove deletes the service info of a sub-resource, and prunes the segments that have no routes any more
+func (t *routeTable) remove(subResource string) {
+	segments := splitSubResource(subResource)
+	nodes := []*routeNode{t.root}
+	node := t.root
+	for _, segment := range segments {
+		child, ok := node.children[segment]
+		if !ok {
+			return
+		}
+		nodes = append(nodes, child)
+		node = child
+	}
+	node.serviceInfo = nil
+
+	for i := len(segments); i > 0; i-- {
+		if nodes[i].serviceInfo != nil || len(nodes[i].children) != 0 {
+			return
+		}
+		delete(nodes[i-1].children, segments[i-1])
+	}
+}
+
+// lookup returns the service info of the longest sub-resource that is a prefix of the path by segments, e.g.
+// metrics/v1/pods is routed to metrics/v1 rather than metrics, it returns nil if no sub-resource matches
+func (t *routeTable) lookup(subResourcePath string) *AggregatorServiceInfo {
+	var matched *AggregatorServiceInfo
+	node := t.root
+	rest := strings.Trim(subResourcePath, "/")
+	for rest != "" {
+		segment := rest
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			segment, rest = rest[:i], rest[i+1:]
+		} else {
+			rest = ""
+		}
+
+		child, ok := node.children[segment]
+		if !ok {
+			break
+		}
+		node = child
+		if node.serviceInfo != nil {
+			matched = node.serviceInfo
+		}
+	}
+	return matched
+}
+
+func splitSubResource(subResource string) []string {
+	return strings.Split(strings.Trim(subResource, "/"), "/")
+}
+
+// ValidateSubResource returns an error if a sub-resource is not a path of one or more non-empty segments, the
+// segments cannot be . or ..
+func ValidateSubResource(subResource string) error {
+	if subResource == "" {
+		return fmt.Errorf("the subResource is required")
+	}
+	for _, segment := range strings.Split(subResource, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("the subResource %q has an invalid segment %q", subResource, segment)
+		}
+	}
+	return nil
+}
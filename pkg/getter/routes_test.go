@@ -0,0 +1,130 @@
+package getter
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRouteAggregatorServiceInfo(t *testing.T) {
+	g := NewAggregatorServiceInfoGetter()
+	for name, subResource := range map[string]string{
+		"default/metrics":    "metrics",
+		"default/metrics-v1": "metrics/v1",
+		"default/search":     "apps/search",
+		"default/logs":       "apps/logs",
+	} {
+		if err := g.AddAggregatorServiceInfo(newTestServiceInfo(name, subResource, nil)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	cases := []struct {
+		subResourcePath string
+		expectedName    string
+	}{
+		{subResourcePath: "metrics", expectedName: "default/metrics"},
+		{subResourcePath: "metrics/v2/pods", expectedName: "default/metrics"},
+		{subResourcePath: "metrics/v1", expectedName: "default/metrics-v1"},
+		{subResourcePath: "metrics/v1/pods/", expectedName: "default/metrics-v1"},
+		{subResourcePath: "metrics/v10", expectedName: "default/metrics"},
+		{subResourcePath: "apps/search/q", expectedName: "default/search"},
+		{subResourcePath: "apps/logs", expectedName: "default/logs"},
+		{subResourcePath: "apps", expectedName: ""},
+		{subResourcePath: "apps/other", expectedName: ""},
+		{subResourcePath: "unknown", expectedName: ""},
+		{subResourcePath: "", expectedName: ""},
+	}
+	for _, c := range cases {
+		var name string
+		if serviceInfo := g.GetAggregatorServiceInfo(c.subResourcePath); serviceInfo != nil {
+			name = serviceInfo.Name
+		}
+		if name != c.expectedName {
+			t.Errorf("expected %s is routed to %q, but %q", c.subResourcePath, c.expectedName, name)
+		}
+	}
+
+	g.RemoveAggregatorServiceInfo("default/metrics-v1")
+	if serviceInfo := g.GetAggregatorServiceInfo("metrics/v1/pods"); serviceInfo == nil || serviceInfo.Name != "default/metrics" {
+		t.Errorf("expected metrics/v1/pods is routed to default/metrics, but %#v", serviceInfo)
+	}
+	g.RemoveAggregatorServiceInfo("default/search")
+	if serviceInfo := g.GetAggregatorServiceInfo("apps/logs/q"); serviceInfo == nil || serviceInfo.Name != "default/logs" {
+		t.Errorf("expected apps/logs/q is routed to default/logs, but %#v", serviceInfo)
+	}
+}
+
+func TestAddAggregatorServiceInfoConflict(t *testing.T) {
+	g := NewAggregatorServiceInfoGetter()
+	if err := g.AddAggregatorServiceInfo(newTestServiceInfo("default/a", "metrics/v1", nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := g.AddAggregatorServiceInfo(newTestServiceInfo("default/b", "metrics/v1", nil)); err == nil {
+		t.Errorf("expected conflict error, but failed")
+	}
+	if serviceInfo := g.GetAggregatorServiceInfo("metrics/v1"); serviceInfo == nil || serviceInfo.Name != "default/a" {
+		t.Errorf("expected metrics/v1 is routed to default/a, but %#v", serviceInfo)
+	}
+
+	// the sub-resource of a service info is changed, the old one is released to the other claimant
+	if err := g.AddAggregatorServiceInfo(newTestServiceInfo("default/a", "metrics/v2", nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if serviceInfo := g.GetAggregatorServiceInfo("metrics/v1"); serviceInfo == nil || serviceInfo.Name != "default/b" {
+		t.Errorf("expected metrics/v1 is routed to default/b, but %#v", serviceInfo)
+	}
+}
+
+func TestValidateSubResource(t *testing.T) {
+	for subResource, valid := range map[string]bool{
+		"":             false,
+		"metrics":      true,
+		"metrics/v1":   true,
+		"metrics//v1":  false,
+		"metrics/./v1": false,
+		"../metrics":   false,
+	} {
+		if err := ValidateSubResource(subResource); (err == nil) != valid {
+			t.Errorf("expected %q valid %t, but %v", subResource, valid, err)
+		}
+	}
+}
+
+func newBenchmarkGetter(b *testing.B, services int) *AggregatorServiceInfoGetter {
+	g := NewAggregatorServiceInfoGetter()
+	for i := 0; i < services; i++ {
+		subResource := fmt.Sprintf("group%d/service%d", i%10, i)
+		if err := g.AddAggregatorServiceInfo(newTestServiceInfo(subResource, subResource, nil)); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return g
+}
+
+func BenchmarkGetAggregatorServiceInfo(b *testing.B) {
+	for _, services := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("%d services", services), func(b *testing.B) {
+			g := newBenchmarkGetter(b, services)
+			subResourcePath := fmt.Sprintf("group%d/service%d/api/v1/namespaces/default/pods", (services-1)%10, services-1)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if g.GetAggregatorServiceInfo(subResourcePath) == nil {
+					b.Fatalf("expected %s is routed, but failed", subResourcePath)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetAggregatorServiceInfoParallel(b *testing.B) {
+	g := newBenchmarkGetter(b, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			g.GetAggregatorServiceInfo("group9/service99/api/v1/pods")
+		}
+	})
+}
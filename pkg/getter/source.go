@@ -0,0 +1,13 @@
+package getter
+
+// ServiceInfoSource registers the aggregator service infos of a kind of configuration to the getter, e.g. the
+// AggregatorService resources, the labelled ConfigMaps or a static file
+type ServiceInfoSource interface {
+	// Name is the name of the readiness check of the source
+	Name() string
+	// Run registers the service infos until the source is stopped
+	Run()
+	// HasSynced returns true if the initial service infos have been registered, the server is not ready until all
+	// sources have synced
+	HasSynced() bool
+}
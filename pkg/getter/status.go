@@ -0,0 +1,55 @@
+package getter
+
+import (
+	"sort"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/circuitbreaker"
+)
+
+// ServiceInfoStatus is the registration state of an aggregator service info
+type ServiceInfoStatus struct {
+	Name        string `json:"name"`
+	SubResource string `json:"subResource"`
+	// Backend is the host:port that the requests are sent to
+	Backend string `json:"backend"`
+	// Registered is true if the sub-resource is routed to the service info
+	Registered bool `json:"registered"`
+	// Usable is true if the requests are proxied to the backend
+	Usable bool `json:"usable"`
+	// Reason is why the service info is not registered or not usable
+	Reason string `json:"reason,omitempty"`
+}
+
+// ServiceInfoStatuses returns the states of all service infos, including the ones that are not routed because of
+// the conflicts, sorted by the service info names
+func (g *AggregatorServiceInfoGetter) ServiceInfoStatuses() []ServiceInfoStatus {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	statuses := []ServiceInfoStatus{}
+	for subResource, claims := range g.claims {
+		for i, claim := range claims {
+			status := ServiceInfoStatus{
+				Name:        claim.Name,
+				SubResource: subResource,
+				Backend:     claim.Host(),
+				Registered:  i == 0,
+			}
+			switch {
+			case i > 0:
+				status.Reason = (&ConflictError{SubResource: subResource, Winner: claims[0].Name}).Error()
+			case claim.UnavailableReason != "":
+				status.Reason = claim.UnavailableReason
+			case g.breakers[claim.Name] != nil && g.breakers[claim.Name].Snapshot().State == circuitbreaker.StateOpen:
+				status.Reason = "the circuit breaker is open"
+			case g.health[claim.Name] != nil && !g.health[claim.Name].Healthy():
+				status.Reason = "the backend is unhealthy"
+			default:
+				status.Usable = true
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
@@ -0,0 +1,142 @@
+package getter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	proxyutil "k8s.io/apimachinery/pkg/util/proxy"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	idleConnsPerHost = 25
+	idleConnTimeout  = 90 * time.Second
+)
+
+// transportCache caches the backend transports of aggregator service infos, so the connections (and their
+// TLS sessions) to a backend are reused across the proxied requests
+type transportCache struct {
+	mutex      sync.Mutex
+	transports map[*AggregatorServiceInfo]*cachedTransport
+}
+
+type cachedTransport struct {
+	roundTripper http.RoundTripper
+	transport    *http.Transport
+	// upgradeTransport dials the upgraded connections, e.g. websocket and SPDY, with the client certificate
+	upgradeTransport proxyutil.UpgradeRequestRoundTripper
+	upgradeConn      *http.Transport
+}
+
+func newTransportCache() *transportCache {
+	return &transportCache{
+		transports: make(map[*AggregatorServiceInfo]*cachedTransport),
+	}
+}
+
+// get returns the transports of the service info, the transports are built at the first time
+func (c *transportCache) get(serviceInfo *AggregatorServiceInfo) (*cachedTransport, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if cached, ok := c.transports[serviceInfo]; ok {
+		return cached, nil
+	}
+
+	cached, err := newTransport(restConfigFor(serviceInfo))
+	if err != nil {
+		return nil, err
+	}
+	c.transports[serviceInfo] = cached
+	return cached, nil
+}
+
+// evict removes the transport of the service info from the cache and closes its idle connections
+func (c *transportCache) evict(serviceInfo *AggregatorServiceInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cached, ok := c.transports[serviceInfo]
+	if !ok {
+		return
+	}
+	delete(c.transports, serviceInfo)
+	cached.transport.CloseIdleConnections()
+	cached.upgradeConn.CloseIdleConnections()
+}
+
+// restConfigFor returns the rest config to access the backend of a service info, the server certificate is always
+// verified with the service DNS name, even if the requests are sent to the endpoints of the service directly, or
+// with the host of the Address if it is set
+func restConfigFor(serviceInfo *AggregatorServiceInfo) *rest.Config {
+	config := rest.CopyConfig(serviceInfo.RestConfig)
+	if config.ServerName == "" && serviceInfo.Address != "" {
+		config.ServerName, _, _ = net.SplitHostPort(serviceInfo.Address)
+	}
+	if config.ServerName == "" {
+		config.ServerName = fmt.Sprintf("%s.%s.svc", serviceInfo.ServiceName, serviceInfo.ServiceNamespace)
+	}
+	return config
+}
+
+// newTransport builds a dedicated transport for a rest config, unlike rest.TransportFor, the transport is not
+// shared by the configs that have same TLS options, so its idle connections can be closed safely
+func newTransport(config *rest.Config) (*cachedTransport, error) {
+	tlsConfig, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	dial := config.Dial
+	if dial == nil {
+		dial = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	transport := utilnet.SetTransportDefaults(&http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: idleConnsPerHost,
+		IdleConnTimeout:     idleConnTimeout,
+		DialContext:         dial,
+		DisableCompression:  config.DisableCompression,
+	})
+
+	roundTripper, err := rest.HTTPWrappersForConfig(config, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	// an upgraded connection cannot be served with http/2, so the upgrade connections only negotiate http/1.1,
+	// the headers of the config, e.g. the bearer token, are written to the upgrade requests by the wrappers
+	var upgradeTLSConfig *tls.Config
+	if tlsConfig != nil {
+		upgradeTLSConfig = tlsConfig.Clone()
+		upgradeTLSConfig.NextProtos = []string{"http/1.1"}
+	}
+	upgradeConn := utilnet.SetTransportDefaults(&http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     upgradeTLSConfig,
+		DialContext:         dial,
+	})
+	upgrader, err := rest.HTTPWrappersForConfig(config, proxyutil.MirrorRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cachedTransport{
+		roundTripper:     roundTripper,
+		transport:        transport,
+		upgradeTransport: proxyutil.NewUpgradeRequestRoundTripper(upgradeConn, upgrader),
+		upgradeConn:      upgradeConn,
+	}, nil
+}
@@ -0,0 +1,133 @@
+package getter
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func newTestServiceInfo(name, subResource string, dial func(ctx context.Context, network, address string) (net.Conn, error)) *AggregatorServiceInfo {
+	return &AggregatorServiceInfo{
+		Name:             name,
+		SubResource:      subResource,
+		ServiceName:      "backend",
+		ServiceNamespace: "default",
+		ServicePort:      "443",
+		RestConfig: &rest.Config{
+			TLSClientConfig: rest.TLSClientConfig{Insecure: true},
+			Dial:            dial,
+		},
+	}
+}
+
+func TestTransportCache(t *testing.T) {
+	g := NewAggregatorServiceInfoGetter()
+
+	serviceInfo := newTestServiceInfo("default/test", "sub", nil)
+	g.AddAggregatorServiceInfo(serviceInfo)
+
+	transport, err := g.GetTransport(serviceInfo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cachedTransport, err := g.GetTransport(serviceInfo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if transport != cachedTransport {
+		t.Errorf("expected the transport is reused")
+	}
+
+	// an equal service info does not replace the cached one
+	g.AddAggregatorServiceInfo(newTestServiceInfo("default/test", "sub", nil))
+	if _, ok := g.transports.transports[serviceInfo]; !ok {
+		t.Errorf("expected the transport is kept for an unchanged service info")
+	}
+
+	updatedServiceInfo := newTestServiceInfo("default/test", "sub", nil)
+	updatedServiceInfo.ServicePort = "8443"
+	g.AddAggregatorServiceInfo(updatedServiceInfo)
+	if _, ok := g.transports.transports[serviceInfo]; ok {
+		t.Errorf("expected the transport is evicted after the service info is replaced")
+	}
+
+	// the replaced service info is not cached again
+	if _, err := g.GetTransport(serviceInfo); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := g.transports.transports[serviceInfo]; ok {
+		t.Errorf("expected no transport is cached for a replaced service info")
+	}
+
+	updatedTransport, err := g.GetTransport(updatedServiceInfo)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updatedTransport == transport {
+		t.Errorf("expected a new transport for the updated service info")
+	}
+
+	g.RemoveAggregatorServiceInfo("default/test")
+	if len(g.transports.transports) != 0 {
+		t.Errorf("expected the transport is evicted after the service info is removed")
+	}
+}
+
+func newBenchmarkBackend() (*httptest.Server, *AggregatorServiceInfo) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	backendAddr := backend.Listener.Addr().String()
+	serviceInfo := newTestServiceInfo("default/bench", "bench", func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, backendAddr)
+	})
+	return backend, serviceInfo
+}
+
+func roundTrip(b *testing.B, transport http.RoundTripper) {
+	req, _ := http.NewRequest(http.MethodGet, "https://backend.default.svc/", nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		b.Fatalf("unexpected error: %v", err)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func BenchmarkCachedTransport(b *testing.B) {
+	backend, serviceInfo := newBenchmarkBackend()
+	defer backend.Close()
+
+	g := NewAggregatorServiceInfoGetter()
+	g.AddAggregatorServiceInfo(serviceInfo)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		transport, err := g.GetTransport(serviceInfo)
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		roundTrip(b, transport)
+	}
+}
+
+func BenchmarkTransportPerRequest(b *testing.B) {
+	backend, serviceInfo := newBenchmarkBackend()
+	defer backend.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cached, err := newTransport(serviceInfo.RestConfig)
+		if err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+		roundTrip(b, cached.roundTripper)
+		cached.transport.CloseIdleConnections()
+	}
+}
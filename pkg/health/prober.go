@@ -0,0 +1,165 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// DefaultConcurrency is the number of the backends that are probed concurrently by default
+const DefaultConcurrency = 10
+
+const (
+	// jitterFactor spreads the probes of a backend over [period, period * (1 + jitterFactor))
+	jitterFactor = 0.2
+	// targetsSyncPeriod is how often the probed backends are synced with the registered aggregator services
+	targetsSyncPeriod = time.Second
+)
+
+// Target is a backend to probe
+type Target struct {
+	// Status records the results of the probes, a backend is probed by one worker until its status is replaced
+	Status *Status
+	// URL is the health check url of the backend
+	URL string
+	// Transport sends the probes with the TLS config of the aggregator service
+	Transport http.RoundTripper
+}
+
+// Prober probes the backends of the aggregator services periodically. The first probe of a backend is delayed by
+// a random part of its period and the later ones are jittered, and at most concurrency backends are probed at the
+// same time, so a large number of backends are not probed at once.
+type Prober struct {
+	targets func() []Target
+	tokens  chan struct{}
+
+	mutex   sync.Mutex
+	current map[*Status]Target
+	workers map[*Status]chan struct{}
+}
+
+// NewProber returns a prober of the targets, the targets are got again when they are synced
+func NewProber(targets func() []Target, concurrency int) *Prober {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	return &Prober{
+		targets: targets,
+		tokens:  make(chan struct{}, concurrency),
+		current: map[*Status]Target{},
+		workers: map[*Status]chan struct{}{},
+	}
+}
+
+// Run probes the targets until the stop channel is closed
+func (p *Prober) Run(stopCh <-chan struct{}) {
+	klog.Info("Starting aggregator service health prober")
+	wait.Until(func() { p.sync(stopCh) }, targetsSyncPeriod, stopCh)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for status, workerStopCh := range p.workers {
+		close(workerStopCh)
+		delete(p.workers, status)
+	}
+	klog.Info("Shutting aggregator service health prober")
+}
+
+// sync starts the workers of the new targets and stops the workers of the removed targets, the workers of the
+// existing targets probe with their latest urls and transports
+func (p *Prober) sync(stopCh <-chan struct{}) {
+	targets := p.targets()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.current = map[*Status]Target{}
+	for _, target := range targets {
+		p.current[target.Status] = target
+		if _, ok := p.workers[target.Status]; ok {
+			continue
+		}
+		workerStopCh := make(chan struct{})
+		p.workers[target.Status] = workerStopCh
+		go p.runWorker(target.Status, workerStopCh, stopCh)
+	}
+	for status, workerStopCh := range p.workers {
+		if _, ok := p.current[status]; !ok {
+			close(workerStopCh)
+			delete(p.workers, status)
+		}
+	}
+}
+
+func (p *Prober) runWorker(status *Status, workerStopCh, stopCh <-chan struct{}) {
+	period := status.Config().Period
+	select {
+	case <-time.After(time.Duration(rand.Int63n(int64(period)))):
+	case <-workerStopCh:
+		return
+	case <-stopCh:
+		return
+	}
+
+	wait.JitterUntil(func() {
+		p.probe(status, workerStopCh)
+	}, period, jitterFactor, true, workerStopCh)
+}
+
+// probe waits for a token of the concurrency and probes the latest target of the status
+func (p *Prober) probe(status *Status, workerStopCh <-chan struct{}) {
+	select {
+	case p.tokens <- struct{}{}:
+		defer func() { <-p.tokens }()
+	case <-workerStopCh:
+		return
+	}
+
+	p.mutex.Lock()
+	target, ok := p.current[status]
+	p.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	err := Probe(target, status.Config().Timeout)
+	if status.Record(err) {
+		if status.Healthy() {
+			klog.Infof("The aggregator service %s is healthy", status.Name())
+		} else {
+			klog.Warningf("The aggregator service %s is unhealthy: %v", status.Name(), err)
+		}
+	}
+}
+
+// Probe sends a GET request to the health check url of a target, it returns an error if the backend cannot be
+// connected or does not respond with a 2xx or 3xx code in time
+func Probe(target Target, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := target.Transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// read a part of the body, so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("the health check %s responded with %d", target.URL, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestProbe(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	cases := map[string]bool{"/healthz": true, "/readyz": false, "/slow": false}
+	for path, healthy := range cases {
+		err := Probe(Target{URL: backend.URL + path, Transport: backend.Client().Transport}, 50*time.Millisecond)
+		if healthy != (err == nil) {
+			t.Errorf("expected %s healthy %v, but %v", path, healthy, err)
+		}
+	}
+}
+
+func TestProberConcurrency(t *testing.T) {
+	var inFlight, maxInFlight, probes int32
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(20 * time.Millisecond)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	var mutex sync.Mutex
+	targets := []Target{}
+	for i := 0; i < 6; i++ {
+		targets = append(targets, Target{
+			Status:    NewStatus("default/sub", Config{Path: "/healthz", Period: 50 * time.Millisecond, FailureThreshold: 1}),
+			URL:       backend.URL + "/healthz",
+			Transport: backend.Client().Transport,
+		})
+	}
+	prober := NewProber(func() []Target {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return targets
+	}, 2)
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go prober.Run(stopCh)
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		for _, target := range targets {
+			if target.Status.Healthy() {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("expected all backends become unhealthy, but %v", err)
+	}
+	if max := atomic.LoadInt32(&maxInFlight); max > 2 {
+		t.Errorf("expected at most 2 concurrent probes, but %d", max)
+	}
+
+	// the removed targets are not probed any more
+	mutex.Lock()
+	targets = nil
+	mutex.Unlock()
+	time.Sleep(2 * targetsSyncPeriod)
+	stopped := atomic.LoadInt32(&probes)
+	time.Sleep(200 * time.Millisecond)
+	if current := atomic.LoadInt32(&probes); current != stopped {
+		t.Errorf("expected the removed targets are not probed, but %d more probes", current-stopped)
+	}
+}
@@ -0,0 +1,164 @@
+package health
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+)
+
+const (
+	DefaultPeriod           = 10 * time.Second
+	DefaultTimeout          = 3 * time.Second
+	DefaultSuccessThreshold = 1
+	DefaultFailureThreshold = 3
+)
+
+// Config is the active health check of an aggregator service
+type Config struct {
+	// Path is the path on the backend that is probed with GET, a 2xx or 3xx response is a success
+	Path string
+	// Period is how often the backend is probed
+	Period time.Duration
+	// Timeout is how long a probe waits for the response
+	Timeout time.Duration
+	// SuccessThreshold is the number of the consecutive successes that mark an unhealthy backend healthy
+	SuccessThreshold int
+	// FailureThreshold is the number of the consecutive failures that mark a healthy backend unhealthy
+	FailureThreshold int
+}
+
+// Complete returns the config with the defaults of the unset fields
+func (c Config) Complete() Config {
+	if c.Period <= 0 {
+		c.Period = DefaultPeriod
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = DefaultTimeout
+	}
+	if c.SuccessThreshold <= 0 {
+		c.SuccessThreshold = DefaultSuccessThreshold
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+	return c
+}
+
+// Snapshot is the observed health of a backend
+type Snapshot struct {
+	Name                 string     `json:"name"`
+	Healthy              bool       `json:"healthy"`
+	ConsecutiveSuccesses int        `json:"consecutiveSuccesses"`
+	ConsecutiveFailures  int        `json:"consecutiveFailures"`
+	LastError            string     `json:"lastError,omitempty"`
+	LastProbeTime        *time.Time `json:"lastProbeTime,omitempty"`
+	LastTransitionTime   time.Time  `json:"lastTransitionTime"`
+}
+
+// Status is the health of the backend of an aggregator service, the backend is healthy until the probes fail
+// FailureThreshold times in a row, so a new backend is routed before it is probed
+type Status struct {
+	name   string
+	config Config
+	now    func() time.Time
+
+	mutex          sync.Mutex
+	healthy        bool
+	successes      int
+	failures       int
+	lastError      string
+	lastProbe      time.Time
+	lastTransition time.Time
+}
+
+// NewStatus returns the healthy status of a backend, the defaults are used for the unset fields of the config
+func NewStatus(name string, config Config) *Status {
+	s := &Status{
+		name:    name,
+		config:  config.Complete(),
+		now:     time.Now,
+		healthy: true,
+	}
+	s.lastTransition = s.now()
+	metrics.SetBackendHealth(name, true)
+	return s
+}
+
+// Name returns the name of the aggregator service
+func (s *Status) Name() string {
+	return s.name
+}
+
+// Config returns the health check of the backend
+func (s *Status) Config() Config {
+	return s.config
+}
+
+// Healthy returns true if the requests can be proxied to the backend
+func (s *Status) Healthy() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.healthy
+}
+
+// Record records the result of a probe, the probe is failed if err is not nil. It returns true if the health is
+// changed by the probe.
+func (s *Status) Record(err error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	metrics.RecordHealthProbe(s.name, err == nil)
+	s.lastProbe = s.now()
+	if err == nil {
+		s.successes++
+		s.failures = 0
+		s.lastError = ""
+	} else {
+		s.failures++
+		s.successes = 0
+		s.lastError = err.Error()
+	}
+
+	switch {
+	case !s.healthy && s.successes >= s.config.SuccessThreshold:
+		s.setHealthy(true)
+		return true
+	case s.healthy && s.failures >= s.config.FailureThreshold:
+		s.setHealthy(false)
+		return true
+	}
+	return false
+}
+
+func (s *Status) setHealthy(healthy bool) {
+	s.healthy = healthy
+	s.lastTransition = s.now()
+	metrics.SetBackendHealth(s.name, healthy)
+}
+
+// Snapshot returns the observed health of the backend
+func (s *Status) Snapshot() Snapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot := Snapshot{
+		Name:                 s.name,
+		Healthy:              s.healthy,
+		ConsecutiveSuccesses: s.successes,
+		ConsecutiveFailures:  s.failures,
+		LastError:            s.lastError,
+		LastTransitionTime:   s.lastTransition,
+	}
+	if !s.lastProbe.IsZero() {
+		lastProbe := s.lastProbe
+		snapshot.LastProbeTime = &lastProbe
+	}
+	return snapshot
+}
+
+// Close deletes the metrics of the backend when its aggregator service is not probed any more
+func (s *Status) Close() {
+	metrics.DeleteBackendHealth(s.name)
+}
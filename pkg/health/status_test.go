@@ -0,0 +1,58 @@
+package health
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStatusThresholds(t *testing.T) {
+	now := time.Now()
+	s := NewStatus("default/sub", Config{Path: "/healthz", SuccessThreshold: 2, FailureThreshold: 3})
+	s.now = func() time.Time { return now }
+
+	if !s.Healthy() {
+		t.Errorf("expected a new backend is healthy")
+	}
+
+	// the backend is not unhealthy until it fails the failure threshold times in a row
+	s.Record(fmt.Errorf("connection refused"))
+	s.Record(fmt.Errorf("connection refused"))
+	s.Record(nil)
+	s.Record(fmt.Errorf("connection refused"))
+	if s.Record(fmt.Errorf("connection refused")) || !s.Healthy() {
+		t.Errorf("expected the backend is still healthy")
+	}
+	now = now.Add(time.Minute)
+	if !s.Record(fmt.Errorf("connection refused")) || s.Healthy() {
+		t.Errorf("expected the backend becomes unhealthy")
+	}
+
+	snapshot := s.Snapshot()
+	if snapshot.ConsecutiveFailures != 3 || snapshot.LastError != "connection refused" ||
+		!snapshot.LastTransitionTime.Equal(now) || snapshot.LastProbeTime == nil {
+		t.Errorf("unexpected snapshot %#v", snapshot)
+	}
+
+	// the backend is healthy again after the success threshold
+	if s.Record(nil) || s.Healthy() {
+		t.Errorf("expected the backend is still unhealthy")
+	}
+	if !s.Record(nil) || !s.Healthy() {
+		t.Errorf("expected the backend becomes healthy")
+	}
+}
+
+func TestConfigComplete(t *testing.T) {
+	config := Config{Path: "/healthz", Period: time.Minute}.Complete()
+	expected := Config{
+		Path:             "/healthz",
+		Period:           time.Minute,
+		Timeout:          DefaultTimeout,
+		SuccessThreshold: DefaultSuccessThreshold,
+		FailureThreshold: DefaultFailureThreshold,
+	}
+	if config != expected {
+		t.Errorf("expected config %#v, but %#v", expected, config)
+	}
+}
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+
+	// register the workqueue metrics of the controllers
+	_ "k8s.io/component-base/metrics/prometheus/workqueue"
+)
+
+const namespace = "aggregator_proxy"
+
+var (
+	proxyRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "requests_total",
+			Help:           "Number of the requests proxied to the aggregator services, partitioned by sub-resource, cluster, method and response code.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"sub_resource", "cluster", "method", "code"},
+	)
+
+	proxyRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Name:           "request_duration_seconds",
+			Help:           "Latency of the requests proxied to the aggregator services in seconds, partitioned by sub-resource, cluster and method.",
+			Buckets:        []float64{0.005, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"sub_resource", "cluster", "method"},
+	)
+
+	proxyResponseSize = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Name:           "response_size_bytes",
+			Help:           "Size of the responses of the aggregator services in bytes, partitioned by sub-resource, cluster and method.",
+			Buckets:        metrics.ExponentialBuckets(256, 4, 8),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"sub_resource", "cluster", "method"},
+	)
+
+	aggregatorServices = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Name:           "aggregator_services",
+			Help:           "Number of the registered aggregator services, partitioned by whether the services are available.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"available"},
+	)
+
+	controllerSyncErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "controller_sync_errors_total",
+			Help:           "Number of the failed syncs of the aggregator service controllers, partitioned by controller.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"controller"},
+	)
+
+	controllerSyncDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace:      namespace,
+			Name:           "controller_sync_duration_seconds",
+			Help:           "Duration of the syncs of the aggregator service controllers in seconds, partitioned by controller.",
+			Buckets:        metrics.ExponentialBuckets(0.001, 2, 15),
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"controller"},
+	)
+
+	circuitBreakerState = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Name:           "circuit_breaker_state",
+			Help:           "State of the circuit breakers of the aggregator services, 0 is closed, 1 is half-open and 2 is open.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service"},
+	)
+
+	circuitBreakerRejections = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "circuit_breaker_rejected_requests_total",
+			Help:           "Number of the requests rejected by the circuit breakers of the aggregator services, partitioned by service.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service"},
+	)
+
+	retries = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "retries_total",
+			Help:           "Number of the retried requests to the aggregator services, partitioned by service.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service"},
+	)
+
+	retryBudgetExhausted = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "retry_budget_exhausted_total",
+			Help:           "Number of the requests to the aggregator services that are not retried because the retry budget is exhausted, partitioned by service.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service"},
+	)
+
+	backendHealth = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      namespace,
+			Name:           "backend_healthy",
+			Help:           "Health of the probed aggregator services, 1 is healthy and 0 is unhealthy.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service"},
+	)
+
+	healthProbes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      namespace,
+			Name:           "health_probes_total",
+			Help:           "Number of the health probes of the aggregator services, partitioned by service and result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"service", "result"},
+	)
+
+	registerMetrics sync.Once
+)
+
+// Register registers the metrics of the proxy and the controllers to the legacy registry that is served on the
+// /metrics endpoint of the generic apiserver, the metrics are not recorded until they are registered
+func Register() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(proxyRequests)
+		legacyregistry.MustRegister(proxyRequestDuration)
+		legacyregistry.MustRegister(proxyResponseSize)
+		legacyregistry.MustRegister(aggregatorServices)
+		legacyregistry.MustRegister(controllerSyncErrors)
+		legacyregistry.MustRegister(controllerSyncDuration)
+		legacyregistry.MustRegister(circuitBreakerState)
+		legacyregistry.MustRegister(circuitBreakerRejections)
+		legacyregistry.MustRegister(retries)
+		legacyregistry.MustRegister(retryBudgetExhausted)
+		legacyregistry.MustRegister(backendHealth)
+		legacyregistry.MustRegister(healthProbes)
+	})
+}
+
+// RecordProxyRequest records a request that is proxied to the aggregator service of a sub-resource
+func RecordProxyRequest(subResource, cluster, method string, code int, responseSize int64, elapsed time.Duration) {
+	proxyRequests.WithLabelValues(subResource, cluster, method, strconv.Itoa(code)).Inc()
+	proxyRequestDuration.WithLabelValues(subResource, cluster, method).Observe(elapsed.Seconds())
+	proxyResponseSize.WithLabelValues(subResource, cluster, method).Observe(float64(responseSize))
+}
+
+// SetAggregatorServices sets the number of the available and unavailable aggregator services
+func SetAggregatorServices(available, unavailable int) {
+	aggregatorServices.WithLabelValues("true").Set(float64(available))
+	aggregatorServices.WithLabelValues("false").Set(float64(unavailable))
+}
+
+// RecordControllerSync records a sync of a controller, the sync is failed if err is not nil
+func RecordControllerSync(controller string, err error, elapsed time.Duration) {
+	controllerSyncDuration.WithLabelValues(controller).Observe(elapsed.Seconds())
+	if err != nil {
+		controllerSyncErrors.WithLabelValues(controller).Inc()
+	}
+}
+
+// SetCircuitBreakerState sets the state of the circuit breaker of an aggregator service
+func SetCircuitBreakerState(service string, state int) {
+	circuitBreakerState.WithLabelValues(service).Set(float64(state))
+}
+
+// RecordCircuitBreakerRejection records a request rejected by the circuit breaker of an aggregator service
+func RecordCircuitBreakerRejection(service string) {
+	circuitBreakerRejections.WithLabelValues(service).Inc()
+}
+
+// DeleteCircuitBreaker deletes the metrics of the circuit breaker of a removed aggregator service
+func DeleteCircuitBreaker(service string) {
+	circuitBreakerState.Delete(map[string]string{"service": service})
+	circuitBreakerRejections.Delete(map[string]string{"service": service})
+}
+
+// RecordRetry records a retried request to an aggregator service
+func RecordRetry(service string) {
+	retries.WithLabelValues(service).Inc()
+}
+
+// RecordRetryBudgetExhausted records a request to an aggregator service that is not retried because of the budget
+func RecordRetryBudgetExhausted(service string) {
+	retryBudgetExhausted.WithLabelValues(service).Inc()
+}
+
+// SetBackendHealth sets the health of a probed aggregator service
+func SetBackendHealth(service string, healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	backendHealth.WithLabelValues(service).Set(value)
+}
+
+// RecordHealthProbe records a health probe of an aggregator service
+func RecordHealthProbe(service string, succeeded bool) {
+	result := "success"
+	if !succeeded {
+		result = "failure"
+	}
+	healthProbes.WithLabelValues(service, result).Inc()
+}
+
+// DeleteBackendHealth deletes the health metrics of an aggregator service that is not probed any more
+func DeleteBackendHealth(service string) {
+	backendHealth.Delete(map[string]string{"service": service})
+	for _, result := range []string{"success", "failure"} {
+		healthProbes.Delete(map[string]string{"service": service, "result": result})
+	}
+}
@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestRecordProxyRequest(t *testing.T) {
+	Register()
+
+	RecordProxyRequest("v1", "cluster1", "GET", 200, 100, 10*time.Millisecond)
+	RecordProxyRequest("v1", "cluster1", "GET", 200, 300, 20*time.Millisecond)
+	RecordProxyRequest("v1", "cluster1", "GET", 503, 50, time.Millisecond)
+
+	expected := `
+# HELP aggregator_proxy_requests_total [ALPHA] Number of the requests proxied to the aggregator services, partitioned by sub-resource, cluster, method and response code.
+# TYPE aggregator_proxy_requests_total counter
+aggregator_proxy_requests_total{cluster="cluster1",code="200",method="GET",sub_resource="v1"} 2
+aggregator_proxy_requests_total{cluster="cluster1",code="503",method="GET",sub_resource="v1"} 1
+`
+	if err := testutil.GatherAndCompare(
+		legacyregistry.DefaultGatherer, strings.NewReader(expected), "aggregator_proxy_requests_total"); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
+
+func TestSetAggregatorServices(t *testing.T) {
+	Register()
+
+	SetAggregatorServices(2, 1)
+
+	expected := `
+# HELP aggregator_proxy_aggregator_services [ALPHA] Number of the registered aggregator services, partitioned by whether the services are available.
+# TYPE aggregator_proxy_aggregator_services gauge
+aggregator_proxy_aggregator_services{available="false"} 1
+aggregator_proxy_aggregator_services{available="true"} 2
+`
+	if err := testutil.GatherAndCompare(
+		legacyregistry.DefaultGatherer, strings.NewReader(expected), "aggregator_proxy_aggregator_services"); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
+
+func TestRecordControllerSync(t *testing.T) {
+	Register()
+
+	RecordControllerSync("test", nil, time.Millisecond)
+	RecordControllerSync("test", fmt.Errorf("failed"), time.Millisecond)
+
+	expected := `
+# HELP aggregator_proxy_controller_sync_errors_total [ALPHA] Number of the failed syncs of the aggregator service controllers, partitioned by controller.
+# TYPE aggregator_proxy_controller_sync_errors_total counter
+aggregator_proxy_controller_sync_errors_total{controller="test"} 1
+`
+	if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer,
+		strings.NewReader(expected), "aggregator_proxy_controller_sync_errors_total"); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
+
+func TestCircuitBreakerMetrics(t *testing.T) {
+	Register()
+
+	SetCircuitBreakerState("default/open", 2)
+	RecordCircuitBreakerRejection("default/open")
+	SetCircuitBreakerState("default/removed", 0)
+	DeleteCircuitBreaker("default/removed")
+
+	expected := `
+# HELP aggregator_proxy_circuit_breaker_state [ALPHA] State of the circuit breakers of the aggregator services, 0 is closed, 1 is half-open and 2 is open.
+# TYPE aggregator_proxy_circuit_breaker_state gauge
+aggregator_proxy_circuit_breaker_state{service="default/open"} 2
+# HELP aggregator_proxy_circuit_breaker_rejected_requests_total [ALPHA] Number of the requests rejected by the circuit breakers of the aggregator services, partitioned by service.
+# TYPE aggregator_proxy_circuit_breaker_rejected_requests_total counter
+aggregator_proxy_circuit_breaker_rejected_requests_total{service="default/open"} 1
+`
+	if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(expected),
+		"aggregator_proxy_circuit_breaker_state", "aggregator_proxy_circuit_breaker_rejected_requests_total"); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
+
+func TestRetryMetrics(t *testing.T) {
+	Register()
+
+	RecordRetry("default/retried")
+	RecordRetry("default/retried")
+	RecordRetryBudgetExhausted("default/retried")
+
+	expected := `
+# HELP aggregator_proxy_retries_total [ALPHA] Number of the retried requests to the aggregator services, partitioned by service.
+# TYPE aggregator_proxy_retries_total counter
+aggregator_proxy_retries_total{service="default/retried"} 2
+# HELP aggregator_proxy_retry_budget_exhausted_total [ALPHA] Number of the requests to the aggregator services that are not retried because the retry budget is exhausted, partitioned by service.
+# TYPE aggregator_proxy_retry_budget_exhausted_total counter
+aggregator_proxy_retry_budget_exhausted_total{service="default/retried"} 1
+`
+	if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(expected),
+		"aggregator_proxy_retries_total", "aggregator_proxy_retry_budget_exhausted_total"); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
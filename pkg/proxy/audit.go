@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+)
+
+// The annotations of the audit events of the proxied requests
+const (
+	AuditAnnotationCluster         = "aggregator.open-cluster-management.io/cluster"
+	AuditAnnotationSubResource     = "aggregator.open-cluster-management.io/sub-resource"
+	AuditAnnotationBackend         = "aggregator.open-cluster-management.io/backend"
+	AuditAnnotationUpstreamPath    = "aggregator.open-cluster-management.io/upstream-path"
+	AuditAnnotationUpstreamCode    = "aggregator.open-cluster-management.io/upstream-code"
+	AuditAnnotationUpstreamLatency = "aggregator.open-cluster-management.io/upstream-latency"
+	// AuditAnnotationPathViolation is why a request is rejected by the path confinement or the path rules
+	AuditAnnotationPathViolation = "aggregator.open-cluster-management.io/path-violation"
+	// AuditAnnotationUpstreams is the json list of the upstream requests of a fan-out request
+	AuditAnnotationUpstreams = "aggregator.open-cluster-management.io/upstreams"
+)
+
+// upstreamRequest is what a request to an aggregator service was proxied to, the backend and the path are empty if
+// the request was not proxied, e.g. the service is unavailable
+type upstreamRequest struct {
+	Cluster string `json:"cluster"`
+	Backend string `json:"backend,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Code    int    `json:"code"`
+	Latency string `json:"latency,omitempty"`
+	// PathViolation is why the request is rejected by the path confinement or the path rules
+	PathViolation string `json:"pathViolation,omitempty"`
+}
+
+func newUpstreamRequest(
+	cluster, backend, path string, code int, latency time.Duration, pathViolation string) *upstreamRequest {
+	upstream := &upstreamRequest{Cluster: cluster, Backend: backend, Path: path, Code: code, PathViolation: pathViolation}
+	if backend != "" {
+		upstream.Latency = latency.String()
+	}
+	return upstream
+}
+
+// auditUpstreamRequest annotates the audit event of a request with its upstream request
+func auditUpstreamRequest(ctx context.Context, subResource string, upstream *upstreamRequest) {
+	annotations := map[string]string{
+		AuditAnnotationCluster:      upstream.Cluster,
+		AuditAnnotationSubResource:  subResource,
+		AuditAnnotationUpstreamCode: strconv.Itoa(upstream.Code),
+	}
+	if upstream.Backend != "" {
+		annotations[AuditAnnotationBackend] = upstream.Backend
+		annotations[AuditAnnotationUpstreamPath] = upstream.Path
+		annotations[AuditAnnotationUpstreamLatency] = upstream.Latency
+	}
+	if upstream.PathViolation != "" {
+		annotations[AuditAnnotationPathViolation] = upstream.PathViolation
+	}
+	annotateAuditEvent(ctx, annotations)
+}
+
+// auditFanOutRequest annotates the audit event of a fan-out request with the upstream requests of the clusters
+func auditFanOutRequest(ctx context.Context, subResource string, upstreams []*upstreamRequest) {
+	data, err := json.Marshal(upstreams)
+	if err != nil {
+		klog.Errorf("failed to encode the upstream requests: %v", err)
+		return
+	}
+	annotateAuditEvent(ctx, map[string]string{
+		AuditAnnotationCluster:     "-",
+		AuditAnnotationSubResource: subResource,
+		AuditAnnotationUpstreams:   string(data),
+	})
+}
+
+func annotateAuditEvent(ctx context.Context, annotations map[string]string) {
+	event := request.AuditEventFrom(ctx)
+	if event == nil {
+		return
+	}
+	for key, value := range annotations {
+		audit.LogAnnotation(event, key, value)
+	}
+}
@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// The policies to pick an endpoint of an aggregator service for a request
+const (
+	// PolicyRoundRobin picks the ready endpoints in turn
+	PolicyRoundRobin = "round-robin"
+	// PolicyLeastOutstanding picks the ready endpoint that has the least outstanding requests
+	PolicyLeastOutstanding = "least-outstanding"
+	// PolicyClusterHash picks the ready endpoint by the consistent hash of the cluster name, so the requests of
+	// a cluster are sent to the same endpoint as long as it is ready
+	PolicyClusterHash = "cluster-hash"
+)
+
+// defaultFailureBackoff is how long an endpoint is skipped after a request to it failed
+const defaultFailureBackoff = 30 * time.Second
+
+// EndpointResolver picks a ready endpoint of the backend service for each proxied request, so the requests are sent
+// to the endpoints directly instead of the service DNS name
+type EndpointResolver struct {
+	serviceLister   corelisters.ServiceLister
+	endpointsLister corelisters.EndpointsLister
+	servicesSynced  cache.InformerSynced
+	endpointsSynced cache.InformerSynced
+	policy          string
+	failureBackoff  time.Duration
+	now             func() time.Time
+
+	mutex sync.Mutex
+	// next is the round-robin position of each service
+	next map[string]int
+	// outstanding is the number of the in-flight requests of each endpoint
+	outstanding map[string]int
+	// failures is the last time that a request to an endpoint failed within the backoff
+	failures map[string]time.Time
+}
+
+// NewEndpointResolver returns an endpoint resolver that picks the endpoints with the policy
+func NewEndpointResolver(serviceInformer coreinformers.ServiceInformer,
+	endpointsInformer coreinformers.EndpointsInformer, policy string) (*EndpointResolver, error) {
+	switch policy {
+	case PolicyRoundRobin, PolicyLeastOutstanding, PolicyClusterHash:
+	default:
+		return nil, fmt.Errorf("the load balancing policy %q is not supported", policy)
+	}
+
+	return &EndpointResolver{
+		serviceLister:   serviceInformer.Lister(),
+		endpointsLister: endpointsInformer.Lister(),
+		servicesSynced:  serviceInformer.Informer().HasSynced,
+		endpointsSynced: endpointsInformer.Informer().HasSynced,
+		policy:          policy,
+		failureBackoff:  defaultFailureBackoff,
+		now:             time.Now,
+		next:            map[string]int{},
+		outstanding:     map[string]int{},
+		failures:        map[string]time.Time{},
+	}, nil
+}
+
+// HasSynced returns true if the services and the endpoints have been synced
+func (r *EndpointResolver) HasSynced() bool {
+	return r.servicesSynced() && r.endpointsSynced()
+}
+
+// Resolve picks a ready endpoint (host:port) of the aggregator service for a request of the cluster, the returned
+// release func must be called with whether the request failed after the request is completed
+func (r *EndpointResolver) Resolve(
+	serviceInfo *getter.AggregatorServiceInfo, clusterName string) (string, func(failed bool), error) {
+	addresses, err := r.readyAddresses(serviceInfo)
+	if err != nil {
+		return "", nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.pruneFailures()
+	address := r.pick(serviceInfo.ServiceNamespace+"/"+serviceInfo.ServiceName, clusterName, r.healthy(addresses))
+	r.outstanding[address]++
+
+	release := func(failed bool) {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		if r.outstanding[address]--; r.outstanding[address] <= 0 {
+			delete(r.outstanding, address)
+		}
+		if failed {
+			r.failures[address] = r.now()
+			return
+		}
+		delete(r.failures, address)
+	}
+	return address, release, nil
+}
+
+// readyAddresses returns the sorted addresses of the ready endpoints that serve the port of the aggregator service
+func (r *EndpointResolver) readyAddresses(serviceInfo *getter.AggregatorServiceInfo) ([]string, error) {
+	namespace, name := serviceInfo.ServiceNamespace, serviceInfo.ServiceName
+	service, err := r.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service %s/%s: %v", namespace, name, err)
+	}
+
+	port, err := strconv.Atoi(serviceInfo.ServicePort)
+	if err != nil {
+		return nil, fmt.Errorf("the port %q of service %s/%s is invalid", serviceInfo.ServicePort, namespace, name)
+	}
+	portName, found := "", false
+	for _, servicePort := range service.Spec.Ports {
+		if int(servicePort.Port) == port {
+			portName, found = servicePort.Name, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("the service %s/%s does not have port %d", namespace, name, port)
+	}
+
+	endpoints, err := r.endpointsLister.Endpoints(namespace).Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get endpoints %s/%s: %v", namespace, name, err)
+	}
+
+	addresses := []string{}
+	for _, subset := range endpoints.Subsets {
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name != portName {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				addresses = append(addresses, net.JoinHostPort(address.IP, strconv.Itoa(int(endpointPort.Port))))
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("the service %s/%s does not have ready endpoints", namespace, name)
+	}
+
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// pruneFailures removes the failures that are older than the backoff, they do not skip the endpoints any more and
+// the endpoints may have been removed, it is called with the lock held
+func (r *EndpointResolver) pruneFailures() {
+	for address, failedAt := range r.failures {
+		if r.now().Sub(failedAt) >= r.failureBackoff {
+			delete(r.failures, address)
+		}
+	}
+}
+
+// healthy returns the addresses that did not fail recently, all addresses are returned if all of them failed,
+// it is called with the lock held
+func (r *EndpointResolver) healthy(addresses []string) []string {
+	healthy := []string{}
+	for _, address := range addresses {
+		if failedAt, ok := r.failures[address]; ok && r.now().Sub(failedAt) < r.failureBackoff {
+			continue
+		}
+		healthy = append(healthy, address)
+	}
+	if len(healthy) == 0 {
+		return addresses
+	}
+	return healthy
+}
+
+// pick picks an address with the policy, it is called with the lock held
+func (r *EndpointResolver) pick(serviceKey, clusterName string, addresses []string) string {
+	switch r.policy {
+	case PolicyLeastOutstanding:
+		picked := addresses[0]
+		for _, address := range addresses[1:] {
+			if r.outstanding[address] < r.outstanding[picked] {
+				picked = address
+			}
+		}
+		return picked
+	case PolicyClusterHash:
+		// rendezvous hashing, only the clusters on a removed endpoint are moved to other endpoints
+		var picked string
+		var pickedWeight uint64
+		for _, address := range addresses {
+			hash := fnv.New64a()
+			_, _ = hash.Write([]byte(clusterName + "/" + address))
+			if weight := hash.Sum64(); picked == "" || weight > pickedWeight {
+				picked, pickedWeight = address, weight
+			}
+		}
+		return picked
+	default:
+		next := r.next[serviceKey]
+		r.next[serviceKey] = next + 1
+		return addresses[next%len(addresses)]
+	}
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+)
+
+// newTestEndpointResolver returns a resolver of the backend service in the default namespace, the service port 443
+// is served by the port of the endpoints
+func newTestEndpointResolver(t *testing.T, policy string, port int32, readyIPs ...string) *EndpointResolver {
+	informerFactory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	serviceInformer := informerFactory.Core().V1().Services()
+	endpointsInformer := informerFactory.Core().V1().Endpoints()
+
+	_ = serviceInformer.Informer().GetStore().Add(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "backend"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: "metrics", Port: 8080}, {Name: "https", Port: 443}},
+		},
+	})
+	addresses := []corev1.EndpointAddress{}
+	for _, ip := range readyIPs {
+		addresses = append(addresses, corev1.EndpointAddress{IP: ip})
+	}
+	_ = endpointsInformer.Informer().GetStore().Add(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "backend"},
+		Subsets: []corev1.EndpointSubset{
+			{
+				Addresses:         addresses,
+				NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.100"}},
+				Ports:             []corev1.EndpointPort{{Name: "metrics", Port: 9090}, {Name: "https", Port: port}},
+			},
+		},
+	})
+
+	resolver, err := NewEndpointResolver(serviceInformer, endpointsInformer, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return resolver
+}
+
+func newEndpointsServiceInfo() *getter.AggregatorServiceInfo {
+	return &getter.AggregatorServiceInfo{
+		Name:             "default/sub",
+		SubResource:      "sub",
+		ServiceName:      "backend",
+		ServiceNamespace: "default",
+		ServicePort:      "443",
+	}
+}
+
+func TestEndpointResolverPolicies(t *testing.T) {
+	serviceInfo := newEndpointsServiceInfo()
+
+	t.Run(PolicyRoundRobin, func(t *testing.T) {
+		resolver := newTestEndpointResolver(t, PolicyRoundRobin, 8443, "10.0.0.2", "10.0.0.1")
+		expected := []string{"10.0.0.1:8443", "10.0.0.2:8443", "10.0.0.1:8443"}
+		for _, expectedAddress := range expected {
+			address, release, err := resolver.Resolve(serviceInfo, "cluster1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			release(false)
+			if address != expectedAddress {
+				t.Errorf("expected %s, but %s", expectedAddress, address)
+			}
+		}
+	})
+
+	t.Run(PolicyLeastOutstanding, func(t *testing.T) {
+		resolver := newTestEndpointResolver(t, PolicyLeastOutstanding, 8443, "10.0.0.1", "10.0.0.2")
+		first, releaseFirst, _ := resolver.Resolve(serviceInfo, "cluster1")
+		second, releaseSecond, _ := resolver.Resolve(serviceInfo, "cluster1")
+		if first == second {
+			t.Errorf("expected the outstanding request is not sent to %s again", first)
+		}
+		releaseFirst(false)
+		third, releaseThird, _ := resolver.Resolve(serviceInfo, "cluster1")
+		if third != first {
+			t.Errorf("expected the released endpoint %s, but %s", first, third)
+		}
+		releaseSecond(false)
+		releaseThird(false)
+	})
+
+	t.Run(PolicyClusterHash, func(t *testing.T) {
+		resolver := newTestEndpointResolver(t, PolicyClusterHash, 8443, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+		picked := map[string]string{}
+		for i := 0; i < 3; i++ {
+			for _, clusterName := range []string{"cluster1", "cluster2", "cluster3", "cluster4"} {
+				address, release, _ := resolver.Resolve(serviceInfo, clusterName)
+				release(false)
+				if previous, ok := picked[clusterName]; ok && previous != address {
+					t.Errorf("expected %s is always sent to %s, but %s", clusterName, previous, address)
+				}
+				picked[clusterName] = address
+			}
+		}
+	})
+}
+
+func TestEndpointResolverSkipFailedEndpoints(t *testing.T) {
+	serviceInfo := newEndpointsServiceInfo()
+	resolver := newTestEndpointResolver(t, PolicyRoundRobin, 8443, "10.0.0.1", "10.0.0.2")
+	now := time.Now()
+	resolver.now = func() time.Time { return now }
+
+	failed, release, _ := resolver.Resolve(serviceInfo, "cluster1")
+	release(true)
+	for i := 0; i < 3; i++ {
+		address, release, _ := resolver.Resolve(serviceInfo, "cluster1")
+		release(false)
+		if address == failed {
+			t.Errorf("expected the failed endpoint %s is skipped", failed)
+		}
+	}
+
+	// the failed endpoint is picked again after the backoff
+	now = now.Add(defaultFailureBackoff)
+	picked := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		address, release, _ := resolver.Resolve(serviceInfo, "cluster1")
+		release(false)
+		picked[address] = true
+	}
+	if !picked[failed] {
+		t.Errorf("expected the failed endpoint %s is picked after the backoff, but %v", failed, picked)
+	}
+
+	// the failure of a removed endpoint is pruned after the backoff
+	resolver.failures["10.0.0.3:8443"] = now
+	now = now.Add(defaultFailureBackoff)
+	_, release, _ = resolver.Resolve(serviceInfo, "cluster1")
+	release(false)
+	if len(resolver.failures) != 0 {
+		t.Errorf("expected the failures are pruned, but %v", resolver.failures)
+	}
+}
+
+func TestEndpointResolverNoEndpoints(t *testing.T) {
+	resolver := newTestEndpointResolver(t, PolicyRoundRobin, 8443)
+	if _, _, err := resolver.Resolve(newEndpointsServiceInfo(), "cluster1"); err == nil {
+		t.Errorf("expected error for the service without ready endpoints")
+	}
+
+	serviceInfo := newEndpointsServiceInfo()
+	serviceInfo.ServicePort = "80"
+	if _, _, err := resolver.Resolve(serviceInfo, "cluster1"); err == nil {
+		t.Errorf("expected error for the unknown service port")
+	}
+}
+
+func TestProxyToEndpoints(t *testing.T) {
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	host, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	backendPort, _ := strconv.Atoi(port)
+	resolver := newTestEndpointResolver(t, PolicyRoundRobin, int32(backendPort), host)
+
+	// the backend is only reachable with the endpoint address
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.ServiceName = "backend"
+	serviceInfo.ServicePort = "443"
+	serviceInfo.RestConfig.Dial = nil
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+
+	rest := NewAggregatorProxyRest(
+		serviceInfoGetter, newTestClusterSource("cluster1"), Config{EndpointResolver: resolver})
+	handler, err := rest.Connect(
+		context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"}, &fakeResponder{t: t})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/pods", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, but %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The reasons of the errors of the proxied requests, a reason is the message of the CauseTypeProxyReason cause of the
+// Status details, so the clients can tell apart the errors that have the same code
+const (
+	// ReasonInvalidPath means the request path is not an aggregator sub-resource path
+	ReasonInvalidPath = "InvalidPath"
+	// ReasonAggregatorServiceNotFound means no aggregator service is registered for the sub-resource
+	ReasonAggregatorServiceNotFound = "AggregatorServiceNotFound"
+	// ReasonSubResourceForbidden means the user is not allowed to access the sub-resource that the request is routed to
+	ReasonSubResourceForbidden = "SubResourceForbidden"
+	// ReasonMethodNotAllowed means the method is not allowed by the aggregator service
+	ReasonMethodNotAllowed = "MethodNotAllowed"
+	// ReasonPathNotAllowed means the upstream path escapes from the root path or is rejected by the path rules
+	ReasonPathNotAllowed = "PathNotAllowed"
+	// ReasonAggregatorServiceUnavailable means the aggregator service cannot be used, e.g. its client certificate
+	// secret is not found
+	ReasonAggregatorServiceUnavailable = "AggregatorServiceUnavailable"
+	// ReasonNoAvailableEndpoints means the backend service has no endpoint that can be connected
+	ReasonNoAvailableEndpoints = "NoAvailableEndpoints"
+	// ReasonBackendUnhealthy means the backend fails its health check
+	ReasonBackendUnhealthy = "BackendUnhealthy"
+	// ReasonCircuitBreakerOpen means the circuit breaker of the aggregator service is open
+	ReasonCircuitBreakerOpen = "CircuitBreakerOpen"
+	// ReasonBackendUnreachable means the request cannot be sent to the backend or the backend does not respond
+	ReasonBackendUnreachable = "BackendUnreachable"
+	// ReasonTransportError means the transport to the backend cannot be built, e.g. the client certificate is invalid
+	ReasonTransportError = "TransportError"
+	// ReasonInvalidOptions means the options of the request cannot be handled
+	ReasonInvalidOptions = "InvalidOptions"
+	// ReasonResponseTooLarge means the response of a cluster to a fan-out request exceeds the size limit
+	ReasonResponseTooLarge = "ResponseTooLarge"
+	// ReasonKindMismatch means a cluster responds to a fan-out request with another kind than the other clusters
+	ReasonKindMismatch = "KindMismatch"
+)
+
+const (
+	// CauseTypeProxyReason is the cause type of the reason of a proxy error
+	CauseTypeProxyReason metav1.CauseType = "AggregatorProxyReason"
+	// CauseTypeSubResource is the cause type of the aggregator sub-resource of a proxy error
+	CauseTypeSubResource metav1.CauseType = "AggregatorSubResource"
+)
+
+// statusReasons are the Status reasons of the codes of the proxy errors
+var statusReasons = map[int32]metav1.StatusReason{
+	http.StatusForbidden:           metav1.StatusReasonForbidden,
+	http.StatusNotFound:            metav1.StatusReasonNotFound,
+	http.StatusMethodNotAllowed:    metav1.StatusReasonMethodNotAllowed,
+	http.StatusInternalServerError: metav1.StatusReasonInternalError,
+	http.StatusServiceUnavailable:  metav1.StatusReasonServiceUnavailable,
+}
+
+// newProxyError returns the Status error of a request to the sub-resource of a cluster, the details have the cluster
+// as the name, and the sub-resource and the reason as the causes
+func newProxyError(code int32, reason, clusterName, subResource, message string) *errors.StatusError {
+	statusReason, ok := statusReasons[code]
+	if !ok {
+		statusReason = metav1.StatusReasonUnknown
+	}
+	return &errors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    code,
+		Reason:  statusReason,
+		Message: message,
+		Details: &metav1.StatusDetails{
+			Name:  clusterName,
+			Group: clusterStatusesResource.Group,
+			Kind:  clusterStatusesResource.Resource,
+			Causes: []metav1.StatusCause{
+				{Type: CauseTypeSubResource, Message: subResource},
+				{Type: CauseTypeProxyReason, Message: reason},
+			},
+		},
+	}}
+}
+
+// newServiceUnavailableError returns a 503 error that asks the client to retry after the backend may accept the
+// requests again, e.g. the circuit breaker lets the requests through or the backend is probed again
+func newServiceUnavailableError(
+	reason, clusterName, subResource, message string, retryAfter time.Duration) *errors.StatusError {
+	err := newProxyError(http.StatusServiceUnavailable, reason, clusterName, subResource, message)
+	retryAfterSeconds := int32(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	err.ErrStatus.Details.RetryAfterSeconds = retryAfterSeconds
+	return err
+}
+
+// ReasonForError returns the reason of a proxy error, it is empty if the error is not a proxy error
+func ReasonForError(err error) string {
+	return causeMessage(err, CauseTypeProxyReason)
+}
+
+// SubResourceForError returns the aggregator sub-resource of a proxy error, it is empty if the error is not a proxy
+// error
+func SubResourceForError(err error) string {
+	return causeMessage(err, CauseTypeSubResource)
+}
+
+func causeMessage(err error, causeType metav1.CauseType) string {
+	status, ok := err.(errors.APIStatus)
+	if !ok || status.Status().Details == nil {
+		return ""
+	}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type == causeType {
+			return cause.Message
+		}
+	}
+	return ""
+}
+
+// newUpstreamError returns the 503 error of an upstream request that cannot get a response
+func newUpstreamError(clusterName, subResource string, err error) *errors.StatusError {
+	return newProxyError(http.StatusServiceUnavailable, ReasonBackendUnreachable, clusterName, subResource,
+		fmt.Sprintf("the backend of the aggregator service (%s) is unreachable: %v", subResource, err))
+}
+
+// upstreamErrorResponder responds the errors of the upgrade requests, e.g. the backend cannot be dialed, with the
+// 503 Status
+type upstreamErrorResponder struct {
+	responder   *metricsResponder
+	clusterName string
+	subResource string
+}
+
+func (r *upstreamErrorResponder) Error(_ http.ResponseWriter, _ *http.Request, err error) {
+	if _, ok := err.(errors.APIStatus); ok {
+		r.responder.Error(err)
+		return
+	}
+	r.responder.Error(newUpstreamError(r.clusterName, r.subResource, err))
+}
+
+// upstreamErrorTransport responds the errors of the upstream requests with the 503 Status in json. The proxy
+// transport would respond them with a plain text, and the response is already being proxied, so the Status cannot
+// be negotiated by the responder. The errors are recorded in the responder, so they are counted as failed.
+type upstreamErrorTransport struct {
+	transport   http.RoundTripper
+	responder   *metricsResponder
+	clusterName string
+	subResource string
+}
+
+func (t *upstreamErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+
+	statusErr := newUpstreamError(t.clusterName, t.subResource, err)
+	t.responder.err = statusErr
+	status := statusErr.ErrStatus
+	status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+	body, marshalErr := json.Marshal(&status)
+	if marshalErr != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func (t *upstreamErrorTransport) WrappedRoundTripper() http.RoundTripper {
+	return t.transport
+}
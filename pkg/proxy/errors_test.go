@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+func TestProxyErrors(t *testing.T) {
+	backend := newEchoBackend()
+	unreachable := newTestServiceInfo(backend, "unreachable")
+	backend.Close()
+
+	unavailable := newTestServiceInfo(backend, "unavailable")
+	unavailable.UnavailableReason = "the secret default/tls is not found"
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(unreachable)
+	serviceInfoGetter.AddAggregatorServiceInfo(unavailable)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	cases := []struct {
+		subResource    string
+		expectedCode   int32
+		expectedReason string
+	}{
+		{subResource: "unknown", expectedCode: http.StatusNotFound, expectedReason: ReasonAggregatorServiceNotFound},
+		{subResource: "unavailable", expectedCode: http.StatusServiceUnavailable, expectedReason: ReasonAggregatorServiceUnavailable},
+		{subResource: "unreachable", expectedCode: http.StatusServiceUnavailable, expectedReason: ReasonBackendUnreachable},
+	}
+	for _, c := range cases {
+		t.Run(c.subResource, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler, err := rest.Connect(context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"},
+				&statusResponder{fakeResponder: fakeResponder{t: t}, w: w})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testRequestPathPrefix+c.subResource+"/pods", nil))
+
+			err = decodeStatus(t, w)
+			status := err.(errors.APIStatus).Status()
+			if status.Code != c.expectedCode || int(status.Code) != w.Code {
+				t.Errorf("expected status %d, but %d: %s", c.expectedCode, w.Code, w.Body.String())
+			}
+			if reason := ReasonForError(err); reason != c.expectedReason {
+				t.Errorf("expected reason %s, but %s", c.expectedReason, reason)
+			}
+			if subResource := SubResourceForError(err); subResource != c.subResource {
+				t.Errorf("expected sub-resource %s, but %s", c.subResource, subResource)
+			}
+			if status.Details == nil || status.Details.Name != "cluster1" || status.Details.Kind != "clusterstatuses" {
+				t.Errorf("expected the details of cluster1, but %#v", status.Details)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/utils"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/klog"
+)
+
+const (
+	// ClusterAnnotation is added to the merged items of a fan-out request to record their source clusters
+	ClusterAnnotation = "aggregation.open-cluster-management.io/cluster"
+
+	// ClustersQueryParameter selects the clusters of a fan-out request by a comma separated list of cluster names
+	ClustersQueryParameter = "clusters"
+	// ClusterSelectorQueryParameter selects the clusters of a fan-out request by a label selector
+	ClusterSelectorQueryParameter = "clusterSelector"
+
+	// DefaultFanOutConcurrency is the default number of clusters that a fan-out request is sent to concurrently
+	DefaultFanOutConcurrency = 10
+	// DefaultFanOutMaxResponseBytes is the default size limit of the response of a cluster to a fan-out request
+	DefaultFanOutMaxResponseBytes = 16 << 20
+
+	aggregatorSubresource = "aggregator"
+)
+
+var clusterStatusesResource = aggregationv1.Resource("clusterstatuses")
+
+// fanOutList is the response of a fan-out request, the items of the list responses from the clusters are merged,
+// and the other responses are added as items
+type fanOutList struct {
+	APIVersion string                   `json:"apiVersion"`
+	Kind       string                   `json:"kind"`
+	Metadata   map[string]interface{}   `json:"metadata"`
+	Items      []map[string]interface{} `json:"items"`
+	// Failures is the failures of the clusters that the request cannot be proxied to
+	Failures []clusterFailure `json:"failures,omitempty"`
+}
+
+type clusterFailure struct {
+	Cluster string `json:"cluster"`
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
+}
+
+// clusterResponse is the response of a fan-out request from a cluster
+type clusterResponse struct {
+	cluster string
+	body    map[string]interface{}
+	failure *clusterFailure
+	// upstream is the request that was proxied to the cluster, it is nil if the user is not authorized
+	upstream *upstreamRequest
+}
+
+// fanOutHandler sends a GET request to the aggregator sub-resource of all selected clusters concurrently
+type fanOutHandler struct {
+	opts              runtime.Object
+	responder         rest.Responder
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter
+	clusterSource     cluster.Source
+	config            *Config
+}
+
+func (h *fanOutHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		h.responder.Error(errors.NewMethodNotSupported(
+			clusterStatusesResource, fmt.Sprintf("%s on all clusters", req.Method)))
+		return
+	}
+	if httpstream.IsUpgradeRequest(req) {
+		h.responder.Error(errors.NewBadRequest("the connection to all clusters cannot be upgraded"))
+		return
+	}
+
+	clusterNames, err := h.selectClusters(req)
+	if err != nil {
+		h.responder.Error(err)
+		return
+	}
+
+	// the selection parameters are not sent to the backends, the responses are always json to be merged
+	upstreamReq := req.WithContext(req.Context())
+	upstreamURL := *req.URL
+	query := upstreamURL.Query()
+	query.Del(ClustersQueryParameter)
+	query.Del(ClusterSelectorQueryParameter)
+	upstreamURL.RawQuery = query.Encode()
+	upstreamReq.URL = &upstreamURL
+	upstreamReq.Header = utilnet.CloneHeader(req.Header)
+	upstreamReq.Header.Set("Accept", "application/json")
+	upstreamReq.Header.Del("Accept-Encoding")
+
+	// the sub-resource is unknown if the request is not routed, the clusters respond with not found
+	subResource := unknownSubResource
+	if subResourcePath, err := utils.GetSubResourcePath(req.URL.Path); err == nil {
+		if serviceInfo := h.serviceInfoGetter.GetAggregatorServiceInfo(subResourcePath); serviceInfo != nil {
+			subResource = serviceInfo.SubResource
+		}
+	}
+
+	responses := make([]*clusterResponse, len(clusterNames))
+	semaphore := make(chan struct{}, h.config.FanOutConcurrency)
+	var wg sync.WaitGroup
+	for i, clusterName := range clusterNames {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, clusterName string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			responses[i] = h.proxyToCluster(clusterName, subResource, upstreamReq)
+		}(i, clusterName)
+	}
+	wg.Wait()
+
+	upstreams := []*upstreamRequest{}
+	for _, response := range responses {
+		if response.upstream != nil {
+			upstreams = append(upstreams, response.upstream)
+		} else if response.failure != nil {
+			upstreams = append(upstreams, newUpstreamRequest(response.cluster, "", "", int(response.failure.Code), 0, ""))
+		}
+	}
+	auditFanOutRequest(req.Context(), subResource, upstreams)
+
+	responsewriters.WriteRawJSON(http.StatusOK, mergeResponses(subResource, responses), w)
+}
+
+// selectClusters returns the names of the selected clusters, all registered clusters are selected by default
+func (h *fanOutHandler) selectClusters(req *http.Request) ([]string, error) {
+	query := req.URL.Query()
+
+	selector := labels.Everything()
+	if labelSelector := query.Get(ClusterSelectorQueryParameter); labelSelector != "" {
+		var err error
+		if selector, err = labels.Parse(labelSelector); err != nil {
+			return nil, errors.NewBadRequest(fmt.Sprintf("invalid cluster selector %q: %v", labelSelector, err))
+		}
+	}
+
+	names := sets.NewString()
+	if clusters := query.Get(ClustersQueryParameter); clusters != "" {
+		for _, name := range strings.Split(clusters, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names.Insert(name)
+			}
+		}
+	}
+
+	clusters, err := h.clusterSource.List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	clusterNames := []string{}
+	for _, cluster := range clusters {
+		if names.Len() == 0 || names.Has(cluster.Name) {
+			clusterNames = append(clusterNames, cluster.Name)
+		}
+	}
+	return clusterNames, nil
+}
+
+// proxyToCluster sends the request to the aggregator sub-resource of a cluster after the user is authorized
+func (h *fanOutHandler) proxyToCluster(clusterName, subResource string, req *http.Request) *clusterResponse {
+	clusterPath := utils.ReplaceClusterName(req.URL.Path, clusterName)
+	if err := h.authorize(req, clusterName, clusterPath); err != nil {
+		return newClusterFailure(clusterName, err)
+	}
+
+	clusterReq := req.Clone(req.Context())
+	clusterReq.URL.Path = clusterPath
+	clusterReq.URL.RawPath = ""
+	responder := &bufferedResponder{}
+	writer := newBufferedResponseWriter(h.config.FanOutMaxResponseBytes)
+	var upstream *upstreamRequest
+	handler := &proxyRestHandler{
+		clusterName:       clusterName,
+		opts:              h.opts,
+		responder:         responder,
+		serviceInfoGetter: h.serviceInfoGetter,
+		config:            h.config,
+		upstream:          func(u *upstreamRequest) { upstream = u },
+	}
+	aborted := serveBuffered(handler, writer, clusterReq)
+
+	response := h.clusterResponse(clusterName, subResource, responder, writer, aborted)
+	response.upstream = upstream
+	return response
+}
+
+// serveBuffered serves a request with the buffered response writer, it returns true if the response is aborted, e.g.
+// the response exceeds the size limit or the backend fails while the response is copied. The reverse proxy aborts
+// the response by panicking with http.ErrAbortHandler, which is recovered here rather than by the http server,
+// since the clusters are served in their own goroutines.
+func serveBuffered(handler http.Handler, writer *bufferedResponseWriter, req *http.Request) (aborted bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			aborted = true
+		}
+	}()
+	handler.ServeHTTP(writer, req)
+	return false
+}
+
+// clusterResponse returns the response of a cluster from the buffered response
+func (h *fanOutHandler) clusterResponse(clusterName, subResource string,
+	responder *bufferedResponder, writer *bufferedResponseWriter, aborted bool) *clusterResponse {
+	if writer.exceeded {
+		return newClusterFailure(clusterName, newProxyError(http.StatusInternalServerError, ReasonResponseTooLarge,
+			clusterName, subResource, fmt.Sprintf("the response of the aggregator service (%s) exceeds %d bytes",
+				subResource, writer.limit)))
+	}
+	if aborted {
+		return newClusterFailure(clusterName, newUpstreamError(clusterName, subResource,
+			fmt.Errorf("the response is aborted")))
+	}
+	if responder.err != nil {
+		return newClusterFailure(clusterName, responder.err)
+	}
+	if writer.code >= http.StatusBadRequest {
+		return newClusterFailure(clusterName, errorFromResponse(writer.code, writer.body.Bytes()))
+	}
+
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(writer.body.Bytes(), &body); err != nil {
+		return newClusterFailure(clusterName, errors.NewInternalError(fmt.Errorf("the response is not a json object: %v", err)))
+	}
+	return &clusterResponse{cluster: clusterName, body: body}
+}
+
+// authorize checks whether the user of a fan-out request is allowed to access the aggregator sub-resource of a cluster
+func (h *fanOutHandler) authorize(req *http.Request, clusterName, clusterPath string) error {
+	if h.config.Authorizer == nil {
+		return nil
+	}
+
+	user, _ := request.UserFrom(req.Context())
+	attrs := authorizer.AttributesRecord{
+		User:            user,
+		Verb:            "get",
+		APIGroup:        aggregationv1.GroupName,
+		APIVersion:      "v1",
+		Resource:        clusterStatusesResource.Resource,
+		Subresource:     aggregatorSubresource,
+		Name:            clusterName,
+		ResourceRequest: true,
+		Path:            clusterPath,
+	}
+	if requestInfo, ok := request.RequestInfoFrom(req.Context()); ok {
+		attrs.APIVersion = requestInfo.APIVersion
+	}
+
+	decision, reason, err := h.config.Authorizer.Authorize(req.Context(), attrs)
+	if err != nil {
+		klog.Errorf("failed to authorize the fan-out request to cluster %s: %v", clusterName, err)
+	}
+	if decision != authorizer.DecisionAllow {
+		return errors.NewForbidden(clusterStatusesResource, clusterName, fmt.Errorf("%s", reason))
+	}
+	return nil
+}
+
+// mergeResponses merges the responses of the clusters into a list, each item is annotated with its source cluster.
+// Only the responses of the same apiVersion and kind as the first successful response are merged, the clusters that
+// respond with another kind are reported as failures.
+func mergeResponses(subResource string, responses []*clusterResponse) *fanOutList {
+	merged := &fanOutList{
+		APIVersion: "v1",
+		Kind:       "List",
+		Metadata:   map[string]interface{}{},
+		Items:      []map[string]interface{}{},
+	}
+
+	var apiVersion, kind string
+	kindSet := false
+	for _, response := range responses {
+		if response.failure != nil {
+			merged.Failures = append(merged.Failures, *response.failure)
+			continue
+		}
+
+		responseAPIVersion, _ := response.body["apiVersion"].(string)
+		responseKind, _ := response.body["kind"].(string)
+		if !kindSet {
+			apiVersion, kind = responseAPIVersion, responseKind
+			kindSet = true
+		} else if responseAPIVersion != apiVersion || responseKind != kind {
+			mismatch := newClusterFailure(response.cluster, newProxyError(http.StatusInternalServerError,
+				ReasonKindMismatch, response.cluster, subResource, fmt.Sprintf(
+					"the response kind %s (%s) of the aggregator service (%s) does not match the kind %s (%s)",
+					responseKind, responseAPIVersion, subResource, kind, apiVersion)))
+			merged.Failures = append(merged.Failures, *mismatch.failure)
+			continue
+		}
+
+		items, isList := response.body["items"].([]interface{})
+		if !isList {
+			merged.Items = append(merged.Items, annotateCluster(response.body, response.cluster))
+			continue
+		}
+
+		if apiVersion != "" {
+			merged.APIVersion = apiVersion
+		}
+		if kind != "" {
+			merged.Kind = kind
+		}
+		for _, item := range items {
+			if obj, ok := item.(map[string]interface{}); ok {
+				merged.Items = append(merged.Items, annotateCluster(obj, response.cluster))
+			}
+		}
+	}
+	return merged
+}
+
+func annotateCluster(obj map[string]interface{}, clusterName string) map[string]interface{} {
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		obj["metadata"] = metadata
+	}
+	annotations, ok := metadata["annotations"].(map[string]interface{})
+	if !ok {
+		annotations = map[string]interface{}{}
+		metadata["annotations"] = annotations
+	}
+	annotations[ClusterAnnotation] = clusterName
+	return obj
+}
+
+func newClusterFailure(clusterName string, err error) *clusterResponse {
+	status := errors.APIStatus(errors.NewInternalError(err))
+	if apiStatus, ok := err.(errors.APIStatus); ok {
+		status = apiStatus
+	}
+	return &clusterResponse{
+		cluster: clusterName,
+		failure: &clusterFailure{
+			Cluster: clusterName,
+			Code:    status.Status().Code,
+			Message: status.Status().Message,
+		},
+	}
+}
+
+// errorFromResponse returns the error of a failed response, the message of the status is used if the response is a status
+func errorFromResponse(code int, body []byte) error {
+	status := &metav1.Status{}
+	if err := json.Unmarshal(body, status); err == nil && status.Kind == "Status" {
+		status.Code = int32(code)
+		return &errors.StatusError{ErrStatus: *status}
+	}
+	return errors.NewGenericServerResponse(code, "get", clusterStatusesResource, "", strings.TrimSpace(string(body)), 0, false)
+}
+
+// bufferedResponder records the error of a proxied request
+type bufferedResponder struct {
+	err error
+}
+
+func (r *bufferedResponder) Object(statusCode int, obj runtime.Object) {
+	if status, ok := obj.(*metav1.Status); ok {
+		r.err = &errors.StatusError{ErrStatus: *status}
+		return
+	}
+	r.err = errors.NewInternalError(fmt.Errorf("unexpected response %d", statusCode))
+}
+
+func (r *bufferedResponder) Error(err error) {
+	r.err = err
+}
+
+// errResponseTooLarge stops copying a response that exceeds the size limit of the buffered response writer
+var errResponseTooLarge = fmt.Errorf("the response is too large")
+
+// bufferedResponseWriter records a proxied response in memory, the writes fail after the response exceeds the limit
+type bufferedResponseWriter struct {
+	header   http.Header
+	code     int
+	body     bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+func newBufferedResponseWriter(limit int64) *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: http.Header{}, code: http.StatusOK, limit: limit}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(data []byte) (int, error) {
+	if w.exceeded || int64(w.body.Len()+len(data)) > w.limit {
+		w.exceeded = true
+		return 0, errResponseTooLarge
+	}
+	return w.body.Write(data)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(code int) {
+	w.code = code
+}
@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+const testFanOutPathPrefix = "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/-/aggregator/"
+
+// newListBackend returns a backend that lists a configmap of the cluster in the request path, the requests for
+// cluster2 are failed
+func newListBackend() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clusterName := strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]
+		if clusterName == "cluster2" {
+			http.Error(w, "backend is broken", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"apiVersion":"v1","kind":"ConfigMapList","metadata":{},"items":[`+
+			`{"metadata":{"name":"cm-%s","labels":{"query":%q}}}]}`, clusterName, req.URL.RawQuery)
+	}))
+}
+
+func TestFanOut(t *testing.T) {
+	backend := newListBackend()
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.UseID = true
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+
+	// the user is not allowed to access cluster3
+	fakeAuthorizer := authorizer.AuthorizerFunc(func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+		if attrs.GetName() == "cluster3" {
+			return authorizer.DecisionNoOpinion, "no rule", nil
+		}
+		return authorizer.DecisionAllow, "", nil
+	})
+
+	rest := NewAggregatorProxyRest(
+		serviceInfoGetter, newTestClusterSource("cluster1", "cluster2", "cluster3", "cluster4"),
+		Config{Authorizer: fakeAuthorizer, FanOutConcurrency: 2})
+	handler, err := rest.Connect(
+		context.TODO(), "-", &aggregationv1.ClusterStatusProxyOptions{Path: "configmaps"}, &fakeResponder{t: t})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet,
+		testFanOutPathPrefix+"sub/configmaps?labelSelector=a%3Db&clusters=cluster1,cluster2,cluster3", nil)
+	req = req.WithContext(request.WithUser(req.Context(), &user.DefaultInfo{Name: "test"}))
+	auditEvent := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+	req = req.WithContext(request.WithAuditEvent(req.Context(), auditEvent))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	// the audit event records the upstream requests of the clusters
+	upstreams := []upstreamRequest{}
+	if err := json.Unmarshal([]byte(auditEvent.Annotations[AuditAnnotationUpstreams]), &upstreams); err != nil {
+		t.Fatalf("unexpected error: %v, %v", err, auditEvent.Annotations)
+	}
+	codes := map[string]int{}
+	for _, upstream := range upstreams {
+		codes[upstream.Cluster] = upstream.Code
+	}
+	expectedCodes := map[string]int{"cluster1": 200, "cluster2": 500, "cluster3": 403}
+	if fmt.Sprint(codes) != fmt.Sprint(expectedCodes) {
+		t.Errorf("expected the upstream codes %v, but %v", expectedCodes, codes)
+	}
+	if auditEvent.Annotations[AuditAnnotationCluster] != "-" || auditEvent.Annotations[AuditAnnotationSubResource] != "sub" {
+		t.Errorf("expected the fan-out request to sub, but %v", auditEvent.Annotations)
+	}
+
+	merged := &fanOutList{}
+	if err := json.Unmarshal(w.Body.Bytes(), merged); err != nil {
+		t.Fatalf("unexpected error: %v, %s", err, w.Body.String())
+	}
+	if merged.Kind != "ConfigMapList" {
+		t.Errorf("expected kind ConfigMapList, but %s", merged.Kind)
+	}
+
+	if len(merged.Items) != 1 {
+		t.Fatalf("expected 1 item, but %v", merged.Items)
+	}
+	metadata := merged.Items[0]["metadata"].(map[string]interface{})
+	if metadata["name"] != "cm-cluster1" {
+		t.Errorf("expected item cm-cluster1, but %v", metadata["name"])
+	}
+	annotations := metadata["annotations"].(map[string]interface{})
+	if annotations[ClusterAnnotation] != "cluster1" {
+		t.Errorf("expected the item is annotated with cluster1, but %v", annotations)
+	}
+	// the cluster selection parameters are not sent to the backends
+	if query := metadata["labels"].(map[string]interface{})["query"]; query != "labelSelector=a%3Db" {
+		t.Errorf("expected the upstream query labelSelector=a%%3Db, but %v", query)
+	}
+
+	if len(merged.Failures) != 2 {
+		t.Fatalf("expected 2 failures, but %v", merged.Failures)
+	}
+	if merged.Failures[0].Cluster != "cluster2" || merged.Failures[0].Code != http.StatusInternalServerError {
+		t.Errorf("expected cluster2 is failed with 500, but %v", merged.Failures[0])
+	}
+	if merged.Failures[1].Cluster != "cluster3" || merged.Failures[1].Code != http.StatusForbidden {
+		t.Errorf("expected cluster3 is forbidden, but %v", merged.Failures[1])
+	}
+}
+
+func TestFanOutSelectClusters(t *testing.T) {
+	h := &fanOutHandler{clusterSource: newTestClusterSource("cluster1", "cluster2", "cluster3"), config: &Config{}}
+
+	cases := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{
+			name:     "all clusters",
+			expected: []string{"cluster1", "cluster2", "cluster3"},
+		},
+		{
+			name:     "cluster names",
+			query:    "?clusters=cluster3,,unknown,cluster1",
+			expected: []string{"cluster1", "cluster3"},
+		},
+		{
+			name:     "cluster selector",
+			query:    "?clusterSelector=" + testClusterLabel,
+			expected: []string{"cluster1", "cluster2", "cluster3"},
+		},
+		{
+			name:     "unmatched cluster selector",
+			query:    "?clusterSelector=env%3Dprod",
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, testFanOutPathPrefix+"sub"+c.query, nil)
+			clusterNames, err := h.selectClusters(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(clusterNames, ",") != strings.Join(c.expected, ",") {
+				t.Errorf("expected clusters %v, but %v", c.expected, clusterNames)
+			}
+		})
+	}
+}
+
+func TestFanOutMaxResponseBytes(t *testing.T) {
+	// the response of cluster1 exceeds the limit
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clusterName := strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]
+		w.Header().Set("Content-Type", "application/json")
+		name := clusterName
+		if clusterName == "cluster1" {
+			name = strings.Repeat("x", 4096)
+		}
+		fmt.Fprintf(w, `{"apiVersion":"v1","kind":"ConfigMapList","metadata":{},"items":[{"metadata":{"name":%q}}]}`, name)
+	}))
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.UseID = true
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1", "cluster2"),
+		Config{FanOutMaxResponseBytes: 1024})
+	handler, err := rest.Connect(
+		context.TODO(), "-", &aggregationv1.ClusterStatusProxyOptions{Path: "configmaps"}, &fakeResponder{t: t})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the reverse proxy aborts the response of cluster1 by panicking when it is served by a http server
+	req := httptest.NewRequest(http.MethodGet, testFanOutPathPrefix+"sub/configmaps", nil)
+	req = req.WithContext(context.WithValue(req.Context(), http.ServerContextKey, &http.Server{}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	merged := &fanOutList{}
+	if err := json.Unmarshal(w.Body.Bytes(), merged); err != nil {
+		t.Fatalf("unexpected error: %v, %s", err, w.Body.String())
+	}
+	if len(merged.Items) != 1 || merged.Items[0]["metadata"].(map[string]interface{})["name"] != "cluster2" {
+		t.Errorf("expected the item of cluster2, but %v", merged.Items)
+	}
+	if len(merged.Failures) != 1 || merged.Failures[0].Cluster != "cluster1" ||
+		merged.Failures[0].Code != http.StatusInternalServerError ||
+		!strings.Contains(merged.Failures[0].Message, "exceeds 1024 bytes") {
+		t.Errorf("expected cluster1 is failed with the too large response, but %v", merged.Failures)
+	}
+}
+
+func TestFanOutKindMismatch(t *testing.T) {
+	// cluster2 responds with another kind
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		clusterName := strings.Split(strings.Trim(req.URL.Path, "/"), "/")[0]
+		kind := "ConfigMapList"
+		if clusterName == "cluster2" {
+			kind = "SecretList"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"apiVersion":"v1","kind":%q,"metadata":{},"items":[{"metadata":{"name":%q}}]}`, kind, clusterName)
+	}))
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.UseID = true
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1", "cluster2", "cluster3"), Config{})
+	handler, err := rest.Connect(
+		context.TODO(), "-", &aggregationv1.ClusterStatusProxyOptions{Path: "/sub/configmaps"}, &fakeResponder{t: t})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testFanOutPathPrefix+"sub/configmaps", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	merged := &fanOutList{}
+	if err := json.Unmarshal(w.Body.Bytes(), merged); err != nil {
+		t.Fatalf("unexpected error: %v, %s", err, w.Body.String())
+	}
+	if merged.Kind != "ConfigMapList" || len(merged.Items) != 2 {
+		t.Errorf("expected the ConfigMapList of cluster1 and cluster3, but %s %v", merged.Kind, merged.Items)
+	}
+	if len(merged.Failures) != 1 || merged.Failures[0].Cluster != "cluster2" ||
+		!strings.Contains(merged.Failures[0].Message, "does not match the kind ConfigMapList") {
+		t.Errorf("expected cluster2 is failed with the mismatched kind, but %v", merged.Failures)
+	}
+}
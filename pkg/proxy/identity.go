@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// The front-proxy headers that the backends authenticate the users with, see --requestheader-username-headers of
+// kube-apiserver
+const (
+	RemoteUserHeader        = "X-Remote-User"
+	RemoteGroupHeader       = "X-Remote-Group"
+	RemoteExtraHeaderPrefix = "X-Remote-Extra-"
+)
+
+// identityHeaders are the headers that carry the identity of a user, the copies of the clients are never proxied,
+// otherwise a client could act as any user to the backends that trust the client certificate of the proxy
+var identityHeaders = []string{
+	authenticationv1.ImpersonateUserHeader,
+	authenticationv1.ImpersonateGroupHeader,
+	RemoteUserHeader,
+	RemoteGroupHeader,
+}
+
+var identityHeaderPrefixes = []string{
+	authenticationv1.ImpersonateUserExtraHeaderPrefix,
+	RemoteExtraHeaderPrefix,
+}
+
+// forwardIdentity strips the identity headers of the client and forwards the authenticated user with the identity
+// forwarding mode of the aggregator service, it returns a request that can be modified without affecting the
+// original one
+func forwardIdentity(serviceInfo *getter.AggregatorServiceInfo, req *http.Request) *http.Request {
+	newReq := req.WithContext(req.Context())
+	newReq.Header = utilnet.CloneHeader(req.Header)
+	for key := range newReq.Header {
+		if isIdentityHeader(key) {
+			newReq.Header.Del(key)
+		}
+	}
+
+	user, ok := request.UserFrom(req.Context())
+	if !ok || user.GetName() == "" {
+		return newReq
+	}
+
+	userHeader, groupHeader, extraHeaderPrefix := "", "", ""
+	switch serviceInfo.IdentityForwarding {
+	case getter.IdentityForwardingImpersonation:
+		userHeader = authenticationv1.ImpersonateUserHeader
+		groupHeader = authenticationv1.ImpersonateGroupHeader
+		extraHeaderPrefix = authenticationv1.ImpersonateUserExtraHeaderPrefix
+	case getter.IdentityForwardingFrontProxy:
+		userHeader = RemoteUserHeader
+		groupHeader = RemoteGroupHeader
+		extraHeaderPrefix = RemoteExtraHeaderPrefix
+	default:
+		return newReq
+	}
+
+	newReq.Header.Set(userHeader, user.GetName())
+	for _, group := range user.GetGroups() {
+		newReq.Header.Add(groupHeader, group)
+	}
+	for key, values := range user.GetExtra() {
+		// the extra keys are case-insensitive in the headers, so they are escaped as kube-apiserver expects
+		extraHeader := extraHeaderPrefix + url.PathEscape(key)
+		for _, value := range values {
+			newReq.Header.Add(extraHeader, value)
+		}
+	}
+	return newReq
+}
+
+func isIdentityHeader(key string) bool {
+	for _, header := range identityHeaders {
+		if strings.EqualFold(key, header) {
+			return true
+		}
+	}
+	for _, prefix := range identityHeaderPrefixes {
+		if len(key) >= len(prefix) && strings.EqualFold(key[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
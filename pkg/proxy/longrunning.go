@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// streamingQueryParameters are the query parameters that keep a proxied request streaming, e.g. watch and follow logs
+var streamingQueryParameters = []string{"watch", "follow"}
+
+// LongRunningRequestCheck returns a check that treats the upgrade requests and the streaming requests to the aggregator
+// sub-resource as long running, so they are not limited by the request timeout, the other requests are checked by the
+// delegate check
+func LongRunningRequestCheck(delegate request.LongRunningRequestCheck) request.LongRunningRequestCheck {
+	return func(r *http.Request, requestInfo *request.RequestInfo) bool {
+		if delegate != nil && delegate(r, requestInfo) {
+			return true
+		}
+		if requestInfo == nil || !requestInfo.IsResourceRequest ||
+			requestInfo.Resource != clusterStatusesResource.Resource || requestInfo.Subresource != aggregatorSubresource {
+			return false
+		}
+		return isStreamingRequest(r)
+	}
+}
+
+// isStreamingRequest returns true if the request is an upgrade request or a streaming request, e.g. watch
+func isStreamingRequest(r *http.Request) bool {
+	if httpstream.IsUpgradeRequest(r) {
+		return true
+	}
+
+	query := r.URL.Query()
+	for _, parameter := range streamingQueryParameters {
+		if value := query.Get(parameter); value == "true" || value == "1" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/registry/rest"
+)
+
+// statusCodecs encodes the Status of the errors as the apiserver responds them, a Status is unversioned
+var statusCodecs = newStatusCodecs()
+
+func newStatusCodecs() serializer.CodecFactory {
+	scheme := runtime.NewScheme()
+	metav1.AddToGroupVersion(scheme, aggregationv1.SchemeGroupVersion)
+	return serializer.NewCodecFactory(scheme)
+}
+
+// metricsResponseWriter records the response code and size of a proxied request
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	code int
+	size int64
+	// headerWritten is called once with the response code when the response header is written
+	headerWritten func(code int)
+}
+
+func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
+	return &metricsResponseWriter{ResponseWriter: w, code: http.StatusOK}
+}
+
+func (w *metricsResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.notifyHeaderWritten()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsResponseWriter) Write(data []byte) (int, error) {
+	w.notifyHeaderWritten()
+	n, err := w.ResponseWriter.Write(data)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush is required to stream the responses, e.g. watch
+func (w *metricsResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack is required to upgrade the connections, the response of an upgraded connection is written to the
+// hijacked connection directly, so it is recorded as switching protocols
+func (w *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer does not support hijacking")
+	}
+	w.code = http.StatusSwitchingProtocols
+	w.notifyHeaderWritten()
+	return hijacker.Hijack()
+}
+
+func (w *metricsResponseWriter) notifyHeaderWritten() {
+	if headerWritten := w.headerWritten; headerWritten != nil {
+		w.headerWritten = nil
+		headerWritten(w.code)
+	}
+}
+
+// metricsResponder records the response code and size of the errors that are responded by the apiserver
+type metricsResponder struct {
+	rest.Responder
+	writer *metricsResponseWriter
+	req    *http.Request
+	// err is the error of the proxied request, e.g. the backend cannot be connected
+	err error
+}
+
+func (r *metricsResponder) Object(statusCode int, obj runtime.Object) {
+	r.writer.code = statusCode
+	r.Responder.Object(statusCode, obj)
+}
+
+func (r *metricsResponder) Error(err error) {
+	r.err = err
+	r.writer.code = http.StatusInternalServerError
+	if status, ok := err.(errors.APIStatus); ok && status.Status().Code != 0 {
+		r.writer.code = int(status.Status().Code)
+	}
+	r.Responder.Error(err)
+
+	// the apiserver writes the Status with its own response writer, so the Status is encoded with the negotiated
+	// serializer of the request again to count its size
+	sizeWriter := &sizeResponseWriter{header: http.Header{}}
+	responsewriters.ErrorNegotiated(err, statusCodecs, aggregationv1.SchemeGroupVersion, sizeWriter, r.req)
+	r.writer.size += sizeWriter.size
+}
+
+// sizeResponseWriter discards a response and counts its size
+type sizeResponseWriter struct {
+	header http.Header
+	size   int64
+}
+
+func (w *sizeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *sizeResponseWriter) Write(data []byte) (int, error) {
+	w.size += int64(len(data))
+	return len(data), nil
+}
+
+func (w *sizeResponseWriter) WriteHeader(int) {}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+)
+
+// checkPathRules returns an error if the upstream path is denied by the path rules of the aggregator service, a path
+// is denied if it matches a denied path, or the service has allowed paths and it matches none of them
+func checkPathRules(serviceInfo *getter.AggregatorServiceInfo, upstreamPath string) error {
+	for _, rule := range serviceInfo.DeniedPaths {
+		if matchPathRule(rule, upstreamPath) {
+			return fmt.Errorf("the path %s is denied by %s", upstreamPath, rule)
+		}
+	}
+
+	if len(serviceInfo.AllowedPaths) == 0 {
+		return nil
+	}
+	for _, rule := range serviceInfo.AllowedPaths {
+		if matchPathRule(rule, upstreamPath) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the path %s is not allowed", upstreamPath)
+}
+
+// matchPathRule returns true if the path or one of its parents matches the rule, a rule is a glob pattern if it has
+// any of the *?[ characters, otherwise it is a path prefix, e.g. /api/v1 matches /api/v1/pods but not /api/v1beta1
+func matchPathRule(rule, upstreamPath string) bool {
+	isPattern := strings.ContainsAny(rule, "*?[")
+	rule = strings.TrimSuffix(rule, "/")
+	for p := upstreamPath; ; p = path.Dir(p) {
+		if isPattern {
+			if matched, _ := path.Match(rule, p); matched {
+				return true
+			}
+		} else if p == rule {
+			return true
+		}
+		if p == "/" || p == "." {
+			return false
+		}
+	}
+}
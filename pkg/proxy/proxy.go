@@ -3,28 +3,78 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
 	"net/url"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
 	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+	"github.com/skeeey/aggregator-proxy-server/pkg/retry"
 	"github.com/skeeey/aggregator-proxy-server/pkg/utils"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
 	proxyutil "k8s.io/apimachinery/pkg/util/proxy"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/filters"
 	"k8s.io/apiserver/pkg/registry/rest"
-	restclient "k8s.io/client-go/rest"
 	"k8s.io/klog"
 )
 
+// unknownSubResource is the sub-resource label of the metrics of the requests that are not routed to a service
+const unknownSubResource = "unknown"
+
+// SubResourceAuthorizer authorizes an aggregator request on the aggregator sub-resource that it is routed to
+type SubResourceAuthorizer interface {
+	AuthorizeSubResource(
+		ctx context.Context, attrs authorizer.Attributes, subResource string) (authorizer.Decision, string, error)
+}
+
+// Config is the configuration of the aggregator proxy
+type Config struct {
+	// Authorizer authorizes the fan-out requests per cluster, the requests are authorized again with the routed
+	// sub-resource if it is a SubResourceAuthorizer
+	Authorizer authorizer.Authorizer
+	// FanOutConcurrency is the number of clusters that a fan-out request is sent to concurrently
+	FanOutConcurrency int
+	// FanOutMaxResponseBytes is the size limit of the response of a cluster to a fan-out request, a cluster that
+	// responds with a larger response is reported as a failure
+	FanOutMaxResponseBytes int64
+	// EndpointResolver picks the endpoints of the backend services, the requests are sent to the service DNS names
+	// if it is nil
+	EndpointResolver *EndpointResolver
+	// RetryBudget limits the retries of all aggregator services
+	RetryBudget *retry.Budget
+}
+
 // ProxyREST implements the proxy subresource for a Service
 type AggregatorProxyRest struct {
 	*getter.AggregatorServiceInfoGetter
+	clusterSource cluster.Source
+	config        *Config
 }
 
-func NewAggregatorProxyRest(serviceInfoGetter *getter.AggregatorServiceInfoGetter) *AggregatorProxyRest {
-	return &AggregatorProxyRest{serviceInfoGetter}
+func NewAggregatorProxyRest(
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter, clusterSource cluster.Source, config Config) *AggregatorProxyRest {
+	if config.FanOutConcurrency <= 0 {
+		config.FanOutConcurrency = DefaultFanOutConcurrency
+	}
+	if config.FanOutMaxResponseBytes <= 0 {
+		config.FanOutMaxResponseBytes = DefaultFanOutMaxResponseBytes
+	}
+	if config.RetryBudget == nil {
+		config.RetryBudget = retry.NewBudget(retry.DefaultBudgetRatio, retry.DefaultBudgetBurst)
+	}
+	return &AggregatorProxyRest{
+		AggregatorServiceInfoGetter: serviceInfoGetter,
+		clusterSource:               clusterSource,
+		config:                      &config,
+	}
 }
 
 var _ = rest.Connecter(&AggregatorProxyRest{})
@@ -34,10 +84,9 @@ func (r *AggregatorProxyRest) New() runtime.Object {
 	return &aggregationv1.ClusterStatusProxyOptions{}
 }
 
-// ConnectMethods returns the list of HTTP methods that can be proxied
+// ConnectMethods returns the list of HTTP methods that can be proxied, an aggregator service may only allow a part of them
 func (r *AggregatorProxyRest) ConnectMethods() []string {
-	//TODO: may need more methods
-	return []string{"GET", "POST", "PUT", "OPTIONS"}
+	return getter.ProxyMethods
 }
 
 // NewConnectOptions returns versioned resource that represents proxy parameters
@@ -47,58 +96,272 @@ func (r *AggregatorProxyRest) NewConnectOptions() (runtime.Object, bool, string)
 
 // Connect returns a handler for the pod proxy
 func (r *AggregatorProxyRest) Connect(
-	_ context.Context, _ string, opts runtime.Object, responder rest.Responder) (http.Handler, error) {
-	return &proxyRestHandler{opts: opts, responder: responder, serviceInfoGetter: r.AggregatorServiceInfoGetter}, nil
+	_ context.Context, clusterName string, opts runtime.Object, responder rest.Responder) (http.Handler, error) {
+	// the request is sent to all selected clusters, the clusters are checked by the fan-out handler
+	if clusterName == utils.AllClusters {
+		return &fanOutHandler{
+			opts:              opts,
+			responder:         responder,
+			serviceInfoGetter: r.AggregatorServiceInfoGetter,
+			clusterSource:     r.clusterSource,
+			config:            r.config,
+		}, nil
+	}
+
+	// refuse to proxy the requests for the clusters that are not registered
+	if _, err := r.clusterSource.Get(clusterName); err != nil {
+		return nil, err
+	}
+
+	return &proxyRestHandler{
+		clusterName:       clusterName,
+		opts:              opts,
+		responder:         responder,
+		serviceInfoGetter: r.AggregatorServiceInfoGetter,
+		config:            r.config,
+	}, nil
 }
 
 type proxyRestHandler struct {
+	clusterName       string
 	opts              runtime.Object
 	responder         rest.Responder
 	serviceInfoGetter *getter.AggregatorServiceInfoGetter
+	config            *Config
+	// upstream receives the upstream request after the request is proxied, the audit event of the request is
+	// annotated with the upstream request if it is nil
+	upstream func(*upstreamRequest)
 }
 
-func (h *proxyRestHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	// the request URL must comply with the rules
-	subResource, err := utils.GetSubResource(req.URL.Path)
+func (h *proxyRestHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// the request URL must comply with the rules, the sub-resource is replaced with the routed one of the service
+	subResourcePath, err := utils.GetSubResourcePath(req.URL.Path)
+	subResource, _ := utils.GetSubResource(req.URL.Path)
+	// the raw sub-resource is not a metric label until it is routed, it is any path segment of the clients
+	metricsSubResource := unknownSubResource
+
+	startTime := time.Now()
+	method := req.Method
+	w := newMetricsResponseWriter(rw)
+	responder := &metricsResponder{Responder: h.responder, writer: w, req: req}
+	ctx := req.Context()
+	var backend, upstreamPath, pathViolation string
+	var upstreamStartTime time.Time
+	defer func() {
+		metrics.RecordProxyRequest(metricsSubResource, h.clusterName, method, w.code, w.size, time.Since(startTime))
+
+		upstream := newUpstreamRequest(
+			h.clusterName, backend, upstreamPath, w.code, time.Since(upstreamStartTime), pathViolation)
+		if h.upstream != nil {
+			h.upstream(upstream)
+			return
+		}
+		auditUpstreamRequest(ctx, subResource, upstream)
+	}()
+
 	if err != nil {
-		http.Error(w, fmt.Sprintf("the request %s is forbidden", req.URL.Path), http.StatusForbidden)
+		responder.Error(newProxyError(http.StatusForbidden, ReasonInvalidPath, h.clusterName, subResource,
+			fmt.Sprintf("the request %s is forbidden: %v", req.URL.Path, err)))
 		return
 	}
 
-	serviceInfo := h.serviceInfoGetter.GetAggregatorServiceInfo(subResource)
+	serviceInfo := h.serviceInfoGetter.GetAggregatorServiceInfo(subResourcePath)
 	if serviceInfo == nil {
 		klog.Warningf("The aggregator service cannot be found for %s", req.URL.Path)
-		http.Error(w, fmt.Sprintf("the aggregator service (%s) is not found", subResource), http.StatusNotFound)
+		responder.Error(newProxyError(http.StatusNotFound, ReasonAggregatorServiceNotFound, h.clusterName, subResource,
+			fmt.Sprintf("the aggregator service (%s) is not found", subResource)))
 		return
 	}
+	subResource = serviceInfo.SubResource
+	metricsSubResource = subResource
 
-	transport, err := restclient.TransportFor(serviceInfo.RestConfig)
-	if err != nil {
-		klog.Errorf("failed to build transport for %s", serviceInfo.Name)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// the route may be changed after the request was authorized, so the request is authorized again with the
+	// sub-resource of the service that serves it
+	if err := h.authorizeSubResource(req, subResource); err != nil {
+		klog.Warningf("The request %s to the aggregator service %s is forbidden: %v", req.URL.Path, serviceInfo.Name, err)
+		responder.Error(newProxyError(http.StatusForbidden, ReasonSubResourceForbidden, h.clusterName, subResource,
+			fmt.Sprintf("the request %s is forbidden: %v", req.URL.Path, err)))
 		return
 	}
 
-	host := fmt.Sprintf("%s.%s.svc", serviceInfo.ServiceName, serviceInfo.ServiceNamespace)
+	if !serviceInfo.Allows(req.Method) {
+		w.Header().Set("Allow", strings.Join(serviceInfo.Methods(), ", "))
+		responder.Error(newProxyError(http.StatusMethodNotAllowed, ReasonMethodNotAllowed, h.clusterName, subResource,
+			fmt.Sprintf("the method %s is not allowed by the aggregator service (%s)", req.Method, subResource)))
+		return
+	}
+
+	if serviceInfo.UnavailableReason != "" {
+		klog.Warningf("The aggregator service %s is unavailable: %s", serviceInfo.Name, serviceInfo.UnavailableReason)
+		responder.Error(newProxyError(http.StatusServiceUnavailable, ReasonAggregatorServiceUnavailable, h.clusterName,
+			subResource, fmt.Sprintf("the aggregator service (%s) is unavailable", subResource)))
+		return
+	}
+
+	req = forwardIdentity(serviceInfo, req)
 	proxyPath := serviceInfo.RootPath
 	if serviceInfo.UseID {
-		//TODO: find cluster name from req.URL.Path
-		proxyPath = path.Join(proxyPath, "")
+		proxyPath, req = h.injectClusterName(serviceInfo, proxyPath, req)
 	}
 	proxyOpts, ok := h.opts.(*aggregationv1.ClusterStatusProxyOptions)
 	if !ok {
 		klog.Errorf("invalid options object: %#v", h.opts)
-		http.Error(w, "failed to get proxy path", http.StatusInternalServerError)
+		responder.Error(newProxyError(http.StatusInternalServerError, ReasonInvalidOptions, h.clusterName, subResource,
+			"failed to get proxy path"))
+		return
+	}
+	// the path cannot escape from the root path of the service, and it is checked with the path rules of the service
+	proxyPath, err = utils.JoinProxyPath(proxyPath, proxyOpts.Path)
+	if err == nil {
+		err = checkPathRules(serviceInfo, proxyPath)
+	}
+	if err != nil {
+		klog.Warningf("The request %s to the aggregator service %s is forbidden: %v", req.URL.Path, serviceInfo.Name, err)
+		pathViolation = err.Error()
+		responder.Error(newProxyError(http.StatusForbidden, ReasonPathNotAllowed, h.clusterName, subResource,
+			fmt.Sprintf("the request %s is forbidden", req.URL.Path)))
 		return
 	}
-	proxyPath = path.Join("/", proxyPath, proxyOpts.Path)
+
+	// an unhealthy backend is not routed until the probes succeed again, so the client retries after a probe period
+	if status := h.serviceInfoGetter.GetHealthStatus(serviceInfo); status != nil && !status.Healthy() {
+		klog.Warningf("The backend of the aggregator service %s is unhealthy", serviceInfo.Name)
+		responder.Error(newServiceUnavailableError(ReasonBackendUnhealthy, h.clusterName, subResource,
+			fmt.Sprintf("the backend of the aggregator service (%s) is unhealthy", subResource), status.Config().Period))
+		return
+	}
+
+	if breaker := h.serviceInfoGetter.GetCircuitBreaker(serviceInfo); breaker != nil {
+		allowed, retryAfter := breaker.Allow()
+		if !allowed {
+			klog.Warningf("The circuit breaker of the aggregator service %s is open", serviceInfo.Name)
+			responder.Error(newServiceUnavailableError(ReasonCircuitBreakerOpen, h.clusterName, subResource,
+				fmt.Sprintf("the circuit breaker of the aggregator service (%s) is open", subResource), retryAfter))
+			return
+		}
+		failed := func() bool {
+			return (responder.err != nil && req.Context().Err() == nil) || w.code >= 500
+		}
+		if isStreamingRequest(req) {
+			// the streaming requests last as long as the clients want, so only their errors are counted, and their
+			// results are recorded once the response header is written, a half-open probe is not held until the end
+			var once sync.Once
+			record := func() { once.Do(func() { breaker.Record(failed(), 0) }) }
+			w.headerWritten = func(int) { record() }
+			defer record()
+		} else {
+			defer func() {
+				breaker.Record(failed(), time.Since(startTime))
+			}()
+		}
+	}
+
+	transport, err := h.serviceInfoGetter.GetTransport(serviceInfo)
+	if err != nil {
+		klog.Errorf("failed to build transport for %s: %v", serviceInfo.Name, err)
+		responder.Error(newProxyError(http.StatusInternalServerError, ReasonTransportError, h.clusterName, subResource,
+			fmt.Sprintf("failed to build the transport to the aggregator service (%s)", subResource)))
+		return
+	}
+	if serviceInfo.RetryPolicy != nil {
+		transport = retry.NewRoundTripper(transport, serviceInfo.Name, *serviceInfo.RetryPolicy, h.config.RetryBudget)
+	}
+
+	host := serviceInfo.Host()
+	if h.config.EndpointResolver != nil && serviceInfo.Address == "" {
+		address, release, err := h.config.EndpointResolver.Resolve(serviceInfo, h.clusterName)
+		if err != nil {
+			klog.Warningf("The aggregator service %s has no available endpoint: %v", serviceInfo.Name, err)
+			responder.Error(newProxyError(http.StatusServiceUnavailable, ReasonNoAvailableEndpoints, h.clusterName,
+				subResource, fmt.Sprintf("the aggregator service (%s) has no available endpoint", subResource)))
+			return
+		}
+		host = address
+		// the endpoint is skipped for a while if it cannot be connected, the requests canceled by the clients are ignored
+		defer func() {
+			release(responder.err != nil && req.Context().Err() == nil)
+		}()
+	}
 
 	location := &url.URL{
 		Scheme: "https", // should always be https
-		Host:   net.JoinHostPort(host, serviceInfo.ServicePort),
+		Host:   host,
 		Path:   proxyPath,
+		// the query of an upgrade request is only sent with the location, e.g. the command of exec
+		RawQuery: req.URL.RawQuery,
 	}
 	klog.Infof("Proxy %s to %s", req.URL.Path, location.Path)
-	proxyHandler := proxyutil.NewUpgradeAwareHandler(location, transport, true, false, proxyutil.NewErrorResponder(h.responder))
+	transport = &upstreamErrorTransport{
+		transport: transport, responder: responder, clusterName: h.clusterName, subResource: subResource}
+	proxyHandler := proxyutil.NewUpgradeAwareHandler(location, transport, true, false,
+		&upstreamErrorResponder{responder: responder, clusterName: h.clusterName, subResource: subResource})
+	if httpstream.IsUpgradeRequest(req) {
+		upgradeTransport, err := h.serviceInfoGetter.GetUpgradeTransport(serviceInfo)
+		if err != nil {
+			klog.Errorf("failed to build upgrade transport for %s: %v", serviceInfo.Name, err)
+			responder.Error(newProxyError(http.StatusInternalServerError, ReasonTransportError, h.clusterName,
+				subResource, fmt.Sprintf("failed to build the upgrade transport to the aggregator service (%s)", subResource)))
+			return
+		}
+		proxyHandler.UpgradeTransport = upgradeTransport
+	}
+	backend, upstreamPath = location.Host, location.Path
+	upstreamStartTime = time.Now()
 	proxyHandler.ServeHTTP(w, req)
 }
+
+// authorizeSubResource authorizes the request on the sub-resource if the authorizer authorizes the aggregator
+// sub-resources, the request is authorized on the cluster of the handler, e.g. a cluster of a fan-out request
+func (h *proxyRestHandler) authorizeSubResource(req *http.Request, subResource string) error {
+	subResourceAuthorizer, ok := h.config.Authorizer.(SubResourceAuthorizer)
+	if !ok {
+		return nil
+	}
+	attrs, err := filters.GetAuthorizerAttributes(req.Context())
+	if err != nil {
+		return err
+	}
+
+	clusterAttrs := authorizer.AttributesRecord{
+		User:            attrs.GetUser(),
+		Verb:            attrs.GetVerb(),
+		APIGroup:        attrs.GetAPIGroup(),
+		APIVersion:      attrs.GetAPIVersion(),
+		Resource:        attrs.GetResource(),
+		Subresource:     attrs.GetSubresource(),
+		Name:            h.clusterName,
+		ResourceRequest: attrs.IsResourceRequest(),
+		Path:            req.URL.Path,
+	}
+	decision, reason, err := subResourceAuthorizer.AuthorizeSubResource(req.Context(), clusterAttrs, subResource)
+	if err != nil {
+		return err
+	}
+	if decision != authorizer.DecisionAllow {
+		return fmt.Errorf("%s", reason)
+	}
+	return nil
+}
+
+// injectClusterName puts the cluster name into the upstream request with the placement of the aggregator service,
+// it returns the proxy path and a request that can be modified without affecting the original one
+func (h *proxyRestHandler) injectClusterName(
+	serviceInfo *getter.AggregatorServiceInfo, proxyPath string, req *http.Request) (string, *http.Request) {
+	switch serviceInfo.IDPlacement {
+	case getter.IDPlacementQuery:
+		newReq := req.WithContext(req.Context())
+		newURL := *req.URL
+		query := newURL.Query()
+		query.Set(getter.ClusterNameQueryParameter, h.clusterName)
+		newURL.RawQuery = query.Encode()
+		newReq.URL = &newURL
+		return proxyPath, newReq
+	case getter.IDPlacementHeader:
+		newReq := req.WithContext(req.Context())
+		newReq.Header = utilnet.CloneHeader(req.Header)
+		newReq.Header.Set(getter.ClusterNameHeader, h.clusterName)
+		return proxyPath, newReq
+	default:
+		return path.Join(proxyPath, h.clusterName), req
+	}
+}
@@ -0,0 +1,800 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/authorization"
+	"github.com/skeeey/aggregator-proxy-server/pkg/circuitbreaker"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/health"
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+	"github.com/skeeey/aggregator-proxy-server/pkg/retry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/endpoints/handlers/responsewriters"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	restclient "k8s.io/client-go/rest"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const testRequestPathPrefix = "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/cluster1/aggregator/"
+
+type fakeResponder struct {
+	t *testing.T
+}
+
+func (r *fakeResponder) Object(statusCode int, obj runtime.Object) {
+	r.t.Errorf("unexpected object response %d: %#v", statusCode, obj)
+}
+
+func (r *fakeResponder) Error(err error) {
+	r.t.Errorf("unexpected error response: %v", err)
+}
+
+// echoRequest is what the test backend observed from a proxied request
+type echoRequest struct {
+	Path   string
+	Query  url.Values
+	Header http.Header
+}
+
+func newEchoBackend() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&echoRequest{Path: req.URL.Path, Query: req.URL.Query(), Header: req.Header})
+	}))
+}
+
+// newTestServiceInfo returns an aggregator service info whose connections are dialed to the backend
+func newTestServiceInfo(backend *httptest.Server, subResource string) *getter.AggregatorServiceInfo {
+	backendAddr := backend.Listener.Addr().String()
+	_, port, _ := net.SplitHostPort(backendAddr)
+	return &getter.AggregatorServiceInfo{
+		Name:             "default/" + subResource,
+		SubResource:      subResource,
+		ServiceName:      "backend",
+		ServiceNamespace: "default",
+		ServicePort:      port,
+		RestConfig: &restclient.Config{
+			TLSClientConfig: restclient.TLSClientConfig{Insecure: true},
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, backendAddr)
+			},
+		},
+	}
+}
+
+const testClusterLabel = "aggregation.open-cluster-management.io/cluster"
+
+// newTestClusterSource returns a cluster source that the clusters are registered with labelled namespaces
+func newTestClusterSource(clusterNames ...string) cluster.Source {
+	informerFactory := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0)
+	namespaceInformer := informerFactory.Core().V1().Namespaces()
+	for _, clusterName := range clusterNames {
+		_ = namespaceInformer.Informer().GetStore().Add(&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: clusterName, Labels: map[string]string{testClusterLabel: ""}},
+		})
+	}
+	selector, _ := labels.Parse(testClusterLabel)
+	return cluster.NewNamespaceSource(namespaceInformer, selector)
+}
+
+func proxyTo(t *testing.T, serviceInfoGetter *getter.AggregatorServiceInfoGetter, requestURL, proxyPath string) *echoRequest {
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+	handler, err := rest.Connect(
+		context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: proxyPath}, &fakeResponder{t: t})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, requestURL, nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	body, err := ioutil.ReadAll(w.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	observed := &echoRequest{}
+	if err := json.Unmarshal(body, observed); err != nil {
+		t.Fatalf("unexpected error: %v, %s", err, string(body))
+	}
+	return observed
+}
+
+func TestInjectClusterName(t *testing.T) {
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	cases := []struct {
+		name           string
+		useID          bool
+		idPlacement    string
+		expectedPath   string
+		expectedQuery  string
+		expectedHeader string
+	}{
+		{
+			name:         "without id",
+			useID:        false,
+			expectedPath: "/root/sub/namespaces/default/pods",
+		},
+		{
+			name:         "path placement by default",
+			useID:        true,
+			expectedPath: "/root/cluster1/sub/namespaces/default/pods",
+		},
+		{
+			name:         "path placement",
+			useID:        true,
+			idPlacement:  getter.IDPlacementPath,
+			expectedPath: "/root/cluster1/sub/namespaces/default/pods",
+		},
+		{
+			name:          "query placement",
+			useID:         true,
+			idPlacement:   getter.IDPlacementQuery,
+			expectedPath:  "/root/sub/namespaces/default/pods",
+			expectedQuery: "cluster1",
+		},
+		{
+			name:           "header placement",
+			useID:          true,
+			idPlacement:    getter.IDPlacementHeader,
+			expectedPath:   "/root/sub/namespaces/default/pods",
+			expectedHeader: "cluster1",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			serviceInfo := newTestServiceInfo(backend, "sub")
+			serviceInfo.RootPath = "root"
+			serviceInfo.UseID = c.useID
+			serviceInfo.IDPlacement = c.idPlacement
+			serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+			serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+
+			observed := proxyTo(t, serviceInfoGetter,
+				testRequestPathPrefix+"sub/namespaces/default/pods?labelSelector=a%3Db", "/sub/namespaces/default/pods")
+			if observed.Path != c.expectedPath {
+				t.Errorf("expected path %s, but %s", c.expectedPath, observed.Path)
+			}
+			if observed.Query.Get("labelSelector") != "a=b" {
+				t.Errorf("expected the original query is kept, but %v", observed.Query)
+			}
+			if clusterName := observed.Query.Get(getter.ClusterNameQueryParameter); clusterName != c.expectedQuery {
+				t.Errorf("expected cluster query %q, but %q", c.expectedQuery, clusterName)
+			}
+			if clusterName := observed.Header.Get(getter.ClusterNameHeader); clusterName != c.expectedHeader {
+				t.Errorf("expected cluster header %q, but %q", c.expectedHeader, clusterName)
+			}
+		})
+	}
+}
+
+func TestConnectUnknownCluster(t *testing.T) {
+	rest := NewAggregatorProxyRest(getter.NewAggregatorServiceInfoGetter(), newTestClusterSource("cluster1"), Config{})
+	_, err := rest.Connect(context.TODO(), "unknown", &aggregationv1.ClusterStatusProxyOptions{}, &fakeResponder{t: t})
+	if !errors.IsNotFound(err) {
+		t.Errorf("expected not found error, but %v", err)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.AllowedMethods = []string{http.MethodGet, http.MethodHead}
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	for _, method := range getter.ProxyMethods {
+		w := httptest.NewRecorder()
+		handler, err := rest.Connect(context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"},
+			&statusResponder{fakeResponder: fakeResponder{t: t}, w: w})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		handler.ServeHTTP(w, httptest.NewRequest(method, testRequestPathPrefix+"sub/pods", nil))
+		if serviceInfo.Allows(method) {
+			if w.Code != http.StatusOK {
+				t.Errorf("expected %s is proxied, but %d: %s", method, w.Code, w.Body.String())
+			}
+			continue
+		}
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected %s is not allowed, but %d", method, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+			t.Errorf("expected Allow header GET, HEAD, but %q", allow)
+		}
+		if err := decodeStatus(t, w); !errors.IsMethodNotSupported(err) || ReasonForError(err) != ReasonMethodNotAllowed {
+			t.Errorf("expected method not allowed status, but %v", err)
+		}
+	}
+}
+
+func TestMultiSegmentSubResource(t *testing.T) {
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	for subResource, rootPath := range map[string]string{"metrics": "v2", "metrics/v1": "v1"} {
+		serviceInfo := newTestServiceInfo(backend, subResource)
+		serviceInfo.RootPath = rootPath
+		if err := serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	for path, expectedPath := range map[string]string{
+		"metrics/v1/pods":  "/v1/metrics/v1/pods",
+		"metrics/v2/pods":  "/v2/metrics/v2/pods",
+		"metrics/v10/pods": "/v2/metrics/v10/pods",
+	} {
+		handler, err := rest.Connect(
+			context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: path}, &fakeResponder{t: t})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testRequestPathPrefix+path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %s is proxied, but %d: %s", path, w.Code, w.Body.String())
+		}
+		echo := &echoRequest{}
+		if err := json.Unmarshal(w.Body.Bytes(), echo); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if echo.Path != expectedPath {
+			t.Errorf("expected %s is proxied to %s, but %s", path, expectedPath, echo.Path)
+		}
+	}
+}
+
+// errorResponder records the errors that are responded by the apiserver
+// statusResponder writes the errors as the Status json like the responder of the apiserver
+type statusResponder struct {
+	fakeResponder
+	w http.ResponseWriter
+}
+
+func (r *statusResponder) Error(err error) {
+	status := responsewriters.ErrorToAPIStatus(err)
+	r.w.Header().Set("Content-Type", "application/json")
+	r.w.WriteHeader(int(status.Code))
+	_ = json.NewEncoder(r.w).Encode(status)
+}
+
+// decodeStatus returns the Status error of a response
+func decodeStatus(t *testing.T, w *httptest.ResponseRecorder) error {
+	status := &metav1.Status{}
+	if err := json.Unmarshal(w.Body.Bytes(), status); err != nil {
+		t.Fatalf("expected a Status response, but %v: %s", err, w.Body.String())
+	}
+	return &errors.StatusError{ErrStatus: *status}
+}
+
+type errorResponder struct {
+	fakeResponder
+	errs []error
+}
+
+func (r *errorResponder) Error(err error) {
+	r.errs = append(r.errs, err)
+}
+
+func TestCircuitBreakerOpen(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "backend is broken", http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.CircuitBreaker = &circuitbreaker.Config{ErrorRateThreshold: 50, MinimumRequests: 2}
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	codes := []int{}
+	responder := &errorResponder{fakeResponder: fakeResponder{t: t}}
+	for i := 0; i < 3; i++ {
+		handler, err := rest.Connect(
+			context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"}, responder)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/pods", nil))
+		codes = append(codes, w.Code)
+	}
+
+	// the failed requests are proxied until the breaker is opened
+	if codes[0] != http.StatusInternalServerError || codes[1] != http.StatusInternalServerError {
+		t.Errorf("expected the failed requests are proxied, but %v", codes)
+	}
+	if len(responder.errs) != 1 {
+		t.Fatalf("expected the request is rejected by the open breaker, but %v", responder.errs)
+	}
+	status, ok := responder.errs[0].(errors.APIStatus)
+	if !ok {
+		t.Fatalf("expected a status error, but %v", responder.errs[0])
+	}
+	if code := status.Status().Code; code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, but %d", code)
+	}
+	if details := status.Status().Details; details == nil || details.RetryAfterSeconds != 30 {
+		t.Errorf("expected retry after 30 seconds, but %#v", details)
+	}
+
+	if snapshots := serviceInfoGetter.CircuitBreakers(); len(snapshots) != 1 || snapshots[0].State != circuitbreaker.StateOpen {
+		t.Errorf("expected the breaker of default/sub is open, but %#v", snapshots)
+	}
+}
+
+func TestCircuitBreakerStreamingProbe(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Query().Get("fail") == "true":
+			http.Error(w, "backend is broken", http.StatusInternalServerError)
+		case req.URL.Query().Get("watch") == "true":
+			// the watch lasts until the test releases it
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-release
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.CircuitBreaker = &circuitbreaker.Config{
+		ErrorRateThreshold: 50, MinimumRequests: 2, OpenDuration: 10 * time.Millisecond}
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+	serve := func(query string) int {
+		handler, err := rest.Connect(context.TODO(), "cluster1",
+			&aggregationv1.ClusterStatusProxyOptions{Path: "pods"}, &errorResponder{fakeResponder: fakeResponder{t: t}})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return 0
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/pods?"+query, nil))
+		return w.Code
+	}
+	breakerState := func() circuitbreaker.State {
+		return serviceInfoGetter.CircuitBreakers()[0].State
+	}
+
+	serve("fail=true")
+	serve("fail=true")
+	if state := breakerState(); state != circuitbreaker.StateOpen {
+		t.Fatalf("expected the breaker is open, but %s", state)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// the watch is the half-open probe, its result is recorded once its response header is written
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serve("watch=true")
+	}()
+	defer wg.Wait()
+	defer close(release)
+
+	if err := wait.PollImmediate(10*time.Millisecond, wait.ForeverTestTimeout, func() (bool, error) {
+		return breakerState() == circuitbreaker.StateClosed, nil
+	}); err != nil {
+		t.Fatalf("expected the breaker is closed while the watch is running, but %s", breakerState())
+	}
+	if code := serve(""); code != http.StatusOK {
+		t.Errorf("expected the request is proxied while the watch is running, but %d", code)
+	}
+}
+
+func TestUnhealthyBackend(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/healthz" {
+			http.Error(w, "backend is broken", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.HealthCheck = &health.Config{Path: "/healthz", FailureThreshold: 1}
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	// the backend is probed with the transport of the service
+	targets := serviceInfoGetter.ProbeTargets()
+	if len(targets) != 1 {
+		t.Fatalf("expected 1 probe target, but %#v", targets)
+	}
+	probeErr := health.Probe(targets[0], time.Second)
+	if probeErr == nil {
+		t.Fatalf("expected the probe is failed, but succeeded")
+	}
+	if !targets[0].Status.Record(probeErr) {
+		t.Errorf("expected the backend becomes unhealthy")
+	}
+
+	responder := &errorResponder{fakeResponder: fakeResponder{t: t}}
+	handler, err := rest.Connect(
+		context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"}, responder)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/pods", nil))
+	if len(responder.errs) != 1 {
+		t.Fatalf("expected the request is rejected, but %v", responder.errs)
+	}
+	status, ok := responder.errs[0].(errors.APIStatus)
+	if !ok {
+		t.Fatalf("expected a status error, but %v", responder.errs[0])
+	}
+	if code := status.Status().Code; code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, but %d", code)
+	}
+	if details := status.Status().Details; details == nil || details.RetryAfterSeconds != 10 {
+		t.Errorf("expected retry after 10 seconds, but %#v", details)
+	}
+
+	// the backend is routed again after a successful probe
+	targets[0].Status.Record(nil)
+	handler, err = rest.Connect(
+		context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"}, &fakeResponder{t: t})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/pods", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, but %d", w.Code)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	attempts := 0
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "backend is restarting", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.RetryPolicy = &retry.Policy{RetryOnStatusCodes: []int{http.StatusServiceUnavailable}}
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	handler, err := rest.Connect(
+		context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"}, &fakeResponder{t: t})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/pods", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200 after the retry, but %d", w.Code)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, but %d", attempts)
+	}
+}
+
+func TestForwardIdentity(t *testing.T) {
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	cases := []struct {
+		name               string
+		identityForwarding string
+		expectedHeader     http.Header
+	}{
+		{
+			name:               "none",
+			identityForwarding: getter.IdentityForwardingNone,
+			expectedHeader:     http.Header{},
+		},
+		{
+			name:               "impersonation",
+			identityForwarding: getter.IdentityForwardingImpersonation,
+			expectedHeader: http.Header{
+				"Impersonate-User":                   {"alice"},
+				"Impersonate-Group":                  {"admins", "system:authenticated"},
+				"Impersonate-Extra-Scopes.test%2fio": {"read", "write"},
+			},
+		},
+		{
+			name:               "front-proxy",
+			identityForwarding: getter.IdentityForwardingFrontProxy,
+			expectedHeader: http.Header{
+				"X-Remote-User":                   {"alice"},
+				"X-Remote-Group":                  {"admins", "system:authenticated"},
+				"X-Remote-Extra-Scopes.test%2fio": {"read", "write"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			serviceInfo := newTestServiceInfo(backend, "sub")
+			serviceInfo.IdentityForwarding = c.identityForwarding
+			serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+			serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+			rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+			handler, err := rest.Connect(
+				context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: "pods"}, &fakeResponder{t: t})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/pods", nil)
+			req = req.WithContext(request.WithUser(req.Context(), &user.DefaultInfo{
+				Name:   "alice",
+				Groups: []string{"admins", "system:authenticated"},
+				Extra:  map[string][]string{"scopes.test/io": {"read", "write"}},
+			}))
+			// the identity headers of the client are never proxied
+			req.Header.Set("Impersonate-User", "system:admin")
+			req.Header.Set("impersonate-extra-foo", "bar")
+			req.Header.Set("X-Remote-Group", "system:masters")
+			req.Header.Set("X-Remote-Extra-Foo", "bar")
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected status 200, but %d: %s", w.Code, w.Body.String())
+			}
+
+			observed := &echoRequest{}
+			if err := json.Unmarshal(w.Body.Bytes(), observed); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			identityHeader := http.Header{}
+			for key, values := range observed.Header {
+				if isIdentityHeader(key) {
+					identityHeader[key] = values
+				}
+			}
+			if !reflect.DeepEqual(identityHeader, c.expectedHeader) {
+				t.Errorf("expected identity headers %v, but %v", c.expectedHeader, identityHeader)
+			}
+		})
+	}
+}
+
+func TestPathRules(t *testing.T) {
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "sub")
+	serviceInfo.RootPath = "api"
+	serviceInfo.AllowedPaths = []string{"/api/v1/namespaces/*/pods", "/api/v1/nodes"}
+	serviceInfo.DeniedPaths = []string{"/api/v1/namespaces/kube-system"}
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	cases := []struct {
+		proxyPath    string
+		expectedCode int
+	}{
+		{proxyPath: "v1/namespaces/default/pods", expectedCode: http.StatusOK},
+		{proxyPath: "v1/namespaces/default/pods/test/log", expectedCode: http.StatusOK},
+		{proxyPath: "v1/nodes", expectedCode: http.StatusOK},
+		{proxyPath: "v1/nodesx", expectedCode: http.StatusForbidden},
+		{proxyPath: "v1/namespaces/default/secrets", expectedCode: http.StatusForbidden},
+		{proxyPath: "v1/namespaces/kube-system/pods", expectedCode: http.StatusForbidden},
+		// the path cannot escape from the root path
+		{proxyPath: "v1/namespaces/default/pods/../../../../../anything", expectedCode: http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		t.Run(c.proxyPath, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler, err := rest.Connect(context.TODO(), "cluster1",
+				&aggregationv1.ClusterStatusProxyOptions{Path: c.proxyPath},
+				&statusResponder{fakeResponder: fakeResponder{t: t}, w: w})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, testRequestPathPrefix+"sub/"+c.proxyPath, nil)
+			auditEvent := &auditinternal.Event{Level: auditinternal.LevelMetadata}
+			req = req.WithContext(request.WithAuditEvent(req.Context(), auditEvent))
+			handler.ServeHTTP(w, req)
+			if w.Code != c.expectedCode {
+				t.Errorf("expected status %d, but %d: %s", c.expectedCode, w.Code, w.Body.String())
+			}
+			if c.expectedCode == http.StatusForbidden {
+				if err := decodeStatus(t, w); !errors.IsForbidden(err) || ReasonForError(err) != ReasonPathNotAllowed {
+					t.Errorf("expected path not allowed status, but %v", err)
+				}
+			}
+
+			// the violations are audited
+			violation := auditEvent.Annotations[AuditAnnotationPathViolation]
+			if (c.expectedCode == http.StatusForbidden) != (violation != "") {
+				t.Errorf("unexpected path violation %q", violation)
+			}
+		})
+	}
+}
+
+// subResourceLabels returns the sub-resource labels of the request metrics of a cluster
+func subResourceLabels(t *testing.T, clusterName string) sets.String {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	subResources := sets.NewString()
+	for _, family := range families {
+		if family.GetName() != "aggregator_proxy_requests_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["cluster"] == clusterName {
+				subResources.Insert(labels["sub_resource"])
+			}
+		}
+	}
+	return subResources
+}
+
+func TestSubResourceMetrics(t *testing.T) {
+	metrics.Register()
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(newTestServiceInfo(backend, "sub"))
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("metrics-cluster"), Config{})
+
+	// the sub-resources that are not routed are recorded as unknown
+	pathPrefix := "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/metrics-cluster/aggregator/"
+	for _, subResource := range []string{"sub", "random-1", "random-2"} {
+		w := httptest.NewRecorder()
+		handler, err := rest.Connect(context.TODO(), "metrics-cluster",
+			&aggregationv1.ClusterStatusProxyOptions{Path: subResource + "/pods"},
+			&statusResponder{fakeResponder: fakeResponder{t: t}, w: w})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, pathPrefix+subResource+"/pods", nil))
+	}
+
+	if labels := subResourceLabels(t, "metrics-cluster"); !labels.Equal(sets.NewString("sub", unknownSubResource)) {
+		t.Errorf("expected the sub-resource labels sub and unknown, but %v", labels.List())
+	}
+}
+
+func TestAuthorizeRoutedSubResource(t *testing.T) {
+	backend := newEchoBackend()
+	defer backend.Close()
+
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(newTestServiceInfo(backend, "metrics"))
+	// the user is only allowed to access the metrics sub-resource of cluster1
+	subResourceAuthorizer := authorization.NewAggregatorAuthorizer(
+		authorizer.AuthorizerFunc(func(attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+			if attrs.GetSubresource() == "aggregator/metrics" && attrs.GetName() == "cluster1" {
+				return authorizer.DecisionAllow, "", nil
+			}
+			return authorizer.DecisionNoOpinion, "no rule", nil
+		}), serviceInfoGetter)
+	rest := NewAggregatorProxyRest(
+		serviceInfoGetter, newTestClusterSource("cluster1"), Config{Authorizer: subResourceAuthorizer})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler, err := rest.Connect(context.TODO(), "cluster1", &aggregationv1.ClusterStatusProxyOptions{Path: path},
+			&statusResponder{fakeResponder: fakeResponder{t: t}, w: w})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		req := httptest.NewRequest(http.MethodGet, testRequestPathPrefix+strings.TrimPrefix(path, "/"), nil)
+		ctx := request.WithUser(req.Context(), &user.DefaultInfo{Name: "test"})
+		ctx = request.WithRequestInfo(ctx, &request.RequestInfo{IsResourceRequest: true, Verb: "get",
+			APIGroup: aggregationv1.GroupName, APIVersion: "v1", Resource: "clusterstatuses", Subresource: "aggregator",
+			Name: "cluster1"})
+		handler.ServeHTTP(w, req.WithContext(ctx))
+		return w
+	}
+
+	if w := serve("/metrics/v2/pods"); w.Code != http.StatusOK {
+		t.Errorf("expected the request to the metrics sub-resource is proxied, but %d: %s", w.Code, w.Body.String())
+	}
+
+	// the request is routed to a newly registered sub-resource after it was authorized
+	serviceInfoGetter.AddAggregatorServiceInfo(newTestServiceInfo(backend, "metrics/v2"))
+	w := serve("/metrics/v2/pods")
+	if err := decodeStatus(t, w); w.Code != http.StatusForbidden || ReasonForError(err) != ReasonSubResourceForbidden {
+		t.Errorf("expected the request to the metrics/v2 sub-resource is forbidden, but %d: %v", w.Code, err)
+	}
+}
+
+func TestErrorResponseSizeMetrics(t *testing.T) {
+	metrics.Register()
+	rest := NewAggregatorProxyRest(getter.NewAggregatorServiceInfoGetter(), newTestClusterSource("size-cluster"), Config{})
+	w := httptest.NewRecorder()
+	handler, err := rest.Connect(context.TODO(), "size-cluster", &aggregationv1.ClusterStatusProxyOptions{Path: "/sub"},
+		&statusResponder{fakeResponder: fakeResponder{t: t}, w: w})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/size-cluster/aggregator/sub", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, but %d", w.Code)
+	}
+
+	// the Status written by the proxy is counted in the response size
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var size float64
+	for _, family := range families {
+		if family.GetName() != "aggregator_proxy_response_size_bytes" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "cluster" && label.GetValue() == "size-cluster" {
+					size += metric.GetHistogram().GetSampleSum()
+				}
+			}
+		}
+	}
+	if int(size) != w.Body.Len() {
+		t.Errorf("expected the response size %d, but %v", w.Body.Len(), size)
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	aggregationv1 "github.com/skeeey/aggregator-proxy-server/pkg/apis/aggregation/v1"
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"golang.org/x/net/websocket"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// newWebsocketEchoBackend returns a websocket backend that sends the request URI at first, then echoes the messages
+func newWebsocketEchoBackend() *httptest.Server {
+	return httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+		if err := websocket.Message.Send(ws, ws.Request().URL.RequestURI()); err != nil {
+			return
+		}
+		_, _ = io.Copy(ws, ws)
+	}))
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	backend := newWebsocketEchoBackend()
+	defer backend.Close()
+
+	serviceInfo := newTestServiceInfo(backend, "ws")
+	serviceInfo.UseID = true
+	serviceInfoGetter := getter.NewAggregatorServiceInfoGetter()
+	serviceInfoGetter.AddAggregatorServiceInfo(serviceInfo)
+	rest := NewAggregatorProxyRest(serviceInfoGetter, newTestClusterSource("cluster1"), Config{})
+
+	// the server connects the aggregator requests as the apiserver does, the proxy path is the path after
+	// aggregator/, including the sub-resource
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxyPath := "/" + strings.TrimPrefix(req.URL.Path, testRequestPathPrefix)
+		handler, err := rest.Connect(context.TODO(), "cluster1",
+			&aggregationv1.ClusterStatusProxyOptions{Path: proxyPath}, &fakeResponder{t: t})
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+
+	ws, err := websocket.Dial(
+		"ws://"+server.Listener.Addr().String()+testRequestPathPrefix+"ws/echo?stdin=true", "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer ws.Close()
+
+	var requestURI string
+	if err := websocket.Message.Receive(ws, &requestURI); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requestURI != "/cluster1/ws/echo?stdin=true" {
+		t.Errorf("expected the upgrade request /cluster1/ws/echo?stdin=true, but %s", requestURI)
+	}
+
+	for _, message := range []string{"hello", "world"} {
+		if err := websocket.Message.Send(ws, message); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var echoed string
+		if err := websocket.Message.Receive(ws, &echoed); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if echoed != message {
+			t.Errorf("expected echoed message %s, but %s", message, echoed)
+		}
+	}
+}
+
+func TestLongRunningRequestCheck(t *testing.T) {
+	check := LongRunningRequestCheck(func(r *http.Request, requestInfo *request.RequestInfo) bool {
+		return requestInfo.Verb == "watch"
+	})
+
+	aggregatorInfo := &request.RequestInfo{
+		IsResourceRequest: true,
+		Verb:              "get",
+		Resource:          "clusterstatuses",
+		Subresource:       "aggregator",
+	}
+
+	cases := []struct {
+		name        string
+		requestURL  string
+		upgrade     bool
+		requestInfo *request.RequestInfo
+		expected    bool
+	}{
+		{
+			name:        "delegated",
+			requestURL:  "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses?watch=true",
+			requestInfo: &request.RequestInfo{IsResourceRequest: true, Verb: "watch", Resource: "clusterstatuses"},
+			expected:    true,
+		},
+		{
+			name:        "upgrade request",
+			requestURL:  testRequestPathPrefix + "ws/exec",
+			upgrade:     true,
+			requestInfo: aggregatorInfo,
+			expected:    true,
+		},
+		{
+			name:        "watch request",
+			requestURL:  testRequestPathPrefix + "v1/pods?watch=1",
+			requestInfo: aggregatorInfo,
+			expected:    true,
+		},
+		{
+			name:        "follow logs request",
+			requestURL:  testRequestPathPrefix + "v1/namespaces/default/pods/test/log?follow=true",
+			requestInfo: aggregatorInfo,
+			expected:    true,
+		},
+		{
+			name:        "normal request",
+			requestURL:  testRequestPathPrefix + "v1/pods",
+			requestInfo: aggregatorInfo,
+			expected:    false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.requestURL, nil)
+			if c.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+			}
+			if longRunning := check(req, c.requestInfo); longRunning != c.expected {
+				t.Errorf("expected long running %v, but %v", c.expected, longRunning)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package retry
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	DefaultMaxAttempts = 3
+	DefaultBackoff     = 100 * time.Millisecond
+	DefaultMaxBackoff  = 2 * time.Second
+
+	// DefaultBudgetRatio allows the retries up to 20% of the proxied requests
+	DefaultBudgetRatio = 0.2
+	// DefaultBudgetBurst allows 10 retries before the budget is earned by the proxied requests
+	DefaultBudgetBurst = 10
+)
+
+// idempotentMethods are the methods that can be sent again without changing the result, see RFC 7231
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// Policy is the retry policy of an aggregator service
+type Policy struct {
+	// MaxAttempts is the max number of the attempts of a request, including the first one
+	MaxAttempts int
+	// RetryOnConnectionErrors retries the requests that cannot get a response, e.g. the connection is reset
+	RetryOnConnectionErrors bool
+	// RetryOnStatusCodes retries the requests that are responded with these codes
+	RetryOnStatusCodes []int
+	// Backoff is the wait before the first retry, it is doubled for each retry until MaxBackoff, the actual wait
+	// is jittered between the half and the whole of it
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// Complete returns the policy with the defaults of the unset fields
+func (p Policy) Complete() Policy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultMaxAttempts
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = DefaultBackoff
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = DefaultMaxBackoff
+	}
+	if p.MaxBackoff < p.Backoff {
+		p.MaxBackoff = p.Backoff
+	}
+	return p
+}
+
+// Budget limits the retries of all aggregator services to a ratio of the proxied requests, so the retries cannot
+// amplify the load of the failing backends
+type Budget struct {
+	ratio  float64
+	burst  float64
+	mutex  sync.Mutex
+	tokens float64
+}
+
+// NewBudget returns a budget that earns ratio of a retry for each request, and holds burst retries at most
+func NewBudget(ratio float64, burst int) *Budget {
+	return &Budget{ratio: ratio, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *Budget) deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens += b.ratio
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *Budget) withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type roundTripper struct {
+	delegate http.RoundTripper
+	name     string
+	policy   Policy
+	budget   *Budget
+}
+
+// NewRoundTripper returns a round tripper that retries the requests to an aggregator service with the policy, the
+// retries are withdrawn from the budget
+func NewRoundTripper(delegate http.RoundTripper, name string, policy Policy, budget *Budget) http.RoundTripper {
+	return &roundTripper{delegate: delegate, name: name, policy: policy.Complete(), budget: budget}
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.budget.deposit()
+	if !retryable(req) {
+		return rt.delegate.RoundTrip(req)
+	}
+
+	backoff := rt.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := rt.delegate.RoundTrip(req)
+		if attempt >= rt.policy.MaxAttempts || !rt.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+		if !rt.budget.withdraw() {
+			metrics.RecordRetryBudgetExhausted(rt.name)
+			return resp, err
+		}
+		if resp != nil {
+			// drain the body so the connection can be reused
+			_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		metrics.RecordRetry(rt.name)
+
+		timer := time.NewTimer(wait.Jitter(backoff/2, 1.0))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		if backoff *= 2; backoff > rt.policy.MaxBackoff {
+			backoff = rt.policy.MaxBackoff
+		}
+
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (rt *roundTripper) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		// the requests canceled by the clients are not retried
+		return rt.policy.RetryOnConnectionErrors && req.Context().Err() == nil
+	}
+	for _, code := range rt.policy.RetryOnStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable returns true if the request is idempotent and its body can be replayed
+func retryable(req *http.Request) bool {
+	if !idempotentMethods[req.Method] {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewind returns a request with the replayed body to send again
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	newReq := req.Clone(req.Context())
+	newReq.Body = body
+	return newReq, nil
+}
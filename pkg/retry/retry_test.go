@@ -0,0 +1,155 @@
+package retry
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeRoundTripper responds the requests with the results in order, and records the bodies of the requests
+type fakeRoundTripper struct {
+	results []interface{}
+	bodies  []string
+}
+
+func (rt *fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		rt.bodies = append(rt.bodies, string(body))
+	}
+	result := rt.results[0]
+	rt.results = rt.results[1:]
+	if err, ok := result.(error); ok {
+		return nil, err
+	}
+	return &http.Response{StatusCode: result.(int), Body: ioutil.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	policy := Policy{
+		MaxAttempts:             3,
+		RetryOnConnectionErrors: true,
+		RetryOnStatusCodes:      []int{http.StatusServiceUnavailable},
+		Backoff:                 time.Millisecond,
+	}
+	connectionReset := fmt.Errorf("connection reset by peer")
+
+	cases := []struct {
+		name             string
+		method           string
+		body             string
+		results          []interface{}
+		expectedAttempts int
+		expectedCode     int
+		expectedError    bool
+	}{
+		{
+			name:             "retry on connection error",
+			method:           http.MethodGet,
+			results:          []interface{}{connectionReset, http.StatusOK},
+			expectedAttempts: 2,
+			expectedCode:     http.StatusOK,
+		},
+		{
+			name:             "retry on status code",
+			method:           http.MethodGet,
+			results:          []interface{}{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK},
+			expectedAttempts: 3,
+			expectedCode:     http.StatusOK,
+		},
+		{
+			name:   "max attempts",
+			method: http.MethodHead,
+			results: []interface{}{
+				http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			expectedAttempts: 3,
+			expectedCode:     http.StatusServiceUnavailable,
+		},
+		{
+			name:             "not retry on other status code",
+			method:           http.MethodGet,
+			results:          []interface{}{http.StatusInternalServerError},
+			expectedAttempts: 1,
+			expectedCode:     http.StatusInternalServerError,
+		},
+		{
+			name:             "not retry non-idempotent method",
+			method:           http.MethodPost,
+			results:          []interface{}{connectionReset},
+			expectedAttempts: 1,
+			expectedError:    true,
+		},
+		{
+			name:             "retry with replayed body",
+			method:           http.MethodPut,
+			body:             "data",
+			results:          []interface{}{connectionReset, http.StatusOK},
+			expectedAttempts: 2,
+			expectedCode:     http.StatusOK,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			delegate := &fakeRoundTripper{results: c.results}
+			rt := NewRoundTripper(delegate, "default/sub", policy, NewBudget(DefaultBudgetRatio, DefaultBudgetBurst))
+
+			req, _ := http.NewRequest(c.method, "https://backend.default.svc/pods", nil)
+			if c.body != "" {
+				req, _ = http.NewRequest(c.method, "https://backend.default.svc/pods", bytes.NewBufferString(c.body))
+			}
+			resp, err := rt.RoundTrip(req)
+			if c.expectedError != (err != nil) {
+				t.Fatalf("expected error %v, but %v", c.expectedError, err)
+			}
+			if err == nil && resp.StatusCode != c.expectedCode {
+				t.Errorf("expected status %d, but %d", c.expectedCode, resp.StatusCode)
+			}
+			if attempts := len(c.results) - len(delegate.results); attempts != c.expectedAttempts {
+				t.Errorf("expected %d attempts, but %d", c.expectedAttempts, attempts)
+			}
+			for _, body := range delegate.bodies {
+				if body != c.body {
+					t.Errorf("expected body %q, but %q", c.body, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTripNotReplayableBody(t *testing.T) {
+	delegate := &fakeRoundTripper{results: []interface{}{fmt.Errorf("connection reset by peer")}}
+	rt := NewRoundTripper(delegate, "default/sub", Policy{RetryOnConnectionErrors: true}, NewBudget(1, 10))
+
+	// the body of a server request cannot be replayed
+	req := httptest.NewRequest(http.MethodPut, "/pods", bytes.NewBufferString("data"))
+	if _, err := rt.RoundTrip(req); err == nil {
+		t.Errorf("expected the error is returned without retries")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	delegate := &fakeRoundTripper{}
+	rt := NewRoundTripper(delegate, "default/sub",
+		Policy{MaxAttempts: 10, RetryOnStatusCodes: []int{http.StatusBadGateway}, Backoff: time.Millisecond},
+		NewBudget(0.5, 2))
+
+	// the burst allows 2 retries at first, then each request earns a half retry
+	for _, expected := range []int{3, 1, 2} {
+		delegate.results = []interface{}{}
+		for i := 0; i < 10; i++ {
+			delegate.results = append(delegate.results, http.StatusBadGateway)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "https://backend.default.svc/pods", nil)
+		if resp, _ := rt.RoundTrip(req); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expected status 502, but %d", resp.StatusCode)
+		}
+		if attempts := 10 - len(delegate.results); attempts != expected {
+			t.Errorf("expected %d attempts, but %d", expected, attempts)
+		}
+	}
+}
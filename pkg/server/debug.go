@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/proxy"
+	"k8s.io/apiserver/pkg/server/healthz"
+	"k8s.io/klog"
+)
+
+// CircuitBreakersPath is the debug endpoint that serves the states of the circuit breakers of the aggregator services
+const CircuitBreakersPath = "/debug/aggregator/circuitbreakers"
+
+// HealthPath is the debug endpoint that serves the health of the probed aggregator services
+const HealthPath = "/debug/aggregator/health"
+
+// ServicesPath is the debug endpoint that serves the registration states of the aggregator services
+const ServicesPath = "/debug/aggregator/services"
+
+// circuitBreakersHandler serves the states of the circuit breakers as json
+func circuitBreakersHandler(serviceInfoGetter *getter.AggregatorServiceInfoGetter) http.Handler {
+	return jsonHandler("circuit breakers", func() interface{} { return serviceInfoGetter.CircuitBreakers() })
+}
+
+// healthHandler serves the health of the probed aggregator services as json
+func healthHandler(serviceInfoGetter *getter.AggregatorServiceInfoGetter) http.Handler {
+	return jsonHandler("health states", func() interface{} { return serviceInfoGetter.HealthStatuses() })
+}
+
+// servicesHandler serves the registration states of the aggregator services as json
+func servicesHandler(serviceInfoGetter *getter.AggregatorServiceInfoGetter) http.Handler {
+	return jsonHandler("aggregator services", func() interface{} { return serviceInfoGetter.ServiceInfoStatuses() })
+}
+
+// jsonHandler serves the json of a debug state for the GET requests
+func jsonHandler(name string, state func() interface{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state()); err != nil {
+			klog.Errorf("failed to write the %s: %v", name, err)
+		}
+	})
+}
+
+// sourceSyncedCheck fails the readiness until the initial service infos of a source have been registered, so the
+// requests are not rejected as not found while the server is warming up
+func sourceSyncedCheck(source getter.ServiceInfoSource) healthz.HealthChecker {
+	return healthz.NamedCheck(source.Name(), func(_ *http.Request) error {
+		if !source.HasSynced() {
+			return fmt.Errorf("the %s have not been registered", source.Name())
+		}
+		return nil
+	})
+}
+
+// endpointsSyncedCheck fails the readiness until the services and the endpoints have been synced, so the requests
+// are not rejected as having no ready endpoint while the server is warming up
+func endpointsSyncedCheck(resolver *proxy.EndpointResolver) healthz.HealthChecker {
+	return healthz.NamedCheck("endpoints", func(_ *http.Request) error {
+		if !resolver.HasSynced() {
+			return fmt.Errorf("the services and the endpoints have not been synced")
+		}
+		return nil
+	})
+}
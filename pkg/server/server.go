@@ -2,7 +2,11 @@ package server
 
 import (
 	"github.com/skeeey/aggregator-proxy-server/pkg/api"
+	"github.com/skeeey/aggregator-proxy-server/pkg/authorization"
+	"github.com/skeeey/aggregator-proxy-server/pkg/cluster"
 	"github.com/skeeey/aggregator-proxy-server/pkg/getter"
+	"github.com/skeeey/aggregator-proxy-server/pkg/metrics"
+	"github.com/skeeey/aggregator-proxy-server/pkg/proxy"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/client-go/informers"
 )
@@ -14,16 +18,42 @@ type ProxyServer struct {
 func NewProxyServer(
 	informerFactory informers.SharedInformerFactory,
 	apiServerConfig *genericapiserver.Config,
-	serviceInfoGetter *getter.AggregatorServiceInfoGetter) (*ProxyServer, error) {
+	serviceInfoGetter *getter.AggregatorServiceInfoGetter,
+	sources []getter.ServiceInfoSource,
+	clusterSource cluster.Source,
+	proxyConfig proxy.Config) (*ProxyServer, error) {
+	// the server is ready after all sources have registered their initial service infos and the endpoints of the
+	// services have been synced if the requests are routed to the endpoints
+	for _, source := range sources {
+		apiServerConfig.ReadyzChecks = append(apiServerConfig.ReadyzChecks, sourceSyncedCheck(source))
+	}
+	if resolver := proxyConfig.EndpointResolver; resolver != nil {
+		apiServerConfig.ReadyzChecks = append(apiServerConfig.ReadyzChecks, endpointsSyncedCheck(resolver))
+	}
+
+	// authorize the aggregator requests per cluster and per aggregator sub-resource
+	apiServerConfig.Authorization.Authorizer = authorization.NewAggregatorAuthorizer(
+		apiServerConfig.Authorization.Authorizer, serviceInfoGetter)
+
 	apiServer, err := apiServerConfig.Complete(informerFactory).New("aggregator-proxy-server", genericapiserver.NewEmptyDelegate())
 	if err != nil {
 		return nil, err
 	}
 
-	if err := api.Install(serviceInfoGetter, apiServer); err != nil {
+	// serve the metrics of the proxy and the controllers on the /metrics endpoint
+	metrics.Register()
+
+	// the fan-out requests are authorized per cluster with the authorizer of the apiserver
+	proxyConfig.Authorizer = apiServerConfig.Authorization.Authorizer
+	if err := api.Install(serviceInfoGetter, clusterSource, proxyConfig, apiServer); err != nil {
 		return nil, err
 	}
 
+	// the debug endpoints are authorized as a non-resource url by the apiserver
+	apiServer.Handler.NonGoRestfulMux.Handle(CircuitBreakersPath, circuitBreakersHandler(serviceInfoGetter))
+	apiServer.Handler.NonGoRestfulMux.Handle(ServicesPath, servicesHandler(serviceInfoGetter))
+	apiServer.Handler.NonGoRestfulMux.Handle(HealthPath, healthHandler(serviceInfoGetter))
+
 	return &ProxyServer{apiServer}, nil
 }
 
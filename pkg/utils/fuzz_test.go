@@ -0,0 +1,50 @@
+//go:build go1.18
+// +build go1.18
+
+package utils
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func FuzzGetSubResource(f *testing.F) {
+	f.Add("/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/test/aggregator/subres/test")
+	f.Add("/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/test/aggregator/../test")
+	f.Add("/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/test/aggregator//test")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, requestPath string) {
+		subResource, err := GetSubResource(requestPath)
+		if err != nil {
+			return
+		}
+		if subResource == "" || subResource == "." || subResource == ".." || strings.Contains(subResource, "/") {
+			t.Errorf("unexpected sub-resource %q of %q", subResource, requestPath)
+		}
+	})
+}
+
+func FuzzJoinProxyPath(f *testing.F) {
+	f.Add("api", "v1/pods")
+	f.Add("api", "v1/../../anything")
+	f.Add("/api/", "..")
+	f.Add("", "a\\..\\b")
+
+	f.Fuzz(func(t *testing.T, rootPath, requestPath string) {
+		joined, err := JoinProxyPath(rootPath, requestPath)
+		if err != nil {
+			return
+		}
+		root := path.Join("/", rootPath)
+		if joined != root && !strings.HasPrefix(joined, strings.TrimSuffix(root, "/")+"/") {
+			t.Errorf("the joined path %q of %q is out of the root %q", joined, requestPath, root)
+		}
+		for _, segment := range strings.Split(strings.TrimPrefix(joined, root), "/") {
+			if segment == ".." || segment == "." {
+				t.Errorf("the joined path %q has dot segments", joined)
+			}
+		}
+	})
+}
@@ -2,12 +2,17 @@ package utils
 
 import (
 	"fmt"
+	"path"
 	"strings"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 )
 
+// AllClusters is the cluster name of the aggregator requests that are fanned out to all selected clusters.
+// request path: /apis/<group>/<version>/clusterstatuses/-/aggregator/<sub-resource>/xxx
+const AllClusters = "-"
+
 //MatchLabelForLabelSelector match labels for labelselector, if labelSelecor is nil, select everything
 func MatchLabelForLabelSelector(targetLabels map[string]string, labelSelector *metav1.LabelSelector) bool {
 	selector, err := convertLabels(labelSelector)
@@ -20,7 +25,7 @@ func MatchLabelForLabelSelector(targetLabels map[string]string, labelSelector *m
 	return false
 }
 
-// GetSubResource returns the sub-resource behind aggregator in a request path.
+// GetSubResource returns the first segment of the sub-resource behind aggregator in a request path.
 // request path: /apis/<group>/<version>/clusterstatuses/<cluster-name>/aggregator/<sub-resource>/xxx
 func GetSubResource(requestPath string) (string, error) {
 	requestPath = strings.Trim(requestPath, "/")
@@ -34,9 +39,56 @@ func GetSubResource(requestPath string) (string, error) {
 	}
 
 	//TODO: may need to check each field name
+	subResource := pathParts[6]
+	if subResource == "" || subResource == "." || subResource == ".." {
+		return "", fmt.Errorf("invalid sub-resource %q", subResource)
+	}
+	return subResource, nil
+}
+
+// GetSubResourcePath returns the path behind aggregator in a request path, it starts with the sub-resource, which
+// may have multiple segments, e.g. metrics/v1/pods.
+// request path: /apis/<group>/<version>/clusterstatuses/<cluster-name>/aggregator/<sub-resource>/xxx
+func GetSubResourcePath(requestPath string) (string, error) {
+	if _, err := GetSubResource(requestPath); err != nil {
+		return "", err
+	}
+
+	pathParts := strings.SplitN(strings.Trim(requestPath, "/"), "/", 7)
 	return pathParts[6], nil
 }
 
+// JoinProxyPath joins the path of a proxied request to the root path of its aggregator service. The request path is
+// rejected if it has dot segments, so the joined path is always under the root path.
+func JoinProxyPath(rootPath, requestPath string) (string, error) {
+	// some backends treat the backslashes as the separators too
+	segments := strings.FieldsFunc(requestPath, func(r rune) bool { return r == '/' || r == '\\' })
+	for _, segment := range segments {
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("the path %q has dot segments", requestPath)
+		}
+	}
+
+	root := path.Join("/", rootPath)
+	joined := path.Join(root, requestPath)
+	if joined != root && !strings.HasPrefix(joined, strings.TrimSuffix(root, "/")+"/") {
+		return "", fmt.Errorf("the path %q is out of the root path %q", requestPath, root)
+	}
+	return joined, nil
+}
+
+// ReplaceClusterName replaces the cluster name in a request path with the given cluster name.
+// request path: /apis/<group>/<version>/clusterstatuses/<cluster-name>/aggregator/<sub-resource>/xxx
+func ReplaceClusterName(requestPath, clusterName string) string {
+	pathParts := strings.Split(requestPath, "/")
+	// the leading slash results in an empty first part
+	if len(pathParts) < 6 || pathParts[0] != "" {
+		return requestPath
+	}
+	pathParts[5] = clusterName
+	return strings.Join(pathParts, "/")
+}
+
 func convertLabels(labelSelector *metav1.LabelSelector) (labels.Selector, error) {
 	if labelSelector != nil {
 		selector, err := metav1.LabelSelectorAsSelector(labelSelector)
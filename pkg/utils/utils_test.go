@@ -30,3 +30,60 @@ func TestGetSubResource(t *testing.T) {
 		t.Errorf("Expect subres, but %s", subResource)
 	}
 }
+
+func TestGetSubResourcePath(t *testing.T) {
+	if _, err := GetSubResourcePath("/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/test/aggregator/"); err == nil {
+		t.Errorf("Expect format error, but failed")
+	}
+
+	subResourcePath, err := GetSubResourcePath(
+		"/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/test/aggregator/metrics/v1/pods/")
+	if err != nil {
+		t.Errorf("Expect no error, but failed, %v", err)
+	}
+	if subResourcePath != "metrics/v1/pods" {
+		t.Errorf("Expect metrics/v1/pods, but %s", subResourcePath)
+	}
+}
+
+func TestReplaceClusterName(t *testing.T) {
+	fanOutPath := "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/-/aggregator/subres/test"
+	expected := "/apis/aggregation.open-cluster-management.io/v1/clusterstatuses/cluster1/aggregator/subres/test"
+	if clusterPath := ReplaceClusterName(fanOutPath, "cluster1"); clusterPath != expected {
+		t.Errorf("Expect %s, but %s", expected, clusterPath)
+	}
+
+	wrongPath := "/apis/aggregation.open-cluster-management.io"
+	if clusterPath := ReplaceClusterName(wrongPath, "cluster1"); clusterPath != wrongPath {
+		t.Errorf("Expect %s, but %s", wrongPath, clusterPath)
+	}
+}
+
+func TestJoinProxyPath(t *testing.T) {
+	cases := []struct {
+		rootPath      string
+		requestPath   string
+		expected      string
+		expectedError bool
+	}{
+		{rootPath: "api", requestPath: "v1/pods", expected: "/api/v1/pods"},
+		{rootPath: "", requestPath: "/v1/pods/", expected: "/v1/pods"},
+		{rootPath: "api", requestPath: "", expected: "/api"},
+		{rootPath: "api", requestPath: "v1//pods", expected: "/api/v1/pods"},
+		{rootPath: "api", requestPath: "v1/../../anything", expectedError: true},
+		{rootPath: "api", requestPath: "v1/../pods", expectedError: true},
+		{rootPath: "api", requestPath: "./pods", expectedError: true},
+		{rootPath: "api", requestPath: "v1\\..\\..\\anything", expectedError: true},
+		{rootPath: "api", requestPath: "v1/..pods", expected: "/api/v1/..pods"},
+	}
+
+	for _, c := range cases {
+		joined, err := JoinProxyPath(c.rootPath, c.requestPath)
+		if c.expectedError != (err != nil) {
+			t.Errorf("expected error %v for %q, but %v", c.expectedError, c.requestPath, err)
+		}
+		if joined != c.expected {
+			t.Errorf("expected %q, but %q", c.expected, joined)
+		}
+	}
+}